@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"github.com/tshprecher/mcache/protocol"
+	"os"
+	"strings"
+)
+
+// loadPasswords reads a password file in memcached's format, a
+// "<username>:<password>" entry per line. Blank lines and lines starting
+// with # are skipped.
+func loadPasswords(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	passwords := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		i := strings.Index(entry, ":")
+		if i <= 0 || i == len(entry)-1 {
+			return nil, fmt.Errorf("%s:%d: expected <username>:<password>", path, line)
+		}
+		passwords[entry[:i]] = entry[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(passwords) == 0 {
+		return nil, fmt.Errorf("no users found in '%s'", path)
+	}
+	return passwords, nil
+}
+
+// Authenticate checks the credentials against the password file, counting
+// the attempt for the stats command.
+func (s *Server) Authenticate(username, password string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authCmds++
+	expected, ok := s.passwords[username]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		s.authErrors++
+		return false
+	}
+	return true
+}
+
+// enableAuth lets the session authenticate against the password file, if
+// there is one.
+func (s *Server) enableAuth(session *protocol.TextSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.passwords != nil {
+		session.EnableAuth(s, s.requireAuth)
+	}
+}
@@ -26,7 +26,6 @@ func TestIntegrationClient(t *testing.T) {
 	server := &Server{
 		port:       11210,
 		se:         se,
-		lis:        nil,
 		maxValSize: 1024,
 		timeout:    2,
 		mu:         sync.Mutex{}}
@@ -49,6 +48,18 @@ func TestIntegrationClient(t *testing.T) {
 
 	*se = *store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
 	testCliCas(t)
+
+	*se = *store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	testCliAddAndReplace(t)
+
+	*se = *store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	testCliIncrAndDecr(t)
+
+	*se = *store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	testCliTouch(t)
+
+	*se = *store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	testCliFlushAll(t)
 }
 
 func testCliSetAndGet(t *testing.T) {
@@ -73,7 +84,7 @@ func testCliSetAndGet(t *testing.T) {
 		t.Errorf("expected nil error")
 	}
 	if !itemValuesEqual(item, item1) {
-		t.Errorf("expected %v to equal $v", *item, *item1)
+		t.Errorf("expected %v to equal %v", *item, *item1)
 	}
 }
 
@@ -93,10 +104,10 @@ func testCliGets(t *testing.T) {
 		t.Errorf("expected two results, received %d", len(res))
 	}
 	if !itemValuesEqual(res["foo"], fooItem) {
-		t.Errorf("expected %v to equal $v", res["foo"], *fooItem)
+		t.Errorf("expected %v to equal %v", res["foo"], *fooItem)
 	}
 	if !itemValuesEqual(res["bar"], barItem) {
-		t.Errorf("expected %v to equal $v", res["bar"], *barItem)
+		t.Errorf("expected %v to equal %v", res["bar"], *barItem)
 	}
 }
 
@@ -113,10 +124,10 @@ func testCliMultipleSessions(t *testing.T) {
 	item2, _ := mc2.Get("bar")
 
 	if !itemValuesEqual(item1, fooItem) {
-		t.Errorf("expected %v to equal $v", *item1, *fooItem)
+		t.Errorf("expected %v to equal %v", *item1, *fooItem)
 	}
 	if !itemValuesEqual(item2, barItem) {
-		t.Errorf("expected %v to equal $v", *item2, *barItem)
+		t.Errorf("expected %v to equal %v", *item2, *barItem)
 	}
 }
 
@@ -165,3 +176,89 @@ func testCliCas(t *testing.T) {
 		t.Errorf("expected nil error, received %v", err)
 	}
 }
+
+func testCliAddAndReplace(t *testing.T) {
+	mc := memcache.New("localhost:11210")
+
+	err := mc.Replace(&memcache.Item{Key: "foo", Flags: 3, Value: []byte("my value")})
+	if err != memcache.ErrNotStored {
+		t.Errorf("expected not stored, received %v", err)
+	}
+
+	fooItem := &memcache.Item{Key: "foo", Flags: 3, Value: []byte("my value")}
+	err = mc.Add(fooItem)
+	if err != nil {
+		t.Errorf("expected nil error, received %v", err)
+	}
+	err = mc.Add(&memcache.Item{Key: "foo", Flags: 3, Value: []byte("my value 2")})
+	if err != memcache.ErrNotStored {
+		t.Errorf("expected not stored, received %v", err)
+	}
+	item, _ := mc.Get("foo")
+	if !itemValuesEqual(item, fooItem) {
+		t.Errorf("expected %v to equal %v", item, *fooItem)
+	}
+
+	fooItem2 := &memcache.Item{Key: "foo", Flags: 2, Value: []byte("my value 2")}
+	err = mc.Replace(fooItem2)
+	if err != nil {
+		t.Errorf("expected nil error, received %v", err)
+	}
+	item, _ = mc.Get("foo")
+	if !itemValuesEqual(item, fooItem2) {
+		t.Errorf("expected %v to equal %v", item, *fooItem2)
+	}
+}
+
+func testCliIncrAndDecr(t *testing.T) {
+	mc := memcache.New("localhost:11210")
+
+	_, err := mc.Increment("counter", 1)
+	if err != memcache.ErrCacheMiss {
+		t.Errorf("expected cache miss, received %v", err)
+	}
+
+	mc.Set(&memcache.Item{Key: "counter", Value: []byte("41")})
+	value, err := mc.Increment("counter", 1)
+	if err != nil || value != 42 {
+		t.Errorf("expected 42 and nil error, received %d and %v", value, err)
+	}
+	value, err = mc.Decrement("counter", 50)
+	if err != nil || value != 0 {
+		t.Errorf("expected 0 and nil error, received %d and %v", value, err)
+	}
+}
+
+func testCliTouch(t *testing.T) {
+	mc := memcache.New("localhost:11210")
+
+	err := mc.Touch("foo", 10)
+	if err != memcache.ErrCacheMiss {
+		t.Errorf("expected cache miss, received %v", err)
+	}
+
+	mc.Set(&memcache.Item{Key: "foo", Flags: 3, Value: []byte("my value")})
+	err = mc.Touch("foo", -1)
+	if err != nil {
+		t.Errorf("expected nil error, received %v", err)
+	}
+	item, err := mc.Get("foo")
+	if err != memcache.ErrCacheMiss {
+		t.Errorf("expected cache miss, received %v and %v", item, err)
+	}
+}
+
+func testCliFlushAll(t *testing.T) {
+	mc := memcache.New("localhost:11210")
+	mc.Set(&memcache.Item{Key: "foo", Flags: 3, Value: []byte("my value")})
+	mc.Set(&memcache.Item{Key: "bar", Flags: 3, Value: []byte("my value 2")})
+
+	err := mc.FlushAll()
+	if err != nil {
+		t.Errorf("expected nil error, received %v", err)
+	}
+	res, err := mc.GetMulti([]string{"foo", "bar"})
+	if err != nil || len(res) != 0 {
+		t.Errorf("expected no results and nil error, received %v and %v", res, err)
+	}
+}
@@ -0,0 +1,275 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"github.com/golang/glog"
+	"github.com/tshprecher/mcache/protocol"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// errWouldBlock is returned by a nonblockingReader when no bytes are
+// available, telling the worker to hand the session back to its poller.
+var errWouldBlock = errors.New("read would block")
+
+// sweepInterval is the time between sweeps of the sessions waiting on a
+// poller for those that are idle past the timeout or draining.
+const sweepInterval = time.Second
+
+// nonblockingReader reads whatever bytes a connection has available without
+// waiting for more.
+type nonblockingReader struct {
+	rc syscall.RawConn
+}
+
+func (r nonblockingReader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if rerr := r.rc.Read(func(fd uintptr) bool {
+			n, err = syscall.Read(int(fd), p)
+			return true
+		}); rerr != nil {
+			return 0, rerr
+		}
+		switch {
+		case err == syscall.EINTR:
+			continue
+		case err == syscall.EAGAIN:
+			return 0, errWouldBlock
+		case err != nil:
+			return 0, err
+		case n == 0:
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+}
+
+// polledSession is a session registered with a poller. It is either armed,
+// waiting in epoll for its connection to become readable, or handed to a
+// worker, never both.
+type polledSession struct {
+	session *protocol.TextSession
+	fd      int
+	p       *poller
+	armed   bool
+}
+
+// A poller watches a set of connections with its own epoll instance.
+type poller struct {
+	epfd     int
+	mu       sync.Mutex
+	sessions map[int]*polledSession // keyed by fd, guarded by mu
+}
+
+// arm registers the session for a single readable event.
+func (p *poller) arm(ps *polledSession, op int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ps.armed = true
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT, Fd: int32(ps.fd)}
+	if err := syscall.EpollCtl(p.epfd, op, ps.fd, &event); err != nil {
+		ps.armed = false
+		return err
+	}
+	return nil
+}
+
+func (p *poller) remove(ps *polledSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sessions[ps.fd] == ps {
+		delete(p.sessions, ps.fd)
+	}
+}
+
+// An eventLoop serves sessions with a few pollers detecting which
+// connections are readable and a bounded pool of workers serving them, so
+// an idle connection costs no goroutine.
+type eventLoop struct {
+	pollers []*poller
+	next    uint64 // incremented atomically by the accept loop of each listener
+	ready   chan *polledSession
+	timeout time.Duration
+
+	// ended is called once a session is closed
+	ended func(*protocol.TextSession)
+
+	stop        chan struct{}
+	pollersDone sync.WaitGroup
+	workersDone sync.WaitGroup
+}
+
+// newEventLoop starts an eventLoop with the given number of pollers and
+// workers. Sessions idle for longer than timeout are closed, unless timeout
+// is <= 0.
+func newEventLoop(pollers, workers int, timeout time.Duration, ended func(*protocol.TextSession)) (*eventLoop, error) {
+	if pollers <= 0 || workers <= 0 {
+		return nil, errors.New("the epoll network mode needs at least one poller and one worker")
+	}
+	l := &eventLoop{
+		ready:   make(chan *polledSession, workers),
+		timeout: timeout,
+		ended:   ended,
+		stop:    make(chan struct{}),
+	}
+	for i := 0; i < pollers; i++ {
+		epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		p := &poller{epfd: epfd, sessions: map[int]*polledSession{}}
+		l.pollers = append(l.pollers, p)
+		l.pollersDone.Add(1)
+		go l.poll(p)
+	}
+	for i := 0; i < workers; i++ {
+		l.workersDone.Add(1)
+		go l.work()
+	}
+	return l, nil
+}
+
+// newSession wraps the connection in a TextSession reading without blocking.
+func (l *eventLoop) newSession(conn net.Conn, s *Server) (*protocol.TextSession, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("the epoll network mode needs a connection with a file descriptor")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	return protocol.NewSessionFromReader(conn, nonblockingReader{rc}, s.se, s, s.maxValSize, s.timeout, s.writeTimeout), nil
+}
+
+// add registers the session with the next poller, round robin.
+func (l *eventLoop) add(session *protocol.TextSession, conn net.Conn) error {
+	rc, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	fd := -1
+	rc.Control(func(sysfd uintptr) {
+		fd = int(sysfd)
+	})
+	p := l.pollers[(atomic.AddUint64(&l.next, 1)-1)%uint64(len(l.pollers))]
+	ps := &polledSession{session: session, fd: fd, p: p}
+	p.mu.Lock()
+	p.sessions[fd] = ps
+	p.mu.Unlock()
+	if err := p.arm(ps, syscall.EPOLL_CTL_ADD); err != nil {
+		p.remove(ps)
+		return err
+	}
+	return nil
+}
+
+// poll hands sessions that become readable to the workers, and periodically
+// closes the ones waiting that have timed out or are draining.
+func (l *eventLoop) poll(p *poller) {
+	defer l.pollersDone.Done()
+	defer syscall.Close(p.epfd)
+	events := make([]syscall.EpollEvent, 128)
+	lastSweep := time.Now()
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, int(sweepInterval/time.Millisecond))
+		select {
+		case <-l.stop:
+			return
+		default:
+		}
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			glog.Errorf("error polling: %v", err)
+			return
+		}
+		var ready []*polledSession
+		p.mu.Lock()
+		for _, event := range events[:n] {
+			if ps := p.sessions[int(event.Fd)]; ps != nil && ps.armed {
+				ps.armed = false
+				ready = append(ready, ps)
+			}
+		}
+		p.mu.Unlock()
+		for _, ps := range ready {
+			l.ready <- ps
+		}
+		if time.Since(lastSweep) >= sweepInterval {
+			l.sweep(p)
+			lastSweep = time.Now()
+		}
+	}
+}
+
+// sweep closes the armed sessions of the poller that have been idle past
+// the timeout or are draining. An armed session has no buffered responses,
+// since they are flushed before a read that would block.
+func (l *eventLoop) sweep(p *poller) {
+	now := time.Now()
+	var expired []*polledSession
+	p.mu.Lock()
+	for fd, ps := range p.sessions {
+		idle := l.timeout > 0 && now.Sub(ps.session.LastActive()) >= l.timeout
+		if ps.armed && (idle || ps.session.Draining()) {
+			ps.armed = false
+			delete(p.sessions, fd)
+			expired = append(expired, ps)
+		}
+	}
+	p.mu.Unlock()
+	for _, ps := range expired {
+		ps.session.Close()
+		l.ended(ps.session)
+	}
+}
+
+// work serves readable sessions until they would block, then hands them
+// back to their poller.
+func (l *eventLoop) work() {
+	defer l.workersDone.Done()
+	for ps := range l.ready {
+		l.serve(ps)
+	}
+}
+
+func (l *eventLoop) serve(ps *polledSession) {
+	session := ps.session
+	for session.Alive() {
+		err := session.Serve()
+		if err == errWouldBlock {
+			if err = ps.p.arm(ps, syscall.EPOLL_CTL_MOD); err == nil {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				glog.Errorf("error serving: %v", err)
+			}
+			session.Close()
+		}
+	}
+	ps.p.remove(ps)
+	l.ended(session)
+}
+
+// close stops the pollers, which notice within the sweep interval, and then
+// the workers. Sessions still registered are left open.
+func (l *eventLoop) close() {
+	close(l.stop)
+	l.pollersDone.Wait()
+	close(l.ready)
+	l.workersDone.Wait()
+}
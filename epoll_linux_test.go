@@ -0,0 +1,69 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"github.com/tshprecher/mcache/store"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIntegrationEpoll(t *testing.T) {
+	se := store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024 * 1024))
+	server := &Server{
+		port:       11205,
+		se:         se,
+		maxValSize: 64 * 1024,
+		timeout:    5,
+		netMode:    "epoll",
+		pollers:    2,
+		workers:    4,
+		mu:         sync.Mutex{}}
+	go server.Start()
+	defer server.Stop()
+	time.Sleep(500 * time.Millisecond)
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:11205")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+
+	// commands split across reads, pipelined, and with a value larger than
+	// the read buffer are served without blocking a worker
+	value := strings.Repeat("x", 32*1024)
+	testMessages(t, conn,
+		[]string{
+			"set key 0 0 1\r",
+			"\n1\r\n",
+			"set big 0 0 32768\r\n" + value[:1000],
+			value[1000:] + "\r\nget key\r\nincr key 2\r\n",
+		},
+		[]string{
+			"STORED\r\n",
+			"STORED\r\n",
+			"VALUE key 0 1\r\n",
+			"1\r\n",
+			"END\r\n",
+			"3\r\n",
+		},
+	)
+	bin, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer bin.Close()
+	bin.Write(binaryPacket(0x80, 0x0a, 0, 0, nil, nil, nil))
+	resp := make([]byte, 24)
+	bin.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := bin.Read(resp); err != nil || resp[0] != 0x81 || resp[1] != 0x0a {
+		t.Errorf("expected a binary noop response, received %v %v", resp, err)
+	}
+	conn.Close()
+	bin.Close()
+
+	// idle sessions cost no goroutine
+	testIdleSessions(t, server, 10000, 100)
+}
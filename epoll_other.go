@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"github.com/tshprecher/mcache/protocol"
+	"net"
+	"time"
+)
+
+// eventLoop is only implemented on linux, where it is backed by epoll.
+type eventLoop struct{}
+
+func newEventLoop(pollers, workers int, timeout time.Duration, ended func(*protocol.TextSession)) (*eventLoop, error) {
+	return nil, errors.New("the epoll network mode is only supported on linux")
+}
+
+func (l *eventLoop) newSession(conn net.Conn, s *Server) (*protocol.TextSession, error) {
+	return nil, errors.New("the epoll network mode is only supported on linux")
+}
+
+func (l *eventLoop) add(session *protocol.TextSession, conn net.Conn) error {
+	return errors.New("the epoll network mode is only supported on linux")
+}
+
+func (l *eventLoop) close() {}
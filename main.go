@@ -2,32 +2,163 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/golang/glog"
 	"github.com/tshprecher/mcache/store"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 var (
 	// flags
-	port       = flag.Int("port", 11211, "server port")
-	cap        = flag.Int("cap", 1024*1024*1024, "total capacity in bytes (including keys)")
-	timeout    = flag.Int("timeout", 5, "maximum time in seconds an idle connection is open")
-	maxValSize = flag.Int("max_val_size", 0, "max size of a value in bytes, <= 0 for no limit")
+	port           = flag.Int("port", 11211, "server port")
+	udpPort        = flag.Int("udp_port", 0, "port to serve the text protocol over udp, 0 to disable")
+	listen         = flag.String("listen", "", "comma-separated addresses to listen on, each host:port, tls:host:port or unix:/path/to.sock, defaulting to :port")
+	tlsCert        = flag.String("tls_cert", "", "certificate file in PEM format for tls: listeners")
+	tlsKey         = flag.String("tls_key", "", "private key file in PEM format for tls: listeners")
+	tlsCA          = flag.String("tls_ca", "", "CA bundle in PEM format to verify client certificates against, empty to not require them")
+	tlsMinVersion  = flag.String("tls_min_version", "1.2", "minimum TLS version accepted: 1.0, 1.1, 1.2 or 1.3")
+	tlsCiphers     = flag.String("tls_ciphers", "", "comma-separated cipher suites accepted for TLS 1.2 and below, empty for the defaults")
+	authFile       = flag.String("auth_file", "", "password file of username:password lines clients can authenticate against with SASL PLAIN or the text protocol")
+	requireAuth    = flag.Bool("require_auth", false, "refuse every command but auth until a client has authenticated against auth_file")
+	socketPerms    = flag.String("socket_perms", "0700", "permissions in octal of unix sockets")
+	cap            = flag.Int("cap", 1024*1024*1024, "total capacity in bytes (including keys)")
+	timeout        = flag.Int("timeout", 5, "maximum time in seconds an idle connection is open, <= 0 for no limit")
+	writeTimeout   = flag.Int("write_timeout", 5, "maximum time in seconds a client has to accept a response, <= 0 for no limit")
+	maxValSize     = flag.Int("max_val_size", 0, "max size of a value in bytes, <= 0 for no limit")
+	reapInterval   = flag.Int("reap_interval", 1, "time in seconds between removals of expired values, <= 0 to only expire values lazily")
+	reapBatch      = flag.Int("reap_batch", 1000, "maximum number of expired values removed while holding the storage engine lock")
+	engine         = flag.String("engine", "simple", "storage engine: 'simple' for a single lock or 'striped' for a lock per shard")
+	shards         = flag.Int("shards", 16, "number of shards for the striped storage engine")
+	eviction       = flag.String("eviction", "lru", "eviction policy: 'lru' for least recently used, 'lfu' for least frequently used, 'tinylfu' for W-TinyLFU, 'arc' for adaptive replacement, or 's3fifo' for S3-FIFO")
+	lfuDecay       = flag.Int("lfu_decay", 0, "number of reads and writes after which the lfu eviction policy halves every key's frequency, <= 0 to never decay")
+	maxConns       = flag.Int("max_conns", 1024, "maximum number of open connections, <= 0 for no limit")
+	reservedConns  = flag.Int("reserved_conns", 4, "number of connections under max_conns reserved for admin and stats commands")
+	netMode        = flag.String("net_mode", "goroutines", "network mode: 'goroutines' for a goroutine per connection or 'epoll' for an event loop (linux only)")
+	pollers        = flag.Int("pollers", 4, "number of goroutines watching connections in the epoll network mode")
+	workers        = flag.Int("workers", 64, "number of goroutines serving readable connections in the epoll network mode")
+	enableShutdown = flag.Bool("enable_shutdown", false, "allow clients to stop the server with the shutdown command")
+	drainTimeout   = flag.Int("drain_timeout", 10, "maximum time in seconds to wait for open connections to finish on SIGTERM or SIGINT")
 )
 
+// newStorageEngine returns the storage engine selected by the flags.
+func newStorageEngine() (se interface {
+	store.StorageEngine
+	store.Reaper
+}, err error) {
+	var newPolicy func(cap int) store.EvictionPolicy
+	switch *eviction {
+	case "lru":
+		newPolicy = func(cap int) store.EvictionPolicy { return store.NewLruEvictionPolicy(cap) }
+	case "lfu":
+		newPolicy = func(cap int) store.EvictionPolicy { return store.NewLfuEvictionPolicy(cap, *lfuDecay) }
+	case "tinylfu":
+		newPolicy = func(cap int) store.EvictionPolicy { return store.NewTinyLfuEvictionPolicy(cap) }
+	case "arc":
+		newPolicy = func(cap int) store.EvictionPolicy { return store.NewArcEvictionPolicy(cap) }
+	case "s3fifo":
+		newPolicy = func(cap int) store.EvictionPolicy { return store.NewS3FifoEvictionPolicy(cap) }
+	default:
+		return nil, fmt.Errorf("unknown eviction policy '%s'", *eviction)
+	}
+	switch *engine {
+	case "simple":
+		se = store.NewSimpleStorageEngine(newPolicy(*cap))
+	case "striped":
+		se = store.NewStripedLockingStorageEngine(*shards, *cap, newPolicy, store.SystemClock)
+	default:
+		err = fmt.Errorf("unknown storage engine '%s'", *engine)
+	}
+	return
+}
+
 func main() {
 	flag.Parse()
-	glog.Infof("running server with port=%d cap=%d timeout=%ds max_val_size=%d", *port, *cap, *timeout, *maxValSize)
+	glog.Infof("running server with port=%d cap=%d timeout=%ds write_timeout=%ds max_val_size=%d engine=%s eviction=%s net_mode=%s", *port, *cap, *timeout, *writeTimeout, *maxValSize, *engine, *eviction, *netMode)
 	glog.Infof("initializing storage engine...")
+	se, err := newStorageEngine()
+	if err != nil {
+		glog.Fatal(err)
+	}
+	perms, err := strconv.ParseUint(*socketPerms, 8, 32)
+	if err != nil {
+		glog.Fatalf("malformed socket_perms '%s'", *socketPerms)
+	}
+	var addrs []string
+	if *listen != "" {
+		addrs = strings.Split(*listen, ",")
+	}
+	tlsOpts := tlsOptions{certFile: *tlsCert, keyFile: *tlsKey, caFile: *tlsCA, minVersion: *tlsMinVersion}
+	if *tlsCiphers != "" {
+		tlsOpts.ciphers = strings.Split(*tlsCiphers, ",")
+	}
+	if *reapInterval > 0 {
+		reaper := store.NewExpiryReaper(se, store.SystemClock, time.Duration(*reapInterval)*time.Second, *reapBatch)
+		reaper.Start()
+		defer reaper.Stop()
+	}
 	server := &Server{
-		port:       uint16(*port),
-		se:         store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(*cap)),
-		lis:        nil,
-		maxValSize: *maxValSize,
-		timeout:    *timeout,
-		mu:         sync.Mutex{}}
-	err := server.Start()
+		port:           uint16(*port),
+		listen:         addrs,
+		udpPort:        uint16(*udpPort),
+		tlsOpts:        tlsOpts,
+		authFile:       *authFile,
+		requireAuth:    *requireAuth,
+		socketPerms:    os.FileMode(perms),
+		se:             se,
+		maxValSize:     *maxValSize,
+		timeout:        *timeout,
+		writeTimeout:   *writeTimeout,
+		maxConns:       *maxConns,
+		reservedConns:  *reservedConns,
+		netMode:        *netMode,
+		pollers:        *pollers,
+		workers:        *workers,
+		enableShutdown: *enableShutdown,
+		mu:             sync.Mutex{}}
+	go drainOnSignal(server)
+	go reloadTLSOnSignal(server)
+	err = server.Start()
 	if err != nil {
 		glog.Fatal(err)
 	}
+	server.Wait()
+	glog.Info("server stopped")
+	glog.Flush()
+}
+
+// reloadTLSOnSignal reloads the TLS certificates on every SIGHUP.
+func reloadTLSOnSignal(server *Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := server.ReloadTLS(); err != nil {
+			glog.Errorf("error reloading tls certificates: %v", err)
+		} else {
+			glog.Info("reloaded tls certificates")
+		}
+	}
+}
+
+// drainOnSignal drains the server on SIGTERM or SIGINT, and exits right
+// away on a second signal.
+func drainOnSignal(server *Server) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	glog.Infof("received %v, draining connections for up to %ds...", sig, *drainTimeout)
+	go func() {
+		sig := <-signals
+		glog.Errorf("received %v while draining, exiting", sig)
+		glog.Flush()
+		os.Exit(1)
+	}()
+	if err := server.Drain(time.Duration(*drainTimeout) * time.Second); err != nil {
+		glog.Warning(err.Error())
+	}
 }
@@ -0,0 +1,518 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+)
+
+// see: https://github.com/memcached/memcached/wiki/BinaryProtocolRevamped
+const (
+	binaryHeaderLength = 24
+
+	binaryRequestMagic  = 0x80
+	binaryResponseMagic = 0x81
+
+	// opcodes
+	opGet        = 0x00
+	opSet        = 0x01
+	opAdd        = 0x02
+	opReplace    = 0x03
+	opDelete     = 0x04
+	opIncrement  = 0x05
+	opDecrement  = 0x06
+	opQuit       = 0x07
+	opFlush      = 0x08
+	opGetQ       = 0x09
+	opNoop       = 0x0a
+	opVersion    = 0x0b
+	opGetK       = 0x0c
+	opGetKQ      = 0x0d
+	opAppend     = 0x0e
+	opPrepend    = 0x0f
+	opStat       = 0x10
+	opSetQ       = 0x11
+	opAddQ       = 0x12
+	opReplaceQ   = 0x13
+	opDeleteQ    = 0x14
+	opIncrementQ = 0x15
+	opDecrementQ = 0x16
+	opQuitQ      = 0x17
+	opFlushQ     = 0x18
+	opAppendQ    = 0x19
+	opPrependQ   = 0x1a
+	opVerbosity  = 0x1b
+	opTouch      = 0x1c
+	opGat        = 0x1d
+	opGatQ       = 0x1e
+	opSaslList   = 0x20
+	opSaslAuth   = 0x21
+
+	// response statuses
+	statusNoError         = 0x0000
+	statusKeyNotFound     = 0x0001
+	statusKeyExists       = 0x0002
+	statusValueTooLarge   = 0x0003
+	statusInvalidArgs     = 0x0004
+	statusNotStored       = 0x0005
+	statusNonNumeric      = 0x0006
+	statusAuthError       = 0x0020
+	statusUnknownCommand  = 0x0081
+	statusInternalError   = 0x0084
+	binaryNoCreateExpTime = 0xffffffff
+)
+
+var (
+	// protocol errors
+	invalidMagic       = NewClientErrorResponse("invalid binary request magic")
+	invalidPacket      = NewClientErrorResponse("malformed binary request")
+	binaryValueTooLong = NewClientErrorResponse("value too large")
+
+	// quiet maps each quiet opcode to its regular counterpart
+	quiet = map[byte]byte{
+		opGetQ:       opGet,
+		opGetKQ:      opGetK,
+		opSetQ:       opSet,
+		opAddQ:       opAdd,
+		opReplaceQ:   opReplace,
+		opDeleteQ:    opDelete,
+		opIncrementQ: opIncrement,
+		opDecrementQ: opDecrement,
+		opQuitQ:      opQuit,
+		opFlushQ:     opFlush,
+		opAppendQ:    opAppend,
+		opPrependQ:   opPrepend,
+		opGatQ:       opGat,
+	}
+
+	// the error message for each status that is not the result of an ErrorResponse
+	statusMessages = map[uint16]string{
+		statusKeyNotFound: "Not found",
+		statusKeyExists:   "Data exists for key.",
+		statusNotStored:   "Not stored.",
+	}
+
+	_ MessageBuffer = &binaryProtocolMessageBuffer{}
+)
+
+// binaryRequest holds the fields of the request most recently read, which
+// are needed to encode the response.
+type binaryRequest struct {
+	sent   byte // the opcode as sent by the client
+	opcode byte // with any quiet variant mapped to its regular opcode
+	quiet  bool
+	opaque uint32
+	key    []byte
+}
+
+type binaryProtocolMessageBuffer struct {
+	wireIn     io.Reader
+	wireOut    io.Writer
+	maxValSize int
+	packet     []byte
+	read       int
+	req        binaryRequest
+}
+
+// NewBinaryProtocolMessageBuffer returns a MessageBuffer speaking the memcache
+// binary protocol. Responses are encoded from the same Response types used
+// by the text protocol, keyed off of the most recently read request.
+func NewBinaryProtocolMessageBuffer(wireIn io.Reader, wireOut io.Writer, maxValSize int) *binaryProtocolMessageBuffer {
+	return &binaryProtocolMessageBuffer{
+		wireIn:     wireIn,
+		wireOut:    wireOut,
+		maxValSize: maxValSize,
+		packet:     make([]byte, binaryHeaderLength),
+	}
+}
+
+// fill reads until the packet holds n bytes or no more bytes are available.
+// The packet grows by doubling as bytes arrive, so a header claiming a large
+// body cannot allocate more than twice what the client has sent.
+func (b *binaryProtocolMessageBuffer) fill(n int) error {
+	for b.read < n {
+		if b.read == len(b.packet) {
+			size := 2 * len(b.packet)
+			if size > n {
+				size = n
+			}
+			packet := make([]byte, size)
+			copy(packet, b.packet[:b.read])
+			b.packet = packet
+		}
+		end := n
+		if end > len(b.packet) {
+			end = len(b.packet)
+		}
+		r, err := b.wireIn.Read(b.packet[b.read:end])
+		b.read += r
+		if r == 0 {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *binaryProtocolMessageBuffer) Read() (cmd *Command, err error) {
+	// like the text protocol, only report a read error if no bytes were read
+	start := b.read
+	err = b.fill(binaryHeaderLength)
+	if b.read < binaryHeaderLength {
+		if b.read > start {
+			err = nil
+		}
+		return
+	}
+	header := b.packet[:binaryHeaderLength]
+	if header[0] != binaryRequestMagic {
+		b.read = 0
+		return nil, invalidMagic
+	}
+	opcode := header[1]
+	keyLen := int(binary.BigEndian.Uint16(header[2:4]))
+	extrasLen := int(header[4])
+	bodyLen := int(binary.BigEndian.Uint32(header[8:12]))
+	b.req.sent, b.req.opcode, b.req.quiet = opcode, opcode, false
+	if op, ok := quiet[opcode]; ok {
+		b.req.opcode, b.req.quiet = op, true
+	}
+	b.req.opaque = binary.BigEndian.Uint32(header[12:16])
+	b.req.key = nil
+	if keyLen+extrasLen > bodyLen {
+		b.read = 0
+		return nil, invalidPacket
+	}
+	if b.maxValSize > 0 && bodyLen-keyLen-extrasLen > b.maxValSize {
+		b.read = 0
+		return nil, binaryValueTooLong
+	}
+
+	err = b.fill(binaryHeaderLength + bodyLen)
+	if b.read < binaryHeaderLength+bodyLen {
+		if b.read > start {
+			err = nil
+		}
+		return
+	}
+	// the unpacked command must not alias the packet, which is reused
+	body := make([]byte, bodyLen)
+	copy(body, b.packet[binaryHeaderLength:binaryHeaderLength+bodyLen])
+	cas := int64(binary.BigEndian.Uint64(b.packet[16:24]))
+	b.read = 0
+
+	extras, key, value := body[:extrasLen], body[extrasLen:extrasLen+keyLen], body[extrasLen+keyLen:]
+	b.req.key = key
+	glog.Infof("received binary command: opcode=0x%02x key='%s'", opcode, key)
+	cmd, err = b.unpack(extras, string(key), value, cas)
+	if cmd != nil {
+		cmd.binary = true
+	}
+	return
+}
+
+func (b *binaryProtocolMessageBuffer) unpack(extras []byte, key string, value []byte, cas int64) (*Command, error) {
+	expect := func(extrasLen int, hasKey, hasValue bool) error {
+		if len(extras) != extrasLen || (len(key) > 0) != hasKey || (len(value) > 0 && !hasValue) || len(key) > MaxKeyLength {
+			return invalidPacket
+		}
+		return nil
+	}
+	cmd := &Command{}
+	switch b.req.opcode {
+	case opGet, opGetK:
+		if err := expect(0, true, false); err != nil {
+			return nil, err
+		}
+		cmd.retrievalCommand = &RetrievalCommand{Typ: GetCommand, keys: []string{key}}
+	case opGat:
+		if err := expect(4, true, false); err != nil {
+			return nil, err
+		}
+		cmd.retrievalCommand = &RetrievalCommand{Typ: GatCommand, ExpTime: int32(binary.BigEndian.Uint32(extras)), keys: []string{key}}
+	case opSet, opAdd, opReplace:
+		if err := expect(8, true, true); err != nil {
+			return nil, err
+		}
+		typ := map[byte]int{opSet: SetCommand, opAdd: AddCommand, opReplace: ReplaceCommand}[b.req.opcode]
+		if typ == SetCommand && cas != 0 {
+			typ = CasCommand
+		}
+		cmd.storageCommand = &StorageCommand{
+			Typ:       typ,
+			Key:       key,
+			Flags:     uint16(binary.BigEndian.Uint32(extras[0:4])),
+			ExpTime:   int32(binary.BigEndian.Uint32(extras[4:8])),
+			NumBytes:  uint32(len(value)),
+			CasUnique: cas,
+			DataBlock: value,
+		}
+	case opAppend, opPrepend:
+		if err := expect(0, true, true); err != nil {
+			return nil, err
+		}
+		typ := AppendCommand
+		if b.req.opcode == opPrepend {
+			typ = PrependCommand
+		}
+		cmd.storageCommand = &StorageCommand{Typ: typ, Key: key, NumBytes: uint32(len(value)), DataBlock: value}
+	case opDelete:
+		if err := expect(0, true, false); err != nil {
+			return nil, err
+		}
+		cmd.deleteCommand = &DeleteCommand{Key: key}
+	case opIncrement, opDecrement:
+		if err := expect(20, true, false); err != nil {
+			return nil, err
+		}
+		typ := IncrCommand
+		if b.req.opcode == opDecrement {
+			typ = DecrCommand
+		}
+		expTime := binary.BigEndian.Uint32(extras[16:20])
+		cmd.arithmeticCommand = &ArithmeticCommand{
+			Typ:     typ,
+			Key:     key,
+			Delta:   binary.BigEndian.Uint64(extras[0:8]),
+			Initial: binary.BigEndian.Uint64(extras[8:16]),
+			Create:  expTime != binaryNoCreateExpTime,
+			ExpTime: int32(expTime),
+		}
+	case opTouch:
+		if err := expect(4, true, false); err != nil {
+			return nil, err
+		}
+		cmd.touchCommand = &TouchCommand{Key: key, ExpTime: int32(binary.BigEndian.Uint32(extras))}
+	case opFlush:
+		var delay uint32
+		if len(extras) == 4 {
+			delay = binary.BigEndian.Uint32(extras)
+		} else if err := expect(0, false, false); err != nil {
+			return nil, err
+		}
+		cmd.flushCommand = &FlushCommand{Delay: int32(delay)}
+	case opStat:
+		if err := expect(0, len(key) > 0, false); err != nil {
+			return nil, err
+		}
+		cmd.statsCommand = &StatisticsCommand{Group: key}
+	case opVersion, opNoop, opQuit:
+		if err := expect(0, false, false); err != nil {
+			return nil, err
+		}
+		typ := map[byte]int{opVersion: VersionCommand, opNoop: NoopCommand, opQuit: QuitCommand}[b.req.opcode]
+		cmd.adminCommand = &AdminCommand{Typ: typ, NoReply: b.req.quiet}
+	case opVerbosity:
+		if err := expect(4, false, false); err != nil {
+			return nil, err
+		}
+		cmd.adminCommand = &AdminCommand{Typ: VerbosityCommand, Verbosity: int(binary.BigEndian.Uint32(extras))}
+	case opSaslList:
+		if err := expect(0, false, false); err != nil {
+			return nil, err
+		}
+		cmd.authCommand = &AuthCommand{Typ: SaslListMechsCommand}
+	case opSaslAuth:
+		if err := expect(0, true, true); err != nil {
+			return nil, err
+		}
+		cmd.authCommand = &AuthCommand{Typ: SaslAuthCommand, Mechanism: key}
+		// the PLAIN message is the authorization identity, the username and
+		// the password, separated by NUL bytes
+		if parts := bytes.Split(value, []byte{0}); key == "PLAIN" && len(parts) == 3 {
+			cmd.authCommand.Username, cmd.authCommand.Password = string(parts[1]), string(parts[2])
+		}
+	default:
+		return nil, commandNotFound
+	}
+	return cmd, nil
+}
+
+// encode returns a response packet for the most recently read request.
+func (b *binaryProtocolMessageBuffer) encode(status uint16, cas int64, extras, key, value []byte) []byte {
+	packet := make([]byte, binaryHeaderLength, binaryHeaderLength+len(extras)+len(key)+len(value))
+	packet[0] = binaryResponseMagic
+	packet[1] = b.req.sent
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(key)))
+	packet[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(packet[6:8], status)
+	binary.BigEndian.PutUint32(packet[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(packet[12:16], b.req.opaque)
+	binary.BigEndian.PutUint64(packet[16:24], uint64(cas))
+	packet = append(packet, extras...)
+	packet = append(packet, key...)
+	return append(packet, value...)
+}
+
+// errorStatus maps an ErrorResponse onto a binary status given the request.
+func (b *binaryProtocolMessageBuffer) errorStatus(r *ErrorResponse) uint16 {
+	switch {
+	case r.stdErr:
+		return statusUnknownCommand
+	case r == unauthenticated || r == authFailure:
+		return statusAuthError
+	case r == binaryValueTooLong:
+		return statusValueTooLarge
+	case r.clientErr && (b.req.opcode == opIncrement || b.req.opcode == opDecrement):
+		return statusNonNumeric
+	case r.clientErr:
+		return statusInvalidArgs
+	}
+	return statusInternalError
+}
+
+// Write encodes the text protocol Response as the binary response to the
+// most recently read request. Responses the client did not ask for, the
+// successes of quiet requests and the misses of quiet gets, are dropped.
+func (b *binaryProtocolMessageBuffer) Write(r Response) error {
+	var (
+		status        uint16
+		cas           int64
+		extras, value []byte
+		key           []byte
+	)
+	switch resp := r.(type) {
+	case TextStoredResponse, TextDeletedResponse, TextTouchedResponse, TextOkResponse:
+		status = statusNoError
+	case TextNotStoredResponse:
+		switch b.req.opcode {
+		case opAdd:
+			status = statusKeyExists
+		case opReplace:
+			status = statusKeyNotFound
+		default:
+			status = statusNotStored
+		}
+	case TextExistsResponse:
+		status = statusKeyExists
+	case TextNotFoundResponse:
+		status = statusKeyNotFound
+	case TextArithmeticResponse:
+		value = make([]byte, 8)
+		binary.BigEndian.PutUint64(value, resp.Value)
+	case TextVersionResponse:
+		value = []byte(Version)
+	case SaslResponse:
+		value = []byte(resp.Value)
+	case TextGetOrGetsResponse:
+		if len(resp.pairs) == 0 {
+			status = statusKeyNotFound
+			if b.req.quiet {
+				return nil
+			}
+		} else {
+			v := resp.pairs[0].v
+			extras = make([]byte, 4)
+			binary.BigEndian.PutUint32(extras, uint32(v.Flags))
+			value, cas = v.Bytes, v.CasUnique
+		}
+		if b.req.opcode == opGetK {
+			key = b.req.key
+		}
+	case TextStatsResponse:
+		buf := &bytes.Buffer{}
+		for _, s := range resp.stats {
+			buf.Write(b.encode(statusNoError, 0, nil, []byte(s.Name), []byte(s.Value)))
+		}
+		buf.Write(b.encode(statusNoError, 0, nil, nil, nil))
+		return b.write(buf.Bytes())
+	case *ErrorResponse:
+		status = b.errorStatus(resp)
+		value = []byte(resp.Error())
+		if resp.stdErr {
+			value = []byte("Unknown command")
+		}
+		return b.write(b.encode(status, 0, nil, nil, value))
+	default:
+		return fmt.Errorf("no binary encoding for response %T", r)
+	}
+	if status != statusNoError && len(value) == 0 {
+		value = []byte(statusMessages[status])
+	}
+	if b.req.quiet && status == statusNoError && b.req.opcode != opGet && b.req.opcode != opGetK && b.req.opcode != opGat {
+		return nil
+	}
+	return b.write(b.encode(status, cas, extras, key, value))
+}
+
+// Flush is a no-op, since binary responses are written to the wire as they
+// are encoded.
+func (b *binaryProtocolMessageBuffer) Flush() error {
+	return nil
+}
+
+func (b *binaryProtocolMessageBuffer) write(bytes []byte) (err error) {
+	n, err := b.wireOut.Write(bytes)
+	if err != nil {
+		return
+	} else if n < len(bytes) {
+		err = errors.New("could not write complete message to wire")
+	}
+	return
+}
+
+// negotiatingMessageBuffer picks the text or binary protocol based on the
+// first byte the client sends, then delegates to the chosen MessageBuffer.
+type negotiatingMessageBuffer struct {
+	wireIn     io.Reader
+	wireOut    io.Writer
+	maxValSize int
+	delegate   MessageBuffer
+}
+
+// NewMessageBuffer returns a MessageBuffer that speaks the binary protocol
+// if the first byte read is the binary request magic, and the text protocol
+// otherwise.
+func NewMessageBuffer(wireIn io.Reader, wireOut io.Writer, maxValSize int) MessageBuffer {
+	return &negotiatingMessageBuffer{wireIn: wireIn, wireOut: wireOut, maxValSize: maxValSize}
+}
+
+func (n *negotiatingMessageBuffer) Read() (*Command, error) {
+	if n.delegate == nil {
+		first := [1]byte{}
+		r, err := n.wireIn.Read(first[:])
+		if r == 0 {
+			return nil, err
+		}
+		wireIn := &replayReader{prefix: first[:r], wireIn: n.wireIn}
+		if first[0] == binaryRequestMagic {
+			n.delegate = NewBinaryProtocolMessageBuffer(wireIn, n.wireOut, n.maxValSize)
+		} else {
+			n.delegate = NewTextProtocolMessageBuffer(wireIn, n.wireOut, n.maxValSize)
+		}
+	}
+	return n.delegate.Read()
+}
+
+func (n *negotiatingMessageBuffer) Write(r Response) error {
+	if n.delegate == nil {
+		return errors.New("cannot write before the protocol is known")
+	}
+	return n.delegate.Write(r)
+}
+
+func (n *negotiatingMessageBuffer) Flush() error {
+	if n.delegate == nil {
+		return nil
+	}
+	return n.delegate.Flush()
+}
+
+// replayReader replays the bytes sniffed by a negotiatingMessageBuffer ahead
+// of the rest of the wire. Unlike io.MultiReader, it keeps reading from the
+// wire after the wire returns io.EOF.
+type replayReader struct {
+	prefix []byte
+	wireIn io.Reader
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	if len(r.prefix) > 0 {
+		n := copy(p, r.prefix)
+		r.prefix = r.prefix[n:]
+		return n, nil
+	}
+	return r.wireIn.Read(p)
+}
@@ -0,0 +1,257 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/tshprecher/mcache/store"
+	"testing"
+)
+
+// binaryPacket encodes a binary protocol packet with the given header fields and body.
+func binaryPacket(magic, opcode byte, status uint16, opaque uint32, cas uint64, extras, key, value []byte) []byte {
+	packet := make([]byte, binaryHeaderLength)
+	packet[0] = magic
+	packet[1] = opcode
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(key)))
+	packet[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(packet[6:8], status)
+	binary.BigEndian.PutUint32(packet[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(packet[12:16], opaque)
+	binary.BigEndian.PutUint64(packet[16:24], cas)
+	packet = append(packet, extras...)
+	packet = append(packet, key...)
+	return append(packet, value...)
+}
+
+func binaryRequestPacket(opcode byte, cas uint64, extras, key, value []byte) []byte {
+	return binaryPacket(binaryRequestMagic, opcode, 0, 0, cas, extras, key, value)
+}
+
+func binaryResponsePacket(opcode byte, status uint16, cas uint64, extras, key, value []byte) []byte {
+	return binaryPacket(binaryResponseMagic, opcode, status, 0, cas, extras, key, value)
+}
+
+func uint32s(vals ...uint32) []byte {
+	b := make([]byte, 4*len(vals))
+	for i, v := range vals {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	return b
+}
+
+func TestBinaryReadSplitPackets(t *testing.T) {
+	packet := binaryRequestPacket(opSet, 0, uint32s(3, 2), []byte("my_key"), []byte("1"))
+	packets := [][]byte{
+		packet[:10],
+		packet[10:24],
+		packet[24:30],
+		packet[30:],
+	}
+	expResults := []readResult{
+		readResult{},
+		readResult{},
+		readResult{},
+		readResult{
+			cmd: &Command{
+				storageCommand: &StorageCommand{
+					Typ:       SetCommand,
+					Key:       "my_key",
+					Flags:     3,
+					ExpTime:   2,
+					NumBytes:  1,
+					DataBlock: []byte("1"),
+				},
+			},
+		},
+	}
+	wireIn, wireOut := &bytes.Buffer{}, &bytes.Buffer{}
+	buf := NewBinaryProtocolMessageBuffer(wireIn, wireOut, 1024)
+	testTextRead(t, buf, wireIn, packets, expResults)
+}
+
+func TestBinaryReadCommands(t *testing.T) {
+	arith := make([]byte, 20)
+	binary.BigEndian.PutUint64(arith[0:8], 5)
+	binary.BigEndian.PutUint64(arith[8:16], 10)
+	binary.BigEndian.PutUint32(arith[16:20], 60)
+	noCreate := append(append([]byte{}, arith[:16]...), uint32s(binaryNoCreateExpTime)...)
+
+	packets := [][]byte{
+		binaryRequestPacket(opGet, 0, nil, []byte("key"), nil),
+		binaryRequestPacket(opGetKQ, 0, nil, []byte("key"), nil),
+		binaryRequestPacket(opGat, 0, uint32s(10), []byte("key"), nil),
+		binaryRequestPacket(opSetQ, 99, uint32s(1, 0), []byte("key"), []byte("val")),
+		binaryRequestPacket(opAdd, 0, uint32s(1, 0), []byte("key"), []byte("val")),
+		binaryRequestPacket(opPrepend, 0, nil, []byte("key"), []byte("val")),
+		binaryRequestPacket(opDelete, 0, nil, []byte("key"), nil),
+		binaryRequestPacket(opIncrement, 0, arith, []byte("key"), nil),
+		binaryRequestPacket(opDecrementQ, 0, noCreate, []byte("key"), nil),
+		binaryRequestPacket(opTouch, 0, uint32s(10), []byte("key"), nil),
+		binaryRequestPacket(opFlush, 0, uint32s(10), nil, nil),
+		binaryRequestPacket(opFlushQ, 0, nil, nil, nil),
+		binaryRequestPacket(opStat, 0, nil, []byte("items"), nil),
+		binaryRequestPacket(opVersion, 0, nil, nil, nil),
+		binaryRequestPacket(opNoop, 0, nil, nil, nil),
+		binaryRequestPacket(opQuitQ, 0, nil, nil, nil),
+		binaryRequestPacket(opVerbosity, 0, uint32s(2), nil, nil),
+		binaryRequestPacket(opSaslList, 0, nil, nil, nil),
+		binaryRequestPacket(opSaslAuth, 0, nil, []byte("PLAIN"), []byte("\x00user\x00pass")),
+		binaryRequestPacket(opSaslAuth, 0, nil, []byte("CRAM-MD5"), []byte("user digest")),
+		binaryRequestPacket(opGet, 0, nil, nil, nil),
+		binaryRequestPacket(0x30, 0, nil, nil, nil),
+	}
+	expResults := []readResult{
+		readResult{cmd: &Command{retrievalCommand: &RetrievalCommand{Typ: GetCommand, keys: []string{"key"}}}},
+		readResult{cmd: &Command{retrievalCommand: &RetrievalCommand{Typ: GetCommand, keys: []string{"key"}}}},
+		readResult{cmd: &Command{retrievalCommand: &RetrievalCommand{Typ: GatCommand, ExpTime: 10, keys: []string{"key"}}}},
+		readResult{cmd: &Command{storageCommand: &StorageCommand{Typ: CasCommand, Key: "key", Flags: 1, NumBytes: 3, CasUnique: 99, DataBlock: []byte("val")}}},
+		readResult{cmd: &Command{storageCommand: &StorageCommand{Typ: AddCommand, Key: "key", Flags: 1, NumBytes: 3, DataBlock: []byte("val")}}},
+		readResult{cmd: &Command{storageCommand: &StorageCommand{Typ: PrependCommand, Key: "key", NumBytes: 3, DataBlock: []byte("val")}}},
+		readResult{cmd: &Command{deleteCommand: &DeleteCommand{Key: "key"}}},
+		readResult{cmd: &Command{arithmeticCommand: &ArithmeticCommand{Typ: IncrCommand, Key: "key", Delta: 5, Create: true, Initial: 10, ExpTime: 60}}},
+		readResult{cmd: &Command{arithmeticCommand: &ArithmeticCommand{Typ: DecrCommand, Key: "key", Delta: 5, Initial: 10, ExpTime: -1}}},
+		readResult{cmd: &Command{touchCommand: &TouchCommand{Key: "key", ExpTime: 10}}},
+		readResult{cmd: &Command{flushCommand: &FlushCommand{Delay: 10}}},
+		readResult{cmd: &Command{flushCommand: &FlushCommand{}}},
+		readResult{cmd: &Command{statsCommand: &StatisticsCommand{Group: "items"}}},
+		readResult{cmd: &Command{adminCommand: &AdminCommand{Typ: VersionCommand}}},
+		readResult{cmd: &Command{adminCommand: &AdminCommand{Typ: NoopCommand}}},
+		readResult{cmd: &Command{adminCommand: &AdminCommand{Typ: QuitCommand, NoReply: true}}},
+		readResult{cmd: &Command{adminCommand: &AdminCommand{Typ: VerbosityCommand, Verbosity: 2}}},
+		readResult{cmd: &Command{authCommand: &AuthCommand{Typ: SaslListMechsCommand}}},
+		readResult{cmd: &Command{authCommand: &AuthCommand{Typ: SaslAuthCommand, Mechanism: "PLAIN", Username: "user", Password: "pass"}}},
+		readResult{cmd: &Command{authCommand: &AuthCommand{Typ: SaslAuthCommand, Mechanism: "CRAM-MD5"}}},
+		readResult{err: invalidPacket},
+		readResult{err: commandNotFound},
+	}
+	wireIn, wireOut := &bytes.Buffer{}, &bytes.Buffer{}
+	buf := NewBinaryProtocolMessageBuffer(wireIn, wireOut, 1024)
+	testTextRead(t, buf, wireIn, packets, expResults)
+}
+
+func TestBinaryReadInvalid(t *testing.T) {
+	packets := [][]byte{
+		binaryPacket(binaryResponseMagic, opGet, 0, 0, 0, nil, []byte("key"), nil),
+		binaryRequestPacket(opSet, 0, uint32s(0, 0), []byte("key"), make([]byte, 11)),
+	}
+	expResults := []readResult{
+		readResult{err: invalidMagic},
+		readResult{err: binaryValueTooLong},
+	}
+	for p := range packets {
+		wireIn, wireOut := &bytes.Buffer{}, &bytes.Buffer{}
+		buf := NewBinaryProtocolMessageBuffer(wireIn, wireOut, 10)
+		testTextRead(t, buf, wireIn, packets[p:p+1], expResults[p:p+1])
+	}
+}
+
+func TestBinaryReadLargeBody(t *testing.T) {
+	// with a limit, a header claiming a body of 4 GiB is rejected
+	header := binaryRequestPacket(opSet, 0, uint32s(0, 0), []byte("key"), nil)[:binaryHeaderLength]
+	binary.BigEndian.PutUint32(header[8:12], 0xffffffff)
+	wireIn, wireOut := &bytes.Buffer{}, &bytes.Buffer{}
+	buf := NewBinaryProtocolMessageBuffer(wireIn, wireOut, 1024)
+	testTextRead(t, buf, wireIn, [][]byte{header}, []readResult{readResult{err: binaryValueTooLong}})
+
+	// without a limit, the packet only grows as bytes of the body arrive
+	value := make([]byte, 4*1024*1024)
+	packet := binaryRequestPacket(opSet, 0, uint32s(0, 0), []byte("key"), value)
+	buf = NewBinaryProtocolMessageBuffer(wireIn, wireOut, 0)
+	wireIn.Write(packet[:binaryHeaderLength+100])
+	if cmd, err := buf.Read(); cmd != nil || err != nil {
+		t.Errorf("expected an incomplete read, received %v and %v", cmd, err)
+	}
+	if len(buf.packet) > 2*(binaryHeaderLength+100) {
+		t.Errorf("expected a packet of at most %d bytes, received %d", 2*(binaryHeaderLength+100), len(buf.packet))
+	}
+	wireIn.Write(packet[binaryHeaderLength+100:])
+	if cmd, err := buf.Read(); err != nil || len(cmd.storageCommand.DataBlock) != len(value) {
+		t.Errorf("expected a value of %d bytes, received %v", len(value), err)
+	}
+}
+
+func TestBinaryWrite(t *testing.T) {
+	value := store.Value{Flags: 3, CasUnique: 7, Bytes: []byte("val")}
+	hit := TextGetOrGetsResponse{pairs: []struct {
+		k string
+		v store.Value
+	}{{"key", value}}}
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, 11)
+
+	cases := []struct {
+		request  []byte
+		response Response
+		expected []byte
+	}{
+		{binaryRequestPacket(opSet, 0, uint32s(0, 0), []byte("key"), nil), TextStoredResponse{},
+			binaryResponsePacket(opSet, statusNoError, 0, nil, nil, nil)},
+		{binaryRequestPacket(opSetQ, 0, uint32s(0, 0), []byte("key"), nil), TextStoredResponse{},
+			nil},
+		{binaryRequestPacket(opSetQ, 5, uint32s(0, 0), []byte("key"), nil), TextExistsResponse{},
+			binaryResponsePacket(opSetQ, statusKeyExists, 0, nil, nil, []byte("Data exists for key."))},
+		{binaryRequestPacket(opAdd, 0, uint32s(0, 0), []byte("key"), nil), TextNotStoredResponse{},
+			binaryResponsePacket(opAdd, statusKeyExists, 0, nil, nil, []byte("Data exists for key."))},
+		{binaryRequestPacket(opReplace, 0, uint32s(0, 0), []byte("key"), nil), TextNotStoredResponse{},
+			binaryResponsePacket(opReplace, statusKeyNotFound, 0, nil, nil, []byte("Not found"))},
+		{binaryRequestPacket(opAppend, 0, nil, []byte("key"), nil), TextNotStoredResponse{},
+			binaryResponsePacket(opAppend, statusNotStored, 0, nil, nil, []byte("Not stored."))},
+		{binaryRequestPacket(opGet, 0, nil, []byte("key"), nil), hit,
+			binaryResponsePacket(opGet, statusNoError, 7, uint32s(3), nil, []byte("val"))},
+		{binaryRequestPacket(opGetK, 0, nil, []byte("key"), nil), hit,
+			binaryResponsePacket(opGetK, statusNoError, 7, uint32s(3), []byte("key"), []byte("val"))},
+		{binaryRequestPacket(opGetQ, 0, nil, []byte("key"), nil), hit,
+			binaryResponsePacket(opGetQ, statusNoError, 7, uint32s(3), nil, []byte("val"))},
+		{binaryRequestPacket(opGet, 0, nil, []byte("key"), nil), TextGetOrGetsResponse{},
+			binaryResponsePacket(opGet, statusKeyNotFound, 0, nil, nil, []byte("Not found"))},
+		{binaryRequestPacket(opGetKQ, 0, nil, []byte("key"), nil), TextGetOrGetsResponse{},
+			nil},
+		{binaryRequestPacket(opIncrement, 0, make([]byte, 20), []byte("key"), nil), TextArithmeticResponse{11},
+			binaryResponsePacket(opIncrement, statusNoError, 0, nil, nil, counter)},
+		{binaryRequestPacket(opIncrement, 0, make([]byte, 20), []byte("key"), nil), NewClientErrorResponse("not numeric"),
+			binaryResponsePacket(opIncrement, statusNonNumeric, 0, nil, nil, []byte("not numeric"))},
+		{binaryRequestPacket(opVersion, 0, nil, nil, nil), TextVersionResponse{},
+			binaryResponsePacket(opVersion, statusNoError, 0, nil, nil, []byte(Version))},
+		{binaryRequestPacket(opStat, 0, nil, nil, nil), TextStatsResponse{[]Stat{NewStat("pid", 10)}},
+			append(binaryResponsePacket(opStat, statusNoError, 0, nil, []byte("pid"), []byte("10")),
+				binaryResponsePacket(opStat, statusNoError, 0, nil, nil, nil)...)},
+		{binaryRequestPacket(opSaslList, 0, nil, nil, nil), SaslResponse{"PLAIN"},
+			binaryResponsePacket(opSaslList, statusNoError, 0, nil, nil, []byte("PLAIN"))},
+		{binaryRequestPacket(opSaslAuth, 0, nil, []byte("PLAIN"), []byte("\x00user\x00bad")), authFailure,
+			binaryResponsePacket(opSaslAuth, statusAuthError, 0, nil, nil, []byte("authentication failure"))},
+		{binaryRequestPacket(opGet, 0, nil, []byte("key"), nil), unauthenticated,
+			binaryResponsePacket(opGet, statusAuthError, 0, nil, nil, []byte("unauthenticated"))},
+		{binaryRequestPacket(0x30, 0, nil, nil, nil), commandNotFound,
+			binaryResponsePacket(0x30, statusUnknownCommand, 0, nil, nil, []byte("Unknown command"))},
+	}
+	for _, c := range cases {
+		wireIn, wireOut := bytes.NewBuffer(c.request), &bytes.Buffer{}
+		buf := NewBinaryProtocolMessageBuffer(wireIn, wireOut, 1024)
+		buf.Read()
+		if err := buf.Write(c.response); err != nil {
+			t.Errorf("expected no error writing %T, received %v", c.response, err)
+		}
+		if !bytes.Equal(c.expected, wireOut.Bytes()) {
+			t.Errorf("expected %T written as %v, received %v", c.response, c.expected, wireOut.Bytes())
+		}
+	}
+}
+
+func TestNegotiatingRead(t *testing.T) {
+	wireIn, wireOut := &bytes.Buffer{}, &bytes.Buffer{}
+	buf := NewMessageBuffer(wireIn, wireOut, 1024)
+	testTextRead(t, buf, wireIn, [][]byte{[]byte("get key\r\n")},
+		[]readResult{readResult{cmd: &Command{retrievalCommand: &RetrievalCommand{Typ: GetCommand, keys: []string{"key"}}}}})
+	if _, ok := buf.(*negotiatingMessageBuffer).delegate.(*textProtocolMessageBuffer); !ok {
+		t.Errorf("expected the text protocol to be negotiated")
+	}
+
+	wireIn, wireOut = &bytes.Buffer{}, &bytes.Buffer{}
+	buf = NewMessageBuffer(wireIn, wireOut, 1024)
+	packet := binaryRequestPacket(opGet, 0, nil, []byte("key"), nil)
+	testTextRead(t, buf, wireIn, [][]byte{packet[:1], packet[1:]},
+		[]readResult{readResult{}, readResult{cmd: &Command{retrievalCommand: &RetrievalCommand{Typ: GetCommand, keys: []string{"key"}}}}})
+	if _, ok := buf.(*negotiatingMessageBuffer).delegate.(*binaryProtocolMessageBuffer); !ok {
+		t.Errorf("expected the binary protocol to be negotiated")
+	}
+}
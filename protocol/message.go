@@ -1,5 +1,4 @@
-// Package protocol implements the memcache protocol. It currently
-// just supports the text protocol.
+// Package protocol implements the memcache text and binary protocols.
 // see: https://github.com/memcached/memcached/blob/master/doc/protocol.txt
 package protocol
 
@@ -8,26 +7,59 @@ import (
 	"fmt"
 	"github.com/tshprecher/mcache/store"
 	"regexp"
+	"time"
 )
 
 const (
 	MaxKeyLength     = 250
 	MaxCommandLength = 1024
 
-	// the six storage commands
+	// the seven storage commands
 	SetCommand = iota
 	AddCommand
 	ReplaceCommand
 	AppendCommand
 	PrependCommand
 	CasCommand
+	MetaSetCommand
 
-	// the two retrieval commands
+	// the six retrieval commands
 	GetCommand
 	GetsCommand
+	GatCommand
+	GatsCommand
+	MetaGetCommand
+	MetaDebugCommand
 
-	// delete command
+	// the two delete commands
 	DelCommand
+	MetaDeleteCommand
+
+	// the three arithmetic commands
+	IncrCommand
+	DecrCommand
+	MetaArithmeticCommand
+
+	// touch command
+	TchCommand
+
+	// flush_all command
+	FlushAllCommand
+
+	// stats command
+	StatsCommand
+
+	// the six administrative commands
+	VersionCommand
+	VerbosityCommand
+	QuitCommand
+	ShutdownCommand
+	NoopCommand
+	MetaNoopCommand
+
+	// the two SASL commands of the binary protocol
+	SaslListMechsCommand
+	SaslAuthCommand
 )
 
 var (
@@ -38,19 +70,65 @@ var (
 // a memcache storage command.
 func IsStorageCommand(typ int) bool {
 	return typ == SetCommand || typ == AddCommand || typ == ReplaceCommand ||
-		typ == AppendCommand || typ == PrependCommand || typ == CasCommand
+		typ == AppendCommand || typ == PrependCommand || typ == CasCommand || typ == MetaSetCommand
 }
 
 // IsRetrievalCommand returns true if and only if the typ constant represents
 // a memcache retrieval command.
 func IsRetrievalCommand(typ int) bool {
-	return typ == GetCommand || typ == GetsCommand
+	return typ == GetCommand || typ == GetsCommand || typ == GatCommand || typ == GatsCommand ||
+		typ == MetaGetCommand || typ == MetaDebugCommand
 }
 
 // IsDeleteCommand returns true if and only if the typ constant represents
 // a memcache delete command.
 func IsDeleteCommand(typ int) bool {
-	return typ == DelCommand
+	return typ == DelCommand || typ == MetaDeleteCommand
+}
+
+// IsArithmeticCommand returns true if and only if the typ constant represents
+// a memcache arithmetic command.
+func IsArithmeticCommand(typ int) bool {
+	return typ == IncrCommand || typ == DecrCommand || typ == MetaArithmeticCommand
+}
+
+// IsTouchCommand returns true if and only if the typ constant represents
+// a memcache touch command.
+func IsTouchCommand(typ int) bool {
+	return typ == TchCommand
+}
+
+// IsFlushCommand returns true if and only if the typ constant represents
+// a memcache flush_all command.
+func IsFlushCommand(typ int) bool {
+	return typ == FlushAllCommand
+}
+
+// IsStatsCommand returns true if and only if the typ constant represents
+// a memcache stats command.
+func IsStatsCommand(typ int) bool {
+	return typ == StatsCommand
+}
+
+// IsAdminCommand returns true if and only if the typ constant represents
+// a memcache administrative command.
+func IsAdminCommand(typ int) bool {
+	return typ == VersionCommand || typ == VerbosityCommand || typ == QuitCommand ||
+		typ == ShutdownCommand || typ == NoopCommand || typ == MetaNoopCommand
+}
+
+// IsAuthCommand returns true if and only if the typ constant represents
+// a memcache SASL command.
+func IsAuthCommand(typ int) bool {
+	return typ == SaslListMechsCommand || typ == SaslAuthCommand
+}
+
+// IsMetaCommand returns true if and only if the typ constant represents
+// a memcache meta command. Each meta command also belongs to one of the
+// other categories.
+func IsMetaCommand(typ int) bool {
+	return typ == MetaSetCommand || typ == MetaGetCommand || typ == MetaDebugCommand ||
+		typ == MetaDeleteCommand || typ == MetaArithmeticCommand || typ == MetaNoopCommand
 }
 
 // A ErrorResponse is an error that also encapsulates its type with respect
@@ -84,7 +162,44 @@ func NewClientErrorResponse(msg string) *ErrorResponse { return &ErrorResponse{f
 // NewServerErrorResponse returns a new ErrorResponse intended to be treated as a server error.
 func NewServerErrorResponse(msg string) *ErrorResponse { return &ErrorResponse{false, false, true, msg} }
 
+// MetaFlags holds the flags of a meta command. A flag's token is only
+// meaningful when the flag itself is set.
+type MetaFlags struct {
+	// Returns holds the requested return flags among c, f, h, k, l, O,
+	// s and t, in the order requested.
+	Returns string
+	// Value (v) returns the value.
+	Value bool
+	// Opaque (O) is echoed back to the client.
+	Opaque string
+	// Quiet (q) suppresses EN for mg, HD for ms, and HD and NF for md and ma.
+	Quiet bool
+
+	// Touch (T) updates the exptime of the item to ExpTime. For ms, the
+	// token is the StorageCommand's ExpTime instead.
+	Touch   bool
+	ExpTime int32
+	// Vivify (N) creates a missing item with the VivifyExpTime.
+	Vivify        bool
+	VivifyExpTime int32
+	// Recache (R) wins the recache if the item's remaining ttl is below
+	// RecacheTime seconds.
+	Recache     bool
+	RecacheTime int32
+	// Invalidate (I) marks the item stale rather than deleting it, or for
+	// ms, stores it as stale if CompareCas is older than the item's.
+	Invalidate bool
+	// CompareCas (C) only modifies the item if its cas unique matches.
+	CompareCas int64
+	// Mode (M) selects the ms or ma operation.
+	Mode byte
+	// Delta (D) and Initial (J) are the ma delta and vivified value.
+	Delta   uint64
+	Initial uint64
+}
+
 // A StorageCommand represents a client's unpacked storage command.
+// Meta is only set for the ms command.
 type StorageCommand struct {
 	// header fields
 	Typ       int
@@ -94,30 +209,109 @@ type StorageCommand struct {
 	NumBytes  uint32
 	CasUnique int64
 	NoReply   bool
+	Meta      *MetaFlags
 
 	// data block
 	DataBlock []byte
 }
 
 // A RetrievalCommand represents a client's unpacked retrieval command.
+// The ExpTime is only set for the gat and gats commands, and Meta is only
+// set for the mg and me commands.
 type RetrievalCommand struct {
-	Typ  int
-	keys []string
+	Typ     int
+	ExpTime int32
+	keys    []string
+	Meta    *MetaFlags
 }
 
-// A DeleteCommand represents a client's unpacked delete command.
+// A DeleteCommand represents a client's unpacked delete command. Meta is
+// only set for the md command.
 type DeleteCommand struct {
 	Key     string
 	NoReply bool
+	Meta    *MetaFlags
+}
+
+// An ArithmeticCommand represents a client's unpacked incr or decr command.
+// If Create is set, a missing key is created holding Initial with the
+// given ExpTime instead of the command failing. Meta is only set for the
+// ma command.
+type ArithmeticCommand struct {
+	Typ     int
+	Key     string
+	Delta   uint64
+	NoReply bool
+	Meta    *MetaFlags
+
+	Create  bool
+	Initial uint64
+	ExpTime int32
+}
+
+// A TouchCommand represents a client's unpacked touch command.
+type TouchCommand struct {
+	Key     string
+	ExpTime int32
+	NoReply bool
+}
+
+// A FlushCommand represents a client's unpacked flush_all command. A Delay
+// of 0 flushes immediately.
+type FlushCommand struct {
+	Delay   int32
+	NoReply bool
+}
+
+// A StatisticsCommand represents a client's unpacked stats command. The
+// Group is empty for the general statistics.
+type StatisticsCommand struct {
+	Group string
+}
+
+// An AdminCommand represents a client's unpacked version, verbosity, quit,
+// shutdown, noop or mn command. The Verbosity is only set for the verbosity
+// command. The text protocol quit command never replies.
+type AdminCommand struct {
+	Typ       int
+	Verbosity int
+	NoReply   bool
+}
+
+// An AuthCommand represents a client's unpacked SASL list mechanisms or
+// SASL auth command. The Mechanism, Username and Password are only set for
+// SASL auth, and the credentials only if the mechanism is PLAIN.
+type AuthCommand struct {
+	Typ       int
+	Mechanism string
+	Username  string
+	Password  string
 }
 
 // A Command represents a client's unpacked command. It should be treated
-// as the union of three commands: storage, retrieval, and delete. At most one
-// of these commands should be non-nil at any given time.
+// as the union of nine commands: storage, retrieval, delete, arithmetic,
+// touch, flush, statistics, admin, and auth. At most one of these commands
+// should be non-nil at any given time.
 type Command struct {
-	storageCommand   *StorageCommand
-	retrievalCommand *RetrievalCommand
-	deleteCommand    *DeleteCommand
+	storageCommand    *StorageCommand
+	retrievalCommand  *RetrievalCommand
+	deleteCommand     *DeleteCommand
+	arithmeticCommand *ArithmeticCommand
+	touchCommand      *TouchCommand
+	flushCommand      *FlushCommand
+	statsCommand      *StatisticsCommand
+	adminCommand      *AdminCommand
+	authCommand       *AuthCommand
+
+	// binary is set for commands read in the binary protocol, where a set
+	// is never the text protocol's authentication
+	binary bool
+}
+
+// expiry returns the absolute store.Value expiry for a command's exptime,
+// given the current time.
+func expiry(expTime int32, now time.Time) int64 {
+	return store.Expiry(int64(expTime), now)
 }
 
 // Response represents a complete memcache protocol message
@@ -153,9 +347,33 @@ type TextNotFoundResponse struct{}
 
 func (_ TextNotFoundResponse) Bytes() []byte { return []byte("NOT_FOUND\r\n") }
 
-// A TextGetOrGetsResponse builds responses for get and gets commands
+// A TextOkResponse builds the "OK" response
+type TextOkResponse struct{}
+
+func (_ TextOkResponse) Bytes() []byte { return []byte("OK\r\n") }
+
+// A TextVersionResponse builds the "VERSION <version>" response
+type TextVersionResponse struct{}
+
+func (_ TextVersionResponse) Bytes() []byte { return []byte(fmt.Sprintf("VERSION %s\r\n", Version)) }
+
+// A TextTouchedResponse builds the "TOUCHED" response
+type TextTouchedResponse struct{}
+
+func (_ TextTouchedResponse) Bytes() []byte { return []byte("TOUCHED\r\n") }
+
+// A TextArithmeticResponse builds the response holding the new value
+// after an incr or decr command
+type TextArithmeticResponse struct {
+	Value uint64
+}
+
+func (t TextArithmeticResponse) Bytes() []byte { return []byte(fmt.Sprintf("%d\r\n", t.Value)) }
+
+// A TextGetOrGetsResponse builds responses for get, gets, gat and gats commands
 // given a slice of Values to return to the client. The withCasUniq flag
-// should be true if and only if the intended response is for a gets command.
+// should be true if and only if the intended response is for a gets or gats
+// command.
 type TextGetOrGetsResponse struct {
 	pairs []struct {
 		k string
@@ -178,3 +396,54 @@ func (t TextGetOrGetsResponse) Bytes() []byte {
 	buf.WriteString("END\r\n")
 	return buf.Bytes()
 }
+
+// A TextMetaResponse builds the response to a meta command: the code and
+// flags, or "VA <size> <flags>*" followed by the data block if withValue.
+type TextMetaResponse struct {
+	code      string
+	flags     []string
+	value     []byte
+	withValue bool
+}
+
+func (t TextMetaResponse) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	if t.withValue {
+		buf.WriteString(fmt.Sprintf("VA %d", len(t.value)))
+	} else {
+		buf.WriteString(t.code)
+	}
+	for _, f := range t.flags {
+		buf.WriteString(" ")
+		buf.WriteString(f)
+	}
+	buf.WriteString("\r\n")
+	if t.withValue {
+		buf.Write(t.value)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// A SaslResponse holds the value of a successful SASL command's binary
+// response: the supported mechanisms or the result of authenticating.
+type SaslResponse struct {
+	Value string
+}
+
+func (s SaslResponse) Bytes() []byte { return []byte(s.Value + "\r\n") }
+
+// A TextStatsResponse builds the "STAT <name> <value>" lines, terminated
+// by "END", in response to a stats command.
+type TextStatsResponse struct {
+	stats []Stat
+}
+
+func (t TextStatsResponse) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	for _, s := range t.stats {
+		buf.WriteString(fmt.Sprintf("STAT %s %s\r\n", s.Name, s.Value))
+	}
+	buf.WriteString("END\r\n")
+	return buf.Bytes()
+}
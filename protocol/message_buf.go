@@ -1,8 +1,8 @@
 package protocol
 
 import (
+	"bufio"
 	"bytes"
-	"errors"
 	"fmt"
 	"github.com/golang/glog"
 	"io"
@@ -14,12 +14,26 @@ var (
 	// protocol errors
 	invalidStorageCommand = NewClientErrorResponse("storage commands must take exactly 5 or 6 terms")
 	invalidDeleteCommand  = NewClientErrorResponse("delete must take exactly 2 or 3 terms")
+	invalidArithCommand   = NewClientErrorResponse("incr and decr must take exactly 3 or 4 terms")
+	invalidTouchCommand   = NewClientErrorResponse("touch must take exactly 3 or 4 terms")
+	invalidGatCommand     = NewClientErrorResponse("gat and gats must take at least 3 terms")
+	invalidFlushCommand   = NewClientErrorResponse("flush_all must take at most 3 terms")
+	invalidDelay          = NewClientErrorResponse("malformed delay")
+	invalidStatsCommand   = NewClientErrorResponse("stats must take at most 2 terms")
+	invalidAdminCommand   = NewClientErrorResponse("version, quit and shutdown take no arguments")
+	invalidVerbosity      = NewClientErrorResponse("verbosity must take exactly 2 or 3 terms")
+	invalidLevel          = NewClientErrorResponse("malformed verbosity level")
 	invalidKey            = NewClientErrorResponse("malformed key")
 	invalidFlags          = NewClientErrorResponse("malformed flags")
 	invalidExpTime        = NewClientErrorResponse("malformed exptime")
 	invalidBytes          = NewClientErrorResponse("malformed num_bytes")
 	invalidCasUniq        = NewClientErrorResponse("malformed cas_unique")
+	invalidDelta          = NewClientErrorResponse("invalid numeric delta argument")
 	noReplyExpected       = NewClientErrorResponse("expected 'noreply' as last term")
+	invalidMetaCommand    = NewClientErrorResponse("bad command line format")
+	invalidMetaFlag       = NewClientErrorResponse("invalid flag")
+	invalidMetaToken      = NewClientErrorResponse("bad token in command line format")
+	invalidMetaMode       = NewClientErrorResponse("invalid mode")
 
 	commandLineTooLong = NewClientErrorResponse(fmt.Sprintf("command line exceeding %d bytes", MaxCommandLength))
 	dataBlockTooLong   = NewClientErrorResponse("data block exceeds size of value")
@@ -36,7 +50,49 @@ var (
 		"cas":     CasCommand,
 		"get":     GetCommand,
 		"gets":    GetsCommand,
+		"gat":     GatCommand,
+		"gats":    GatsCommand,
 		"delete":  DelCommand,
+		"incr":    IncrCommand,
+		"decr":    DecrCommand,
+		"touch":   TchCommand,
+
+		"flush_all": FlushAllCommand,
+		"stats":     StatsCommand,
+		"version":   VersionCommand,
+		"verbosity": VerbosityCommand,
+		"quit":      QuitCommand,
+		"shutdown":  ShutdownCommand,
+
+		"mg": MetaGetCommand,
+		"ms": MetaSetCommand,
+		"md": MetaDeleteCommand,
+		"ma": MetaArithmeticCommand,
+		"mn": MetaNoopCommand,
+		"me": MetaDebugCommand,
+	}
+
+	// the flags accepted by each meta command taking flags
+	metaCommandFlags = map[int]string{
+		MetaGetCommand:        "cfhklOqstvTNR",
+		MetaSetCommand:        "ckOqFTCIM",
+		MetaDeleteCommand:     "kOqCIT",
+		MetaArithmeticCommand: "cktOqvNJDTMC",
+	}
+
+	// the flags echoed back in meta responses
+	metaReturnFlags = "cfhklOst"
+
+	// the modes accepted by each meta command taking a mode, normalized
+	// to the first of each group
+	metaModes = map[int]map[string]byte{
+		MetaSetCommand: {
+			"S": 'S', "s": 'S', "E": 'E', "e": 'E', "A": 'A', "a": 'A',
+			"P": 'P', "p": 'P', "R": 'R', "r": 'R',
+		},
+		MetaArithmeticCommand: {
+			"I": 'I', "i": 'I', "+": 'I', "D": 'D', "d": 'D', "-": 'D',
+		},
 	}
 
 	_ MessageBuffer = &textProtocolMessageBuffer{}
@@ -46,97 +102,146 @@ var (
 type MessageBuffer interface {
 	Read() (*Command, error)
 	Write(r Response) error
+	// Flush writes any buffered responses to the wire.
+	Flush() error
 }
 
+// readBufferSize is the size of the buffer commands are read into. It must
+// hold at least a command line of MaxCommandLength bytes.
+const readBufferSize = 4096
+
+// dataBlockChunk is the most of a data block allocated before its bytes
+// arrive. Larger blocks grow by doubling as they are read.
+const dataBlockChunk = 1024*1024 + 2
+
 type textProtocolMessageBuffer struct {
 	wireIn      io.Reader
-	wireOut     io.Writer
+	wireOut     *bufio.Writer
 	maxValSize  int
 	curCmd      Command
-	cmdHeader   *bytes.Buffer
+	cmdHeader   string
 	cmdType     int
 	cmdComplete bool
+
+	// in holds the bytes read from the wire but not yet consumed in
+	// in[start:end]
+	in         []byte
+	start, end int
+
+	// blockRead is the number of bytes of the current data block read so far
+	blockRead int
 }
 
 func NewTextProtocolMessageBuffer(wireIn io.Reader, wireOut io.Writer, maxValSize int) *textProtocolMessageBuffer {
 	return &textProtocolMessageBuffer{
 		wireIn:     wireIn,
-		wireOut:    wireOut,
+		wireOut:    bufio.NewWriter(wireOut),
 		maxValSize: maxValSize,
 		curCmd: Command{
 			storageCommand:   nil,
 			retrievalCommand: nil,
 		},
-		cmdHeader:   &bytes.Buffer{},
 		cmdType:     -1,
 		cmdComplete: false,
+		in:          make([]byte, readBufferSize),
 	}
 }
 
+// Write buffers the response. Buffered responses are written to the wire
+// by Flush, or before Read blocks waiting on the client, so a batch of
+// pipelined commands is answered with a single write.
 func (t *textProtocolMessageBuffer) Write(r Response) (err error) {
-	// TODO: handle the case where writing does *not* complete all bytes on the first attempt
-	// perhaps spin until an error is reached and there's some sort of timeout and the close the connection?
-	bytes := r.Bytes()
-	n, err := t.wireOut.Write(bytes)
-	if err != nil {
-		return
-	} else if n < len(bytes) {
-		err = errors.New("could not write complete message to wire")
-	}
+	_, err = t.wireOut.Write(r.Bytes())
 	return
 }
 
+func (t *textProtocolMessageBuffer) Flush() error {
+	return t.wireOut.Flush()
+}
+
 func (t *textProtocolMessageBuffer) Read() (cmd *Command, err error) {
 	// if the header is not read, try reading it first
+	headerRead := false
 	if t.cmdType == -1 {
 		err = t.readHeader()
 		if err != nil {
 			return
 		}
+		headerRead = t.cmdType != -1
 	}
 
 	// continue reading the body of the request
 	if t.cmdType != -1 {
 		err = t.readBody()
+		if _, ok := err.(*ErrorResponse); !ok && headerRead {
+			// the header was read, so a wire error is not reported yet
+			err = nil
+		}
 		if err != nil {
 			return
 		}
 	}
 
 	if t.cmdComplete {
-		glog.Infof("received command: '%v'", string(t.cmdHeader.Bytes()))
+		glog.Infof("received command: '%v'", t.cmdHeader)
 		cmd = new(Command)
 		*cmd = t.curCmd
 		t.curCmd.storageCommand = nil
 		t.curCmd.retrievalCommand = nil
 		t.curCmd.deleteCommand = nil
+		t.curCmd.arithmeticCommand = nil
+		t.curCmd.touchCommand = nil
+		t.curCmd.flushCommand = nil
+		t.curCmd.statsCommand = nil
+		t.curCmd.adminCommand = nil
+		t.curCmd.authCommand = nil
 		t.cmdComplete = false
 		t.cmdType = -1
-		t.cmdHeader.Truncate(0)
+		t.cmdHeader = ""
 	}
 	return
 }
 
-func (t *textProtocolMessageBuffer) readHeader() error {
-	b := [1]byte{}
-	n, err := t.wireIn.Read(b[0:1])
-	if n == 0 && err != nil {
-		return err
+// fill flushes any buffered responses, since the client may be waiting on
+// them before sending more, then reads once from the wire into the free
+// space of the buffer, moving the unconsumed bytes to the front first.
+func (t *textProtocolMessageBuffer) fill() (int, error) {
+	if err := t.wireOut.Flush(); err != nil {
+		return 0, err
 	}
-	for n > 0 {
-		if t.cmdHeader.Len() > MaxCommandLength {
+	if t.start > 0 {
+		t.end = copy(t.in, t.in[t.start:t.end])
+		t.start = 0
+	}
+	n, err := t.wireIn.Read(t.in[t.end:])
+	t.end += n
+	return n, err
+}
+
+func (t *textProtocolMessageBuffer) readHeader() error {
+	progress := false
+	for {
+		if i := bytes.Index(t.in[t.start:t.end], []byte("\r\n")); i >= 0 {
+			// reached the end of the cmd header so parse it, consuming it
+			// even if malformed so the next command starts fresh.
+			line := t.in[t.start : t.start+i]
+			t.start += i + 2
+			t.cmdHeader = string(line)
+			return t.parseHeader(line)
+		}
+		if t.end-t.start > MaxCommandLength {
+			t.start, t.end = 0, 0
 			return commandLineTooLong
 		}
-		t.cmdHeader.Write(b[0:1])
-		bytes := t.cmdHeader.Bytes()
-		if len(bytes) >= 2 && bytes[len(bytes)-1] == '\n' && bytes[len(bytes)-2] == '\r' {
-			// reached the end of the cmd header so parse it.
-			t.cmdHeader.Truncate(t.cmdHeader.Len() - 2)
-			return t.parseHeader(t.cmdHeader.Bytes())
+		n, err := t.fill()
+		if n == 0 {
+			if progress {
+				return nil
+			}
+			return err
 		}
-		n, err = t.wireIn.Read(b[0:1])
+		progress = true
 	}
-	return nil
 }
 
 func (t *textProtocolMessageBuffer) parseHeader(bytes []byte) (err error) {
@@ -150,12 +255,24 @@ func (t *textProtocolMessageBuffer) parseHeader(bytes []byte) (err error) {
 		err = commandNotFound
 		return
 	}
-	if IsStorageCommand(typ) {
+	if IsMetaCommand(typ) {
+		err = t.unpackMetaCommand(typ, terms)
+	} else if IsStorageCommand(typ) {
 		err = t.unpackStorageCommand(typ, terms)
 	} else if IsRetrievalCommand(typ) {
 		err = t.unpackRetrievalCommand(typ, terms)
 	} else if IsDeleteCommand(typ) {
 		err = t.unpackDeleteCommand(typ, terms)
+	} else if IsArithmeticCommand(typ) {
+		err = t.unpackArithmeticCommand(typ, terms)
+	} else if IsTouchCommand(typ) {
+		err = t.unpackTouchCommand(typ, terms)
+	} else if IsFlushCommand(typ) {
+		err = t.unpackFlushCommand(typ, terms)
+	} else if IsStatsCommand(typ) {
+		err = t.unpackStatsCommand(typ, terms)
+	} else if IsAdminCommand(typ) {
+		err = t.unpackAdminCommand(typ, terms)
 	}
 	return
 }
@@ -192,8 +309,279 @@ func (t *textProtocolMessageBuffer) unpackDeleteCommand(typ int, terms []string)
 	return nil
 }
 
+func (t *textProtocolMessageBuffer) unpackArithmeticCommand(typ int, terms []string) error {
+	if len(terms) < 3 || len(terms) > 4 {
+		return invalidArithCommand
+	}
+	key := terms[1]
+	err := t.validateKey(key)
+	if err != nil {
+		return err
+	}
+	delta, err := strconv.ParseUint(terms[2], 10, 64)
+	if err != nil {
+		return invalidDelta
+	}
+	noReply := false
+	if len(terms) == 4 {
+		if terms[3] == "noreply" {
+			noReply = true
+		} else {
+			return noReplyExpected
+		}
+	}
+	t.cmdType = typ
+	t.curCmd.arithmeticCommand = &ArithmeticCommand{
+		Typ:     typ,
+		Key:     key,
+		Delta:   delta,
+		NoReply: noReply,
+	}
+	return nil
+}
+
+func (t *textProtocolMessageBuffer) unpackTouchCommand(typ int, terms []string) error {
+	if len(terms) < 3 || len(terms) > 4 {
+		return invalidTouchCommand
+	}
+	key := terms[1]
+	err := t.validateKey(key)
+	if err != nil {
+		return err
+	}
+	expTime, err := strconv.ParseInt(terms[2], 10, 32)
+	if err != nil {
+		return invalidExpTime
+	}
+	noReply := false
+	if len(terms) == 4 {
+		if terms[3] == "noreply" {
+			noReply = true
+		} else {
+			return noReplyExpected
+		}
+	}
+	t.cmdType = typ
+	t.curCmd.touchCommand = &TouchCommand{
+		Key:     key,
+		ExpTime: int32(expTime),
+		NoReply: noReply,
+	}
+	return nil
+}
+
+func (t *textProtocolMessageBuffer) unpackFlushCommand(typ int, terms []string) error {
+	if len(terms) > 3 {
+		return invalidFlushCommand
+	}
+	noReply := false
+	if len(terms) > 1 && terms[len(terms)-1] == "noreply" {
+		noReply = true
+		terms = terms[:len(terms)-1]
+	}
+	var delay int64
+	if len(terms) == 3 {
+		return noReplyExpected
+	} else if len(terms) == 2 {
+		var err error
+		delay, err = strconv.ParseInt(terms[1], 10, 32)
+		if err != nil {
+			return invalidDelay
+		}
+	}
+	t.cmdType = typ
+	t.curCmd.flushCommand = &FlushCommand{
+		Delay:   int32(delay),
+		NoReply: noReply,
+	}
+	return nil
+}
+
+func (t *textProtocolMessageBuffer) unpackStatsCommand(typ int, terms []string) error {
+	if len(terms) > 2 {
+		return invalidStatsCommand
+	}
+	group := ""
+	if len(terms) == 2 {
+		group = terms[1]
+	}
+	t.cmdType = typ
+	t.curCmd.statsCommand = &StatisticsCommand{
+		Group: group,
+	}
+	return nil
+}
+
+func (t *textProtocolMessageBuffer) unpackAdminCommand(typ int, terms []string) error {
+	var level int64
+	noReply := false
+	if typ == VerbosityCommand {
+		if len(terms) < 2 || len(terms) > 3 {
+			return invalidVerbosity
+		}
+		var err error
+		level, err = strconv.ParseInt(terms[1], 10, 32)
+		if err != nil {
+			return invalidLevel
+		}
+		if len(terms) == 3 {
+			if terms[2] == "noreply" {
+				noReply = true
+			} else {
+				return noReplyExpected
+			}
+		}
+	} else if len(terms) != 1 {
+		return invalidAdminCommand
+	}
+	if typ == QuitCommand {
+		noReply = true
+	}
+	t.cmdType = typ
+	t.curCmd.adminCommand = &AdminCommand{
+		Typ:       typ,
+		Verbosity: int(level),
+		NoReply:   noReply,
+	}
+	return nil
+}
+
+func (t *textProtocolMessageBuffer) unpackMetaCommand(typ int, terms []string) error {
+	if typ == MetaNoopCommand {
+		if len(terms) != 1 {
+			return invalidMetaCommand
+		}
+		t.cmdType = typ
+		t.curCmd.adminCommand = &AdminCommand{Typ: typ}
+		return nil
+	}
+	if len(terms) < 2 {
+		return invalidMetaCommand
+	}
+	key := terms[1]
+	err := t.validateKey(key)
+	if err != nil {
+		return err
+	}
+	if typ == MetaDebugCommand {
+		if len(terms) != 2 {
+			return invalidMetaCommand
+		}
+		t.cmdType = typ
+		t.curCmd.retrievalCommand = &RetrievalCommand{Typ: typ, keys: []string{key}}
+		return nil
+	}
+
+	flagTerms := terms[2:]
+	var numBytes uint64
+	if typ == MetaSetCommand {
+		if len(terms) < 3 {
+			return invalidMetaCommand
+		}
+		numBytes, err = strconv.ParseUint(terms[2], 10, 32)
+		if err != nil {
+			return invalidBytes
+		}
+		if t.maxValSize > 0 && numBytes > uint64(t.maxValSize) {
+			return NewClientErrorResponse(fmt.Sprintf("num_bytes exceeded max of %d", t.maxValSize))
+		}
+		flagTerms = terms[3:]
+	}
+
+	meta := &MetaFlags{Delta: 1}
+	var flags uint64
+	for _, term := range flagTerms {
+		if term == "" || !strings.Contains(metaCommandFlags[typ], term[:1]) {
+			return invalidMetaFlag
+		}
+		flag, token := term[0], term[1:]
+		if strings.IndexByte(metaReturnFlags, flag) >= 0 {
+			if flag == 'O' {
+				meta.Opaque = token
+			}
+			meta.Returns += string(flag)
+			continue
+		}
+		switch flag {
+		case 'v':
+			meta.Value = true
+		case 'q':
+			meta.Quiet = true
+		case 'I':
+			meta.Invalidate = true
+		case 'T':
+			meta.Touch = true
+			meta.ExpTime, err = parseInt32(token)
+		case 'N':
+			meta.Vivify = true
+			meta.VivifyExpTime, err = parseInt32(token)
+		case 'R':
+			meta.Recache = true
+			meta.RecacheTime, err = parseInt32(token)
+		case 'C':
+			meta.CompareCas, err = strconv.ParseInt(token, 10, 64)
+		case 'F':
+			flags, err = strconv.ParseUint(token, 10, 16)
+		case 'D':
+			meta.Delta, err = strconv.ParseUint(token, 10, 64)
+		case 'J':
+			meta.Initial, err = strconv.ParseUint(token, 10, 64)
+		case 'M':
+			mode, ok := metaModes[typ][token]
+			if !ok {
+				return invalidMetaMode
+			}
+			meta.Mode = mode
+		}
+		if err != nil {
+			return invalidMetaToken
+		}
+	}
+
+	t.cmdType = typ
+	switch typ {
+	case MetaGetCommand:
+		t.curCmd.retrievalCommand = &RetrievalCommand{Typ: typ, keys: []string{key}, Meta: meta}
+	case MetaSetCommand:
+		t.curCmd.storageCommand = &StorageCommand{
+			Typ:      typ,
+			Key:      key,
+			Flags:    uint16(flags),
+			ExpTime:  meta.ExpTime,
+			NumBytes: uint32(numBytes),
+			Meta:     meta,
+
+			// filled in when reading the body
+			DataBlock: nil,
+		}
+	case MetaDeleteCommand:
+		t.curCmd.deleteCommand = &DeleteCommand{Key: key, Meta: meta}
+	case MetaArithmeticCommand:
+		t.curCmd.arithmeticCommand = &ArithmeticCommand{Typ: typ, Key: key, Delta: meta.Delta, Meta: meta}
+	}
+	return nil
+}
+
+// parseInt32 parses a base 10 int32 token.
+func parseInt32(token string) (int32, error) {
+	v, err := strconv.ParseInt(token, 10, 32)
+	return int32(v), err
+}
+
 func (t *textProtocolMessageBuffer) unpackRetrievalCommand(typ int, terms []string) error {
+	var expTime int64
 	keys := terms[1:]
+	if typ == GatCommand || typ == GatsCommand {
+		if len(terms) < 3 {
+			return invalidGatCommand
+		}
+		var err error
+		expTime, err = strconv.ParseInt(terms[1], 10, 32)
+		if err != nil {
+			return invalidExpTime
+		}
+		keys = terms[2:]
+	}
 	for _, k := range keys {
 		err := t.validateKey(k)
 		if err != nil {
@@ -202,8 +590,9 @@ func (t *textProtocolMessageBuffer) unpackRetrievalCommand(typ int, terms []stri
 	}
 	t.cmdType = typ
 	t.curCmd.retrievalCommand = &RetrievalCommand{
-		Typ:  typ,
-		keys: keys,
+		Typ:     typ,
+		ExpTime: int32(expTime),
+		keys:    keys,
 	}
 	return nil
 }
@@ -265,25 +654,48 @@ func (t *textProtocolMessageBuffer) unpackStorageCommand(typ int, terms []string
 	return nil
 }
 
+// readDataBlock reads the data block and its trailing "\r\n", taking what
+// is already buffered and reading the rest directly from the wire. The block
+// is allocated up to dataBlockChunk bytes at a time, so a client advertising
+// a large block must send it for the memory to be allocated.
 func (t *textProtocolMessageBuffer) readDataBlock() error {
-	b := [1]byte{}
-	for len(t.curCmd.storageCommand.DataBlock) < int(t.curCmd.storageCommand.NumBytes)+2 {
-		n, _ := t.wireIn.Read(b[0:1])
-		if n > 0 {
-			t.curCmd.storageCommand.DataBlock = append(t.curCmd.storageCommand.DataBlock, b[0:1]...)
-		} else {
-			break
+	cmd := t.curCmd.storageCommand
+	size := int(cmd.NumBytes) + 2
+	if cmd.DataBlock == nil {
+		cmd.DataBlock = make([]byte, min(size, dataBlockChunk))
+		t.blockRead = 0
+	}
+	for t.blockRead < size {
+		if t.blockRead == len(cmd.DataBlock) {
+			block := make([]byte, min(size, 2*len(cmd.DataBlock)))
+			copy(block, cmd.DataBlock)
+			cmd.DataBlock = block
+		}
+		if t.start < t.end {
+			n := copy(cmd.DataBlock[t.blockRead:], t.in[t.start:t.end])
+			t.start += n
+			t.blockRead += n
+			continue
+		}
+		if err := t.wireOut.Flush(); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(t.wireIn, cmd.DataBlock[t.blockRead:])
+		t.blockRead += n
+		if err != nil {
+			// only report an error if no bytes were read
+			if n > 0 {
+				return nil
+			}
+			return err
 		}
 	}
 
-	lenDataBlock := len(t.curCmd.storageCommand.DataBlock)
-	if lenDataBlock == int(t.curCmd.storageCommand.NumBytes)+2 {
-		if string(t.curCmd.storageCommand.DataBlock[lenDataBlock-2:]) != "\r\n" {
-			return dataBlockTooLong
-		}
-		t.curCmd.storageCommand.DataBlock = t.curCmd.storageCommand.DataBlock[0 : lenDataBlock-2]
-		t.cmdComplete = true
+	if string(cmd.DataBlock[size-2:]) != "\r\n" {
+		return dataBlockTooLong
 	}
+	cmd.DataBlock = cmd.DataBlock[:size-2]
+	t.cmdComplete = true
 	return nil
 }
 
@@ -296,6 +708,21 @@ func (t *textProtocolMessageBuffer) readBody() error {
 	} else if IsDeleteCommand(t.cmdType) {
 		// no body, so just set completion
 		t.cmdComplete = true
+	} else if IsArithmeticCommand(t.cmdType) {
+		// no body, so just set completion
+		t.cmdComplete = true
+	} else if IsTouchCommand(t.cmdType) {
+		// no body, so just set completion
+		t.cmdComplete = true
+	} else if IsFlushCommand(t.cmdType) {
+		// no body, so just set completion
+		t.cmdComplete = true
+	} else if IsStatsCommand(t.cmdType) {
+		// no body, so just set completion
+		t.cmdComplete = true
+	} else if IsAdminCommand(t.cmdType) {
+		// no body, so just set completion
+		t.cmdComplete = true
 	}
 	return nil
 }
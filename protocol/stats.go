@@ -0,0 +1,122 @@
+package protocol
+
+import (
+	"fmt"
+	"github.com/tshprecher/mcache/store"
+	"sort"
+)
+
+// Version is the server version reported to clients.
+const Version = "0.1.0"
+
+// A Stat is a single named statistic reported by the stats command.
+type Stat struct {
+	Name  string
+	Value string
+}
+
+// NewStat returns a Stat whose value is formatted with fmt.Sprint.
+func NewStat(name string, value interface{}) Stat {
+	return Stat{name, fmt.Sprint(value)}
+}
+
+// A Host is the server running a TextSession. It supplies the server-level
+// statistics and operations that a session exposes but does not own.
+type Host interface {
+	// Stats returns general statistics about the server, like its
+	// uptime and connection counts.
+	Stats() []Stat
+
+	// Settings returns the configuration of the server.
+	Settings() []Stat
+
+	// Conns returns statistics about each open connection.
+	Conns() []Stat
+
+	// SetVerbosity sets the logging verbosity of the server.
+	SetVerbosity(level int) error
+
+	// Shutdown stops the server from accepting connections and drains
+	// all open sessions. It returns an error if shutdown is disabled.
+	Shutdown() error
+}
+
+// engineStats returns the general statistics of a StorageEngine in the
+// order memcache reports them, followed by those of its EvictionPolicy.
+func engineStats(s store.EngineStats) []Stat {
+	stats := []Stat{
+		NewStat("cmd_get", s.CmdGet),
+		NewStat("cmd_set", s.CmdSet),
+		NewStat("cmd_flush", s.CmdFlush),
+		NewStat("cmd_touch", s.CmdTouch),
+		NewStat("get_hits", s.GetHits),
+		NewStat("get_misses", s.GetMisses),
+		NewStat("delete_misses", s.DeleteMisses),
+		NewStat("delete_hits", s.DeleteHits),
+		NewStat("incr_misses", s.IncrMisses),
+		NewStat("incr_hits", s.IncrHits),
+		NewStat("decr_misses", s.DecrMisses),
+		NewStat("decr_hits", s.DecrHits),
+		NewStat("cas_misses", s.CasMisses),
+		NewStat("cas_hits", s.CasHits),
+		NewStat("cas_badval", s.CasBadval),
+		NewStat("touch_hits", s.TouchHits),
+		NewStat("touch_misses", s.TouchMisses),
+		NewStat("limit_maxbytes", s.LimitMaxbytes),
+		NewStat("bytes", s.Bytes),
+		NewStat("curr_items", s.CurrItems),
+		NewStat("total_items", s.TotalItems),
+		NewStat("evictions", s.Evictions),
+		NewStat("reclaimed", s.Reclaimed),
+	}
+	if s.Admission {
+		stats = append(stats, NewStat("not_admitted", s.NotAdmitted))
+	}
+	if s.Adaptive {
+		stats = append(stats, NewStat("arc_p", s.ArcP))
+	}
+	return stats
+}
+
+// itemsStats returns the statistics for 'stats items'. There are no slab
+// classes, so every item is reported under class 1.
+func itemsStats(s store.EngineStats) []Stat {
+	return []Stat{
+		NewStat("items:1:number", s.CurrItems),
+		NewStat("items:1:evicted", s.Evictions),
+		NewStat("items:1:reclaimed", s.Reclaimed),
+	}
+}
+
+// slabsStats returns the statistics for 'stats slabs'. Memory is not
+// allocated in slabs, so a single class holding every item is reported.
+func slabsStats(s store.EngineStats) []Stat {
+	return []Stat{
+		NewStat("1:used_chunks", s.CurrItems),
+		NewStat("1:mem_requested", s.Bytes),
+		NewStat("1:get_hits", s.GetHits),
+		NewStat("1:cmd_set", s.CmdSet),
+		NewStat("1:delete_hits", s.DeleteHits),
+		NewStat("1:incr_hits", s.IncrHits),
+		NewStat("1:decr_hits", s.DecrHits),
+		NewStat("1:cas_hits", s.CasHits),
+		NewStat("1:cas_badval", s.CasBadval),
+		NewStat("1:touch_hits", s.TouchHits),
+		NewStat("active_slabs", 1),
+		NewStat("total_malloced", s.Bytes),
+	}
+}
+
+// sizesStats returns the statistics for 'stats sizes', ordered by size.
+func sizesStats(sizes map[int]uint64) []Stat {
+	keys := make([]int, 0, len(sizes))
+	for size := range sizes {
+		keys = append(keys, size)
+	}
+	sort.Ints(keys)
+	stats := make([]Stat, 0, len(keys))
+	for _, size := range keys {
+		stats = append(stats, NewStat(fmt.Sprint(size), sizes[size]))
+	}
+	return stats
+}
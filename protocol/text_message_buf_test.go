@@ -2,6 +2,10 @@ package protocol
 
 import (
 	"bytes"
+	"fmt"
+	"github.com/tshprecher/mcache/store"
+	"io"
+	"io/ioutil"
 	"reflect"
 	"testing"
 )
@@ -31,6 +35,24 @@ func expectOneSubcommand(t *testing.T, received *Command) {
 	if received.deleteCommand != nil {
 		count++
 	}
+	if received.arithmeticCommand != nil {
+		count++
+	}
+	if received.touchCommand != nil {
+		count++
+	}
+	if received.flushCommand != nil {
+		count++
+	}
+	if received.statsCommand != nil {
+		count++
+	}
+	if received.adminCommand != nil {
+		count++
+	}
+	if received.authCommand != nil {
+		count++
+	}
 	if count != 1 {
 		t.Errorf("expected one non-nil subcommand")
 	}
@@ -55,6 +77,18 @@ func expectCommandEquals(t *testing.T, expected, actual *Command) {
 		expectEquals(t, *expected.retrievalCommand, *actual.retrievalCommand)
 	} else if expected.deleteCommand != nil {
 		expectEquals(t, *expected.deleteCommand, *actual.deleteCommand)
+	} else if expected.arithmeticCommand != nil {
+		expectEquals(t, *expected.arithmeticCommand, *actual.arithmeticCommand)
+	} else if expected.touchCommand != nil {
+		expectEquals(t, *expected.touchCommand, *actual.touchCommand)
+	} else if expected.flushCommand != nil {
+		expectEquals(t, *expected.flushCommand, *actual.flushCommand)
+	} else if expected.statsCommand != nil {
+		expectEquals(t, *expected.statsCommand, *actual.statsCommand)
+	} else if expected.adminCommand != nil {
+		expectEquals(t, *expected.adminCommand, *actual.adminCommand)
+	} else if expected.authCommand != nil {
+		expectEquals(t, *expected.authCommand, *actual.authCommand)
 	}
 }
 
@@ -155,6 +189,31 @@ func TestTextReadStorageCommand(t *testing.T) {
 	testTextRead(t, buf, wireIn, packets, expResults)
 }
 
+func TestTextReadLargeDataBlock(t *testing.T) {
+	// with a limit, a data block of 4 GiB is rejected
+	wireIn, wireOut := &bytes.Buffer{}, &bytes.Buffer{}
+	buf := NewTextProtocolMessageBuffer(wireIn, wireOut, 1024)
+	testTextRead(t, buf, wireIn, [][]byte{[]byte("set key 0 0 4294967295\r\n")},
+		[]readResult{readResult{err: NewClientErrorResponse("num_bytes exceeded max of 1024")}})
+
+	// without a limit, a data block only grows as its bytes arrive
+	value := bytes.Repeat([]byte("x"), 4*1024*1024)
+	buf = NewTextProtocolMessageBuffer(wireIn, wireOut, 0)
+	wireIn.WriteString(fmt.Sprintf("set key 0 0 %d\r\n", len(value)))
+	wireIn.Write(value[:100])
+	if cmd, err := buf.Read(); cmd != nil || err != nil {
+		t.Errorf("expected an incomplete read, received %v and %v", cmd, err)
+	}
+	if block := buf.curCmd.storageCommand.DataBlock; len(block) > dataBlockChunk {
+		t.Errorf("expected a block of at most %d bytes, received %d", dataBlockChunk, len(block))
+	}
+	wireIn.Write(value[100:])
+	wireIn.WriteString("\r\n")
+	if cmd, err := buf.Read(); err != nil || !bytes.Equal(cmd.storageCommand.DataBlock, value) {
+		t.Errorf("expected a value of %d bytes, received %v", len(value), err)
+	}
+}
+
 func TestTextReadMultiple(t *testing.T) {
 	packets := [][]byte{
 		[]byte("set my_key 3 2 1\r\n1\r\n"),
@@ -217,18 +276,321 @@ func TestTextReadDeleteCommand(t *testing.T) {
 	testTextRead(t, buf, wireIn, packets, expResults)
 }
 
+func TestTextReadArithmeticCommand(t *testing.T) {
+	packets := [][]byte{
+		[]byte("incr my_key 5\r\n"),
+		[]byte("decr my_key 18446744073709551615 noreply\r\n"),
+		[]byte("incr my_key -1\r\n"),
+		[]byte("decr my_key\r\n"),
+	}
+	expResults := []readResult{
+		readResult{
+			cmd: &Command{
+				arithmeticCommand: &ArithmeticCommand{
+					Typ:     IncrCommand,
+					Key:     "my_key",
+					Delta:   5,
+					NoReply: false,
+				},
+			},
+			err: nil,
+		},
+		readResult{
+			cmd: &Command{
+				arithmeticCommand: &ArithmeticCommand{
+					Typ:     DecrCommand,
+					Key:     "my_key",
+					Delta:   18446744073709551615,
+					NoReply: true,
+				},
+			},
+			err: nil,
+		},
+		readResult{
+			err: invalidDelta,
+		},
+		readResult{
+			err: invalidArithCommand,
+		},
+	}
+	wireIn, wireOut := &bytes.Buffer{}, &bytes.Buffer{}
+	buf := NewTextProtocolMessageBuffer(wireIn, wireOut, 1024)
+	testTextRead(t, buf, wireIn, packets, expResults)
+}
+
+func TestTextReadTouchCommand(t *testing.T) {
+	packets := [][]byte{
+		[]byte("touch my_key 10\r\n"),
+		[]byte("touch my_key -1 noreply\r\n"),
+		[]byte("touch my_key\r\n"),
+	}
+	expResults := []readResult{
+		readResult{
+			cmd: &Command{
+				touchCommand: &TouchCommand{
+					Key:     "my_key",
+					ExpTime: 10,
+					NoReply: false,
+				},
+			},
+			err: nil,
+		},
+		readResult{
+			cmd: &Command{
+				touchCommand: &TouchCommand{
+					Key:     "my_key",
+					ExpTime: -1,
+					NoReply: true,
+				},
+			},
+			err: nil,
+		},
+		readResult{
+			err: invalidTouchCommand,
+		},
+	}
+	wireIn, wireOut := &bytes.Buffer{}, &bytes.Buffer{}
+	buf := NewTextProtocolMessageBuffer(wireIn, wireOut, 1024)
+	testTextRead(t, buf, wireIn, packets, expResults)
+}
+
+func TestTextReadGatCommand(t *testing.T) {
+	packets := [][]byte{
+		[]byte("gat 10 key key2\r\n"),
+		[]byte("gats 20 key\r\n"),
+		[]byte("gat key\r\n"),
+	}
+	expResults := []readResult{
+		readResult{
+			cmd: &Command{
+				retrievalCommand: &RetrievalCommand{
+					Typ:     GatCommand,
+					ExpTime: 10,
+					keys:    []string{"key", "key2"},
+				},
+			},
+			err: nil,
+		},
+		readResult{
+			cmd: &Command{
+				retrievalCommand: &RetrievalCommand{
+					Typ:     GatsCommand,
+					ExpTime: 20,
+					keys:    []string{"key"},
+				},
+			},
+			err: nil,
+		},
+		readResult{
+			err: invalidGatCommand,
+		},
+	}
+	wireIn, wireOut := &bytes.Buffer{}, &bytes.Buffer{}
+	buf := NewTextProtocolMessageBuffer(wireIn, wireOut, 1024)
+	testTextRead(t, buf, wireIn, packets, expResults)
+}
+
+func TestTextReadFlushCommand(t *testing.T) {
+	packets := [][]byte{
+		[]byte("flush_all\r\n"),
+		[]byte("flush_all noreply\r\n"),
+		[]byte("flush_all 10\r\n"),
+		[]byte("flush_all 10 noreply\r\n"),
+		[]byte("flush_all 10 20\r\n"),
+		[]byte("flush_all now\r\n"),
+	}
+	expResults := []readResult{
+		readResult{
+			cmd: &Command{flushCommand: &FlushCommand{Delay: 0, NoReply: false}},
+		},
+		readResult{
+			cmd: &Command{flushCommand: &FlushCommand{Delay: 0, NoReply: true}},
+		},
+		readResult{
+			cmd: &Command{flushCommand: &FlushCommand{Delay: 10, NoReply: false}},
+		},
+		readResult{
+			cmd: &Command{flushCommand: &FlushCommand{Delay: 10, NoReply: true}},
+		},
+		readResult{
+			err: noReplyExpected,
+		},
+		readResult{
+			err: invalidDelay,
+		},
+	}
+	wireIn, wireOut := &bytes.Buffer{}, &bytes.Buffer{}
+	buf := NewTextProtocolMessageBuffer(wireIn, wireOut, 1024)
+	testTextRead(t, buf, wireIn, packets, expResults)
+}
+
+func TestTextReadStatsCommand(t *testing.T) {
+	packets := [][]byte{
+		[]byte("stats\r\n"),
+		[]byte("stats items\r\n"),
+		[]byte("stats items slabs\r\n"),
+	}
+	expResults := []readResult{
+		readResult{
+			cmd: &Command{statsCommand: &StatisticsCommand{Group: ""}},
+		},
+		readResult{
+			cmd: &Command{statsCommand: &StatisticsCommand{Group: "items"}},
+		},
+		readResult{
+			err: invalidStatsCommand,
+		},
+	}
+	wireIn, wireOut := &bytes.Buffer{}, &bytes.Buffer{}
+	buf := NewTextProtocolMessageBuffer(wireIn, wireOut, 1024)
+	testTextRead(t, buf, wireIn, packets, expResults)
+}
+
+func TestTextReadAdminCommand(t *testing.T) {
+	packets := [][]byte{
+		[]byte("version\r\n"),
+		[]byte("verbosity 2\r\n"),
+		[]byte("verbosity 1 noreply\r\n"),
+		[]byte("verbosity\r\n"),
+		[]byte("verbosity high\r\n"),
+		[]byte("quit\r\n"),
+		[]byte("shutdown now\r\n"),
+		[]byte("shutdown\r\n"),
+	}
+	expResults := []readResult{
+		readResult{
+			cmd: &Command{adminCommand: &AdminCommand{Typ: VersionCommand}},
+		},
+		readResult{
+			cmd: &Command{adminCommand: &AdminCommand{Typ: VerbosityCommand, Verbosity: 2}},
+		},
+		readResult{
+			cmd: &Command{adminCommand: &AdminCommand{Typ: VerbosityCommand, Verbosity: 1, NoReply: true}},
+		},
+		readResult{
+			err: invalidVerbosity,
+		},
+		readResult{
+			err: invalidLevel,
+		},
+		readResult{
+			cmd: &Command{adminCommand: &AdminCommand{Typ: QuitCommand, NoReply: true}},
+		},
+		readResult{
+			err: invalidAdminCommand,
+		},
+		readResult{
+			cmd: &Command{adminCommand: &AdminCommand{Typ: ShutdownCommand}},
+		},
+	}
+	wireIn, wireOut := &bytes.Buffer{}, &bytes.Buffer{}
+	buf := NewTextProtocolMessageBuffer(wireIn, wireOut, 1024)
+	testTextRead(t, buf, wireIn, packets, expResults)
+}
+
+func TestTextReadMetaCommand(t *testing.T) {
+	packets := [][]byte{
+		[]byte("mg key v k c t O123 q T30 N10 R5\r\n"),
+		[]byte("ms key 2 F3 T60 C9 I MA c\r\nab\r\n"),
+		[]byte("md key q I T30\r\n"),
+		[]byte("ma key N60 J10 D5 M- v\r\n"),
+		[]byte("mn\r\n"),
+		[]byte("me key\r\n"),
+		[]byte("mg key x\r\n"),
+		[]byte("ms key 2 MX\r\n"),
+		[]byte("ma key Dten\r\n"),
+		[]byte("ms key\r\n"),
+	}
+	expResults := []readResult{
+		readResult{
+			cmd: &Command{retrievalCommand: &RetrievalCommand{Typ: MetaGetCommand, keys: []string{"key"}, Meta: &MetaFlags{
+				Returns: "kctO", Value: true, Opaque: "123", Quiet: true, Touch: true, ExpTime: 30,
+				Vivify: true, VivifyExpTime: 10, Recache: true, RecacheTime: 5, Delta: 1,
+			}}},
+		},
+		readResult{
+			cmd: &Command{storageCommand: &StorageCommand{Typ: MetaSetCommand, Key: "key", Flags: 3, ExpTime: 60, NumBytes: 2,
+				DataBlock: []byte("ab"), Meta: &MetaFlags{
+					Returns: "c", Touch: true, ExpTime: 60, CompareCas: 9, Invalidate: true, Mode: 'A', Delta: 1,
+				}}},
+		},
+		readResult{
+			cmd: &Command{deleteCommand: &DeleteCommand{Key: "key", Meta: &MetaFlags{
+				Quiet: true, Invalidate: true, Touch: true, ExpTime: 30, Delta: 1,
+			}}},
+		},
+		readResult{
+			cmd: &Command{arithmeticCommand: &ArithmeticCommand{Typ: MetaArithmeticCommand, Key: "key", Delta: 5, Meta: &MetaFlags{
+				Value: true, Vivify: true, VivifyExpTime: 60, Initial: 10, Delta: 5, Mode: 'D',
+			}}},
+		},
+		readResult{
+			cmd: &Command{adminCommand: &AdminCommand{Typ: MetaNoopCommand}},
+		},
+		readResult{
+			cmd: &Command{retrievalCommand: &RetrievalCommand{Typ: MetaDebugCommand, keys: []string{"key"}}},
+		},
+		readResult{
+			err: invalidMetaFlag,
+		},
+		readResult{
+			err: invalidMetaMode,
+		},
+		readResult{
+			err: invalidMetaToken,
+		},
+		readResult{
+			err: invalidMetaCommand,
+		},
+	}
+	wireIn, wireOut := &bytes.Buffer{}, &bytes.Buffer{}
+	buf := NewTextProtocolMessageBuffer(wireIn, wireOut, 1024)
+	testTextRead(t, buf, wireIn, packets, expResults)
+}
+
+func TestTextMetaResponse(t *testing.T) {
+	responses := []TextMetaResponse{
+		TextMetaResponse{code: "EN"},
+		TextMetaResponse{code: "HD", flags: []string{"c1", "W"}},
+		TextMetaResponse{code: "HD", flags: []string{"s3"}, value: []byte("val"), withValue: true},
+	}
+	expected := []string{
+		"EN\r\n",
+		"HD c1 W\r\n",
+		"VA 3 s3\r\nval\r\n",
+	}
+	for i, resp := range responses {
+		if string(resp.Bytes()) != expected[i] {
+			t.Errorf("expected %#v, received %#v", expected[i], string(resp.Bytes()))
+		}
+	}
+}
+
+func TestTextStatsResponse(t *testing.T) {
+	resp := TextStatsResponse{[]Stat{NewStat("pid", 10), NewStat("version", Version)}}
+	expected := "STAT pid 10\r\nSTAT version " + Version + "\r\nEND\r\n"
+	if string(resp.Bytes()) != expected {
+		t.Errorf("expected %#v, received %#v", expected, string(resp.Bytes()))
+	}
+}
+
 func TestTextWrite(t *testing.T) {
 	wireIn, wireOut := &bytes.Buffer{}, &bytes.Buffer{}
 	buf := NewTextProtocolMessageBuffer(wireIn, wireOut, 1024)
 
 	resp := TextStoredResponse{}
 	buf.Write(resp)
+	if wireOut.Len() != 0 {
+		t.Errorf("expected no bytes written before flushing, received %v", wireOut.Len())
+	}
+	buf.Flush()
 	if wireOut.Len() != len(resp.Bytes()) {
 		t.Errorf("expected %v bytes written, received %v", len(resp.Bytes()), wireOut.Len())
 	}
 
 	resp2 := TextExistsResponse{}
 	buf.Write(resp2)
+	buf.Flush()
 	if wireOut.Len() != len(resp.Bytes())+len(resp2.Bytes()) {
 		t.Errorf("expected %v bytes written, received %v", len(resp.Bytes())+len(resp2.Bytes()), wireOut.Len())
 	}
@@ -240,3 +602,67 @@ func TestTextWrite(t *testing.T) {
 		t.Errorf("expected bytes written value %v, received %v", []byte("STORED\r\nEXISTS\r\n"), bytes)
 	}
 }
+
+// countingReader counts the calls to Read on the underlying reader.
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+// countingWriter counts the calls to Write on the underlying writer.
+type countingWriter struct {
+	w      io.Writer
+	writes int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.w.Write(p)
+}
+
+// The benchmarks report the reads from and writes to the wire per op.
+
+func BenchmarkTextReadLargeValue(b *testing.B) {
+	value := bytes.Repeat([]byte("x"), 1024*1024)
+	packet := append([]byte(fmt.Sprintf("set key 0 0 %d\r\n", len(value))), value...)
+	packet = append(packet, "\r\n"...)
+	wireIn := &countingReader{r: &bytes.Buffer{}}
+	buf := NewTextProtocolMessageBuffer(wireIn, ioutil.Discard, 0)
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wireIn.r = bytes.NewReader(packet)
+		if cmd, err := buf.Read(); cmd == nil || err != nil {
+			b.Fatalf("expected a command, received %v", err)
+		}
+	}
+	b.ReportMetric(float64(wireIn.reads)/float64(b.N), "reads/op")
+}
+
+func BenchmarkTextPipelinedGets(b *testing.B) {
+	const pipelined = 100
+	packet := bytes.Repeat([]byte("get key\r\n"), pipelined)
+	resp := TextGetOrGetsResponse{pairs: []struct {
+		k string
+		v store.Value
+	}{{"key", store.Value{Bytes: []byte("value")}}}}
+	wireIn, wireOut := &countingReader{r: &bytes.Buffer{}}, &countingWriter{w: ioutil.Discard}
+	buf := NewTextProtocolMessageBuffer(wireIn, wireOut, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wireIn.r = bytes.NewReader(packet)
+		for j := 0; j < pipelined; j++ {
+			if cmd, err := buf.Read(); cmd == nil || err != nil {
+				b.Fatalf("expected a command, received %v", err)
+			}
+			buf.Write(resp)
+		}
+	}
+	b.ReportMetric(float64(wireIn.reads)/float64(b.N), "reads/op")
+	b.ReportMetric(float64(wireOut.writes)/float64(b.N), "writes/op")
+}
@@ -2,37 +2,137 @@ package protocol
 
 import (
 	"errors"
+	"fmt"
 	"github.com/tshprecher/mcache/store"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// lastSessionID is the ID of the most recently created TextSession.
+var lastSessionID uint64
+
 // A TextSession manages the connection and protocol logic by
 // reading commands from a MessageBuffer, handling the business logic,
 // and writing responses back to the client.
 type TextSession struct {
+	id            uint64
 	conn          net.Conn
 	messageBuffer MessageBuffer
 	engine        store.StorageEngine
-	alive         bool
+	host          Host
 	maxValSize    int
 	timeout       int
-	lastActive    time.Time
+	writeTimeout  int
+	lastActive    int64 // unix nanoseconds, accessed atomically
+
+	// lifecycle state, guarded by mu
+	mu       sync.Mutex
+	alive    bool
+	busy     bool
+	draining bool
+
+	// adminOnly restricts the session to admin and stats commands, and
+	// rejected is set once it refuses any other command, guarded by mu
+	adminOnly bool
+	rejected  bool
+
+	// auth checks the credentials of SASL and text protocol auth, which are
+	// refused if nil. If authRequired, every other command is refused until
+	// the client has authenticated.
+	auth          Authenticator
+	authRequired  bool
+	authenticated bool
+}
+
+// An Authenticator checks the credentials a client authenticates with.
+type Authenticator interface {
+	// Authenticate returns true if and only if the password is the user's.
+	Authenticate(username, password string) bool
 }
 
 // NewTextSession returns a new TextSession given the established
-// connection, an existing StorageEngine, and a timeout in seconds. If no
-// command is read within the given timeout period, the connection and session
-// are closed.
-func NewTextSession(conn net.Conn, engine store.StorageEngine, maxValSize, timeout int) *TextSession {
-	return &TextSession{
-		conn:          conn,
-		messageBuffer: NewTextProtocolMessageBuffer(conn, conn, maxValSize),
-		engine:        engine,
-		alive:         true,
-		timeout:       timeout,
-		lastActive:    time.Now(),
+// connection, an existing StorageEngine, the Host running the session,
+// a timeout in seconds and a write timeout in seconds. If no command is
+// read within the given timeout period, or a response cannot be written
+// within the write timeout, the connection and session are closed. A write
+// timeout <= 0 never times out writes.
+func NewTextSession(conn net.Conn, engine store.StorageEngine, host Host, maxValSize, timeout, writeTimeout int) *TextSession {
+	t := &TextSession{
+		id:           atomic.AddUint64(&lastSessionID, 1),
+		conn:         conn,
+		engine:       engine,
+		host:         host,
+		alive:        true,
+		timeout:      timeout,
+		writeTimeout: writeTimeout,
+		lastActive:   time.Now().UnixNano(),
+	}
+	t.messageBuffer = NewTextProtocolMessageBuffer(conn, t.wireOut(), maxValSize)
+	return t
+}
+
+// NewSession returns a new TextSession like NewTextSession, except that
+// it speaks the binary protocol if the first byte the client sends is the
+// binary request magic.
+func NewSession(conn net.Conn, engine store.StorageEngine, host Host, maxValSize, timeout, writeTimeout int) *TextSession {
+	return NewSessionFromReader(conn, conn, engine, host, maxValSize, timeout, writeTimeout)
+}
+
+// NewSessionFromReader returns a new TextSession like NewSession, except
+// that commands are read from wireIn instead of the connection. Errors
+// returned by wireIn, such as a read that would block, are returned by Serve.
+func NewSessionFromReader(conn net.Conn, wireIn io.Reader, engine store.StorageEngine, host Host, maxValSize, timeout, writeTimeout int) *TextSession {
+	t := NewTextSession(conn, engine, host, maxValSize, timeout, writeTimeout)
+	t.messageBuffer = NewMessageBuffer(wireIn, t.wireOut(), maxValSize)
+	return t
+}
+
+// wireOut returns the writer responses are written to.
+func (t *TextSession) wireOut() io.Writer {
+	return &deadlineWriter{t.conn, time.Duration(t.writeTimeout) * time.Second}
+}
+
+// errWriteTimeout is returned when a response cannot be written within the
+// write timeout. Unlike the timeout of the underlying connection, it is not
+// temporary, so the session is closed.
+var errWriteTimeout = errors.New("write timed out")
+
+// deadlineWriter writes every byte it is given to a connection, retrying
+// short writes, and fails if the client does not accept them within the
+// timeout.
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) Write(p []byte) (written int, err error) {
+	if w.timeout > 0 {
+		if err = w.conn.SetWriteDeadline(time.Now().Add(w.timeout)); err != nil {
+			return
+		}
+	}
+	for written < len(p) {
+		n, err := w.conn.Write(p[written:])
+		written += n
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return written, errWriteTimeout
+		} else if err != nil {
+			return written, err
+		} else if n == 0 {
+			return written, io.ErrShortWrite
+		}
 	}
+	return
+}
+
+// ID returns a number uniquely identifying the session within the process.
+func (t *TextSession) ID() uint64 {
+	return t.id
 }
 
 // RemoteAddr returns conn.RemoteAddr() of the underlying connection.
@@ -40,67 +140,242 @@ func (t *TextSession) RemoteAddr() net.Addr {
 	return t.conn.RemoteAddr()
 }
 
+// LastActive returns the time the session last received a command. It
+// is safe to call from any goroutine.
+func (t *TextSession) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.lastActive))
+}
+
 // Alive returns true if and only if the session is still servicing requests.
 func (t *TextSession) Alive() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	return t.alive
 }
 
 // Close closes the underlying connection and designates this session as dead.
 func (t *TextSession) Close() error {
-	err := t.conn.Close()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closeLocked()
+}
+
+func (t *TextSession) closeLocked() error {
+	if !t.alive {
+		return nil
+	}
 	t.alive = false
-	return err
+	return t.conn.Close()
+}
+
+// Drain closes the session as soon as it is not serving a command: once
+// the current command's response has been written, or right away if it is
+// idle, after flushing any buffered responses. It is safe to call from any
+// goroutine.
+func (t *TextSession) Drain() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = true
+	if !t.busy && t.alive {
+		// wake the goroutine blocked reading, so that it flushes and closes
+		t.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// RestrictToAdmin limits the session to admin and stats commands, so an
+// operator can still reach a server that is at its connection limit. Any
+// other command is answered with TooManyConnections and closes the session.
+func (t *TextSession) RestrictToAdmin() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.adminOnly = true
+}
+
+// EnableAuth lets the client authenticate against the Authenticator, with
+// SASL PLAIN in the binary protocol or a set carrying "<username> <password>"
+// in the text protocol. If required, every other command is refused, closing
+// the session, until the client has authenticated. It must be called before
+// the session is served.
+func (t *TextSession) EnableAuth(auth Authenticator, required bool) {
+	t.auth = auth
+	t.authRequired = required
+}
+
+// Rejected returns true if the session was closed for sending a command
+// other than an admin or stats command while restricted to them.
+func (t *TextSession) Rejected() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rejected
+}
+
+// reject returns true, marking the session as rejected, if the command is
+// not allowed on the session.
+func (t *TextSession) reject(cmd *Command) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.adminOnly && cmd.adminCommand == nil && cmd.statsCommand == nil && cmd.authCommand == nil {
+		t.rejected = true
+	}
+	return t.rejected
+}
+
+// Draining returns true if the session has been asked to drain.
+func (t *TextSession) Draining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// armReadDeadline sets the connection to time out reads once the session
+// has been idle for the timeout, so that an idle session waits on the
+// network rather than polling. It returns false, leaving the deadline Drain
+// set, if the session is draining.
+func (t *TextSession) armReadDeadline() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	deadline := time.Time{}
+	if t.timeout > 0 {
+		deadline = t.LastActive().Add(time.Duration(t.timeout) * time.Second)
+	}
+	t.conn.SetReadDeadline(deadline)
+	return true
+}
+
+// flushAndClose writes any buffered responses before closing the session.
+func (t *TextSession) flushAndClose() error {
+	t.messageBuffer.Flush()
+	return t.Close()
+}
+
+// begin marks the session as busy serving a command. A command already
+// read when the session is asked to drain is still served, since the client
+// is waiting on its response.
+func (t *TextSession) begin() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.busy = true
+}
+
+// end marks the session as done serving a command, closing it if it has
+// been asked to drain in the meantime.
+func (t *TextSession) end() {
+	t.mu.Lock()
+	t.busy = false
+	draining := t.draining
+	t.mu.Unlock()
+	if draining {
+		t.flushAndClose()
+	}
 }
 
+// errSessionTimeout is returned when no command is read within the timeout.
+var errSessionTimeout = errors.New("session timed out")
+
+// TooManyConnections is the error sent to a client the server cannot serve
+// because too many connections are open.
+var TooManyConnections = NewServerErrorResponse("too many open connections")
+
+var (
+	// unauthenticated is sent in response to any command but auth before
+	// the client has authenticated, and authFailure for bad credentials
+	unauthenticated = NewClientErrorResponse("unauthenticated")
+	authFailure     = NewClientErrorResponse("authentication failure")
+)
+
 // Serve attempts to read a command, handle it, and write the response
-// or error back to the client. It returns nil if and only if no command can
-// be processed or a command has successfully been processed. It is intended
-// to be polled.
+// or error back to the client. It blocks until a command or part of one
+// is read, and returns nil if and only if no command can be processed yet
+// or a command has successfully been processed. It is intended to be called
+// in a loop while the session is alive.
 func (t *TextSession) Serve() error {
-	if !t.alive {
+	if !t.Alive() {
 		return errors.New("cannot serve a dead session")
 	}
+	if !t.armReadDeadline() {
+		return t.flushAndClose()
+	}
 	cmd, err := t.messageBuffer.Read()
-	if cmd == nil && time.Since(t.lastActive) >= time.Duration(t.timeout*1e9) {
-		return errors.New("session timed out")
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		if t.Draining() {
+			return t.flushAndClose()
+		}
+		return errSessionTimeout
 	}
 	if err != nil {
 		if perr, ok := err.(*ErrorResponse); ok {
 			t.messageBuffer.Write(perr)
+			t.messageBuffer.Flush()
 		}
 		return err
 	}
 
 	if cmd != nil {
-		t.lastActive = time.Now()
-		if cmd.storageCommand != nil {
+		t.begin()
+		defer t.end()
+		atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+		if t.authRequired && !t.authenticated && cmd.authCommand == nil {
+			err = t.serveTextAuth(cmd)
+		} else if t.reject(cmd) {
+			err = TooManyConnections
+		} else if cmd.authCommand != nil {
+			err = t.serveAuth(cmd.authCommand)
+		} else if cmd.storageCommand != nil {
 			switch cmd.storageCommand.Typ {
 			case SetCommand:
 				err = t.serveSet(cmd.storageCommand)
 			case AddCommand:
-				err = NewServerErrorResponse("add not yet implemented")
+				err = t.serveConditionalStore(cmd.storageCommand, t.engine.Add)
 			case ReplaceCommand:
-				err = NewServerErrorResponse("replace not yet implemented")
+				err = t.serveConditionalStore(cmd.storageCommand, t.engine.Replace)
 			case AppendCommand:
-				err = NewServerErrorResponse("append not yet implemented")
+				err = t.serveConditionalStore(cmd.storageCommand, t.engine.Append)
 			case PrependCommand:
-				err = NewServerErrorResponse("prepend not yet implemented")
+				err = t.serveConditionalStore(cmd.storageCommand, t.engine.Prepend)
 			case CasCommand:
 				err = t.serveCas(cmd.storageCommand)
+			case MetaSetCommand:
+				err = t.serveMetaSet(cmd.storageCommand)
 			}
 		} else if cmd.retrievalCommand != nil {
 			switch cmd.retrievalCommand.Typ {
-			case GetCommand, GetsCommand:
+			case GetCommand, GetsCommand, GatCommand, GatsCommand:
 				err = t.serveGetAndGets(cmd.retrievalCommand)
+			case MetaGetCommand:
+				err = t.serveMetaGet(cmd.retrievalCommand)
+			case MetaDebugCommand:
+				err = t.serveMetaDebug(cmd.retrievalCommand)
 			}
 		} else if cmd.deleteCommand != nil {
-			err = t.serveDelete(cmd.deleteCommand)
+			if cmd.deleteCommand.Meta != nil {
+				err = t.serveMetaDelete(cmd.deleteCommand)
+			} else {
+				err = t.serveDelete(cmd.deleteCommand)
+			}
+		} else if cmd.arithmeticCommand != nil {
+			if cmd.arithmeticCommand.Typ == MetaArithmeticCommand {
+				err = t.serveMetaArithmetic(cmd.arithmeticCommand)
+			} else {
+				err = t.serveArithmetic(cmd.arithmeticCommand)
+			}
+		} else if cmd.touchCommand != nil {
+			err = t.serveTouch(cmd.touchCommand)
+		} else if cmd.flushCommand != nil {
+			err = t.serveFlushAll(cmd.flushCommand)
+		} else if cmd.statsCommand != nil {
+			err = t.serveStats(cmd.statsCommand)
+		} else if cmd.adminCommand != nil {
+			err = t.serveAdmin(cmd.adminCommand)
 		} else {
 			panic("no command set")
 		}
 	}
 	if perr, ok := err.(*ErrorResponse); ok {
 		t.messageBuffer.Write(perr)
+		t.messageBuffer.Flush()
 	}
 
 	return err
@@ -108,7 +383,13 @@ func (t *TextSession) Serve() error {
 
 // serveSet handles the protocol logic for the 'set' command
 func (t *TextSession) serveSet(cmd *StorageCommand) error {
-	ok := t.engine.Set(cmd.Key, store.Value{cmd.Flags, 0, cmd.DataBlock})
+	return t.serveConditionalStore(cmd, t.engine.Set)
+}
+
+// serveConditionalStore handles the protocol logic for the 'set', 'add', 'replace',
+// 'append' and 'prepend' commands given the StorageEngine operation backing the command.
+func (t *TextSession) serveConditionalStore(cmd *StorageCommand, op func(string, store.Value) bool) error {
+	ok := op(cmd.Key, store.Value{Flags: cmd.Flags, Bytes: cmd.DataBlock, Expiry: t.expiry(cmd.ExpTime)})
 	if ok && !cmd.NoReply {
 		return t.messageBuffer.Write(TextStoredResponse{})
 	} else if !ok && !cmd.NoReply {
@@ -119,7 +400,7 @@ func (t *TextSession) serveSet(cmd *StorageCommand) error {
 
 // serveCas handles the protocol logic for the 'cas' command
 func (t *TextSession) serveCas(cmd *StorageCommand) error {
-	exists, notFound := t.engine.Cas(cmd.Key, store.Value{cmd.Flags, cmd.CasUnique, cmd.DataBlock})
+	exists, notFound := t.engine.Cas(cmd.Key, store.Value{Flags: cmd.Flags, CasUnique: cmd.CasUnique, Bytes: cmd.DataBlock, Expiry: t.expiry(cmd.ExpTime)})
 	if exists && !cmd.NoReply {
 		return t.messageBuffer.Write(TextExistsResponse{})
 	} else if notFound && !cmd.NoReply {
@@ -130,14 +411,25 @@ func (t *TextSession) serveCas(cmd *StorageCommand) error {
 	return nil
 }
 
-// serveGetAndGets handles the protocol logic for the 'get' and 'gets' commands.
+// serveGetAndGets handles the protocol logic for the 'get', 'gets', 'gat' and
+// 'gats' commands.
 func (t *TextSession) serveGetAndGets(cmd *RetrievalCommand) error {
+	touch := cmd.Typ == GatCommand || cmd.Typ == GatsCommand
+	exp := t.expiry(cmd.ExpTime)
 	results := []struct {
 		k string
 		v store.Value
 	}{}
 	for _, k := range cmd.keys {
-		v, ok := t.engine.Get(k)
+		var (
+			v  store.Value
+			ok bool
+		)
+		if touch {
+			v, ok = t.engine.Touch(k, exp)
+		} else {
+			v, ok = t.engine.Get(k)
+		}
 		if ok {
 			results = append(results, struct {
 				k string
@@ -145,7 +437,7 @@ func (t *TextSession) serveGetAndGets(cmd *RetrievalCommand) error {
 			}{k, v})
 		}
 	}
-	return t.messageBuffer.Write(TextGetOrGetsResponse{pairs: results, withCasUniq: cmd.Typ == GetsCommand})
+	return t.messageBuffer.Write(TextGetOrGetsResponse{pairs: results, withCasUniq: cmd.Typ == GetsCommand || cmd.Typ == GatsCommand})
 }
 
 // serveDelete handles the protocol logic for the 'delete' command
@@ -158,3 +450,319 @@ func (t *TextSession) serveDelete(cmd *DeleteCommand) error {
 	}
 	return nil
 }
+
+// serveArithmetic handles the protocol logic for the 'incr' and 'decr' commands,
+// including the binary protocol's creation of missing counters
+func (t *TextSession) serveArithmetic(cmd *ArithmeticCommand) error {
+	value, found, err := t.engine.IncrDecr(cmd.Key, cmd.Delta, cmd.Typ == IncrCommand)
+	if err == nil && !found && cmd.Create {
+		// seed the missing counter, retrying the arithmetic if another
+		// client created it first
+		seed := store.Value{Bytes: []byte(strconv.FormatUint(cmd.Initial, 10)), Expiry: t.expiry(cmd.ExpTime)}
+		if t.engine.Add(cmd.Key, seed) {
+			value, found = cmd.Initial, true
+		} else {
+			value, found, err = t.engine.IncrDecr(cmd.Key, cmd.Delta, cmd.Typ == IncrCommand)
+		}
+	}
+	if err == store.ErrNotNumeric {
+		return NewClientErrorResponse(err.Error())
+	} else if err != nil {
+		return NewServerErrorResponse(err.Error())
+	}
+	if cmd.NoReply {
+		return nil
+	}
+	if !found {
+		return t.messageBuffer.Write(TextNotFoundResponse{})
+	}
+	return t.messageBuffer.Write(TextArithmeticResponse{value})
+}
+
+// serveTouch handles the protocol logic for the 'touch' command
+func (t *TextSession) serveTouch(cmd *TouchCommand) error {
+	_, ok := t.engine.Touch(cmd.Key, t.expiry(cmd.ExpTime))
+	if ok && !cmd.NoReply {
+		return t.messageBuffer.Write(TextTouchedResponse{})
+	} else if !ok && !cmd.NoReply {
+		return t.messageBuffer.Write(TextNotFoundResponse{})
+	}
+	return nil
+}
+
+// serveFlushAll handles the protocol logic for the 'flush_all' command
+func (t *TextSession) serveFlushAll(cmd *FlushCommand) error {
+	t.engine.FlushAll(t.expiry(cmd.Delay))
+	if cmd.NoReply {
+		return nil
+	}
+	return t.messageBuffer.Write(TextOkResponse{})
+}
+
+// serveStats handles the protocol logic for the 'stats' command and its
+// 'items', 'slabs', 'sizes', 'settings' and 'conns' groups.
+func (t *TextSession) serveStats(cmd *StatisticsCommand) error {
+	var stats []Stat
+	switch cmd.Group {
+	case "":
+		stats = append(t.host.Stats(), engineStats(t.engine.Stats())...)
+	case "items":
+		stats = itemsStats(t.engine.Stats())
+	case "slabs":
+		stats = slabsStats(t.engine.Stats())
+	case "sizes":
+		stats = sizesStats(t.engine.SizeHistogram())
+	case "settings":
+		stats = t.host.Settings()
+	case "conns":
+		stats = t.host.Conns()
+	default:
+		return commandNotFound
+	}
+	return t.messageBuffer.Write(TextStatsResponse{stats})
+}
+
+// serveAdmin handles the protocol logic for the 'version', 'verbosity',
+// 'quit', 'shutdown' and 'mn' commands, and the binary noop command.
+func (t *TextSession) serveAdmin(cmd *AdminCommand) error {
+	switch cmd.Typ {
+	case VersionCommand:
+		return t.messageBuffer.Write(TextVersionResponse{})
+	case VerbosityCommand:
+		if err := t.host.SetVerbosity(cmd.Verbosity); err != nil {
+			return NewServerErrorResponse(err.Error())
+		}
+		if cmd.NoReply {
+			return nil
+		}
+		return t.messageBuffer.Write(TextOkResponse{})
+	case QuitCommand:
+		if !cmd.NoReply {
+			t.messageBuffer.Write(TextOkResponse{})
+		}
+		t.flushAndClose()
+	case NoopCommand:
+		return t.messageBuffer.Write(TextOkResponse{})
+	case MetaNoopCommand:
+		return t.messageBuffer.Write(TextMetaResponse{code: "MN"})
+	case ShutdownCommand:
+		if err := t.host.Shutdown(); err != nil {
+			return NewClientErrorResponse(err.Error())
+		}
+	}
+	return nil
+}
+
+// serveAuth handles the protocol logic for the binary SASL list mechanisms
+// and SASL auth commands. Only the PLAIN mechanism is supported.
+func (t *TextSession) serveAuth(cmd *AuthCommand) error {
+	if t.auth == nil {
+		return commandNotFound
+	}
+	switch cmd.Typ {
+	case SaslListMechsCommand:
+		return t.messageBuffer.Write(SaslResponse{"PLAIN"})
+	case SaslAuthCommand:
+		if cmd.Mechanism != "PLAIN" || !t.auth.Authenticate(cmd.Username, cmd.Password) {
+			// like memcached, keep the session so the client can retry
+			return t.messageBuffer.Write(authFailure)
+		}
+		t.authenticated = true
+		return t.messageBuffer.Write(SaslResponse{"Authenticated"})
+	}
+	return nil
+}
+
+// serveTextAuth handles the text protocol's auth, the first command of a
+// session requiring auth: a set of any key whose data block is
+// "<username> <password>". Any other command is refused.
+func (t *TextSession) serveTextAuth(cmd *Command) error {
+	set := cmd.storageCommand
+	if cmd.binary || set == nil || set.Typ != SetCommand {
+		return unauthenticated
+	}
+	creds := strings.Fields(string(set.DataBlock))
+	if len(creds) != 2 || !t.auth.Authenticate(creds[0], creds[1]) {
+		return authFailure
+	}
+	t.authenticated = true
+	if set.NoReply {
+		return nil
+	}
+	return t.messageBuffer.Write(TextStoredResponse{})
+}
+
+// metaCodes maps the result of a meta operation to its response code.
+var metaCodes = map[store.MetaResult]string{
+	store.MetaOK:        "HD",
+	store.MetaNotStored: "NS",
+	store.MetaExists:    "EX",
+	store.MetaNotFound:  "NF",
+}
+
+// expiry returns the absolute store.Value expiry for a command's exptime as
+// of the engine's clock, so relative exptimes agree with the reaper.
+func (t *TextSession) expiry(expTime int32) int64 {
+	return expiry(expTime, t.engine.Clock().Now())
+}
+
+// metaFlags returns the return flags requested by the meta command for
+// the key, Value and ItemMeta, in the order requested. The time is in unix
+// seconds, as of the engine's clock.
+func metaFlags(m *MetaFlags, key string, v store.Value, meta store.ItemMeta, now int64) []string {
+	flags := []string{}
+	for _, f := range m.Returns {
+		switch f {
+		case 'c':
+			flags = append(flags, fmt.Sprintf("c%d", v.CasUnique))
+		case 'f':
+			flags = append(flags, fmt.Sprintf("f%d", v.Flags))
+		case 'h':
+			if meta.Fetched {
+				flags = append(flags, "h1")
+			} else {
+				flags = append(flags, "h0")
+			}
+		case 'k':
+			flags = append(flags, "k"+key)
+		case 'l':
+			flags = append(flags, fmt.Sprintf("l%d", now-meta.LastAccess))
+		case 'O':
+			flags = append(flags, "O"+m.Opaque)
+		case 's':
+			flags = append(flags, fmt.Sprintf("s%d", len(v.Bytes)))
+		case 't':
+			flags = append(flags, fmt.Sprintf("t%d", ttl(v, now)))
+		}
+	}
+	return flags
+}
+
+// ttl returns the seconds until the Value expires, or -1 if it never does.
+func ttl(v store.Value, now int64) int64 {
+	if v.Expiry == 0 {
+		return -1
+	}
+	return v.Expiry - now
+}
+
+// serveMetaGet handles the protocol logic for the 'mg' command
+func (t *TextSession) serveMetaGet(cmd *RetrievalCommand) error {
+	m, key := cmd.Meta, cmd.keys[0]
+	opts := store.MetaGetOptions{
+		Touch:        m.Touch,
+		Expiry:       t.expiry(m.ExpTime),
+		Vivify:       m.Vivify,
+		VivifyExpiry: t.expiry(m.VivifyExpTime),
+	}
+	if m.Recache {
+		opts.RecacheBelow = int64(m.RecacheTime)
+	}
+	value, meta, win, found := t.engine.MetaGet(key, opts)
+	if !found {
+		if m.Quiet {
+			return nil
+		}
+		return t.messageBuffer.Write(TextMetaResponse{code: "EN"})
+	}
+	flags := metaFlags(m, key, value, meta, t.engine.Clock().Now().Unix())
+	if win {
+		flags = append(flags, "W")
+	} else if meta.WinSent {
+		flags = append(flags, "Z")
+	}
+	if meta.Stale {
+		flags = append(flags, "X")
+	}
+	return t.messageBuffer.Write(TextMetaResponse{code: "HD", flags: flags, value: value.Bytes, withValue: m.Value})
+}
+
+// serveMetaSet handles the protocol logic for the 'ms' command
+func (t *TextSession) serveMetaSet(cmd *StorageCommand) error {
+	m := cmd.Meta
+	modes := map[byte]store.SetMode{
+		0:   store.SetModeSet,
+		'S': store.SetModeSet,
+		'E': store.SetModeAdd,
+		'R': store.SetModeReplace,
+		'A': store.SetModeAppend,
+		'P': store.SetModePrepend,
+	}
+	value := store.Value{Flags: cmd.Flags, Bytes: cmd.DataBlock, Expiry: t.expiry(cmd.ExpTime)}
+	cas, result := t.engine.MetaSet(cmd.Key, value, store.MetaSetOptions{
+		Mode:       modes[m.Mode],
+		CompareCas: m.CompareCas,
+		Invalidate: m.Invalidate,
+	})
+	if m.Quiet && result == store.MetaOK {
+		return nil
+	}
+	value.CasUnique = cas
+	return t.messageBuffer.Write(TextMetaResponse{code: metaCodes[result], flags: metaFlags(m, cmd.Key, value, store.ItemMeta{}, t.engine.Clock().Now().Unix())})
+}
+
+// serveMetaDelete handles the protocol logic for the 'md' command
+func (t *TextSession) serveMetaDelete(cmd *DeleteCommand) error {
+	m := cmd.Meta
+	result := t.engine.MetaDelete(cmd.Key, store.MetaDeleteOptions{
+		CompareCas: m.CompareCas,
+		Invalidate: m.Invalidate,
+		Touch:      m.Touch,
+		Expiry:     t.expiry(m.ExpTime),
+	})
+	if m.Quiet && (result == store.MetaOK || result == store.MetaNotFound) {
+		return nil
+	}
+	return t.messageBuffer.Write(TextMetaResponse{code: metaCodes[result], flags: metaFlags(m, cmd.Key, store.Value{}, store.ItemMeta{}, t.engine.Clock().Now().Unix())})
+}
+
+// serveMetaArithmetic handles the protocol logic for the 'ma' command
+func (t *TextSession) serveMetaArithmetic(cmd *ArithmeticCommand) error {
+	m := cmd.Meta
+	value, result, err := t.engine.MetaArithmetic(cmd.Key, store.MetaArithmeticOptions{
+		Incr:         m.Mode != 'D',
+		Delta:        cmd.Delta,
+		Vivify:       m.Vivify,
+		Initial:      m.Initial,
+		VivifyExpiry: t.expiry(m.VivifyExpTime),
+		CompareCas:   m.CompareCas,
+		Touch:        m.Touch,
+		Expiry:       t.expiry(m.ExpTime),
+	})
+	if err == store.ErrNotNumeric {
+		return NewClientErrorResponse(err.Error())
+	} else if err != nil {
+		return NewServerErrorResponse(err.Error())
+	}
+	if m.Quiet && (result == store.MetaNotFound || result == store.MetaOK && !m.Value) {
+		return nil
+	}
+	return t.messageBuffer.Write(TextMetaResponse{
+		code:      metaCodes[result],
+		flags:     metaFlags(m, cmd.Key, value, store.ItemMeta{}, t.engine.Clock().Now().Unix()),
+		value:     value.Bytes,
+		withValue: m.Value && result == store.MetaOK,
+	})
+}
+
+// serveMetaDebug handles the protocol logic for the 'me' command
+func (t *TextSession) serveMetaDebug(cmd *RetrievalCommand) error {
+	key := cmd.keys[0]
+	value, meta, found := t.engine.MetaDebug(key)
+	if !found {
+		return t.messageBuffer.Write(TextMetaResponse{code: "EN"})
+	}
+	fetch := "no"
+	if meta.Fetched {
+		fetch = "yes"
+	}
+	now := t.engine.Clock().Now().Unix()
+	return t.messageBuffer.Write(TextMetaResponse{code: "ME " + key, flags: []string{
+		fmt.Sprintf("exp=%d", ttl(value, now)),
+		fmt.Sprintf("la=%d", now-meta.LastAccess),
+		fmt.Sprintf("cas=%d", value.CasUnique),
+		"fetch=" + fetch,
+		"cls=1",
+		fmt.Sprintf("size=%d", len(key)+len(value.Bytes)),
+	}})
+}
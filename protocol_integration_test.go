@@ -2,19 +2,55 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"github.com/tshprecher/mcache/protocol"
 	"github.com/tshprecher/mcache/store"
+	"io"
 	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
 
+// A testClock is a store.Clock whose time only moves when advanced, so that
+// expiry can be tested without sleeping.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
 func TestIntegrationProtocol(t *testing.T) {
 	se := store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
 	server := &Server{
 		port:       11209,
 		se:         se,
-		lis:        nil,
 		maxValSize: 1024,
 		timeout:    2,
 		mu:         sync.Mutex{}}
@@ -28,6 +64,675 @@ func TestIntegrationProtocol(t *testing.T) {
 
 	*se = *store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
 	testProtoCas(t)
+
+	*se = *store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	testProtoAddAndReplace(t)
+
+	*se = *store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	testProtoAppendAndPrepend(t)
+
+	clock := &testClock{now: time.Now()}
+	*se = *store.NewSimpleStorageEngineWithClock(store.NewLruEvictionPolicy(1024), clock)
+	testProtoExpiration(t, clock)
+
+	*se = *store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	testProtoIncrAndDecr(t)
+
+	*se = *store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	testProtoTouchAndGat(t)
+
+	*se = *store.NewSimpleStorageEngineWithClock(store.NewLruEvictionPolicy(1024), clock)
+	testProtoFlushAll(t, clock)
+
+	*se = *store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	testProtoStats(t)
+
+	testProtoAdmin(t)
+
+	*se = *store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	testProtoBinary(t)
+
+	*se = *store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	testProtoMeta(t)
+}
+
+func TestIntegrationShutdown(t *testing.T) {
+	se := store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	server := &Server{
+		port:           11208,
+		se:             se,
+		maxValSize:     1024,
+		timeout:        2,
+		enableShutdown: true,
+		mu:             sync.Mutex{}}
+	stopped := make(chan struct{})
+	go func() {
+		server.Start()
+		server.Wait()
+		close(stopped)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:11208")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer idle.Close()
+	conn, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+
+	testMessages(t, conn,
+		[]string{
+			"set key 3 0 1\r\n1\r\n",
+			"shutdown\r\n",
+		},
+		[]string{
+			"STORED\r\n",
+		},
+	)
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected server to stop after shutdown")
+	}
+	for _, c := range []net.Conn{idle, conn} {
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("expected drained session to be closed, received %v", err)
+		}
+	}
+	if _, err := net.DialTCP("tcp", nil, tcpAddr); err == nil {
+		t.Errorf("expected stopped server to refuse connections")
+	}
+}
+
+func TestIntegrationSlowClient(t *testing.T) {
+	se := store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024 * 1024))
+	server := &Server{
+		port:         11207,
+		se:           se,
+		maxValSize:   1024 * 1024,
+		timeout:      10,
+		writeTimeout: 1,
+		mu:           sync.Mutex{}}
+	go server.Start()
+	defer server.Stop()
+	time.Sleep(500 * time.Millisecond)
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:11207")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+
+	// pipeline far more responses than the socket buffers hold without ever
+	// reading them, so the server's writes block
+	value := strings.Repeat("x", 64*1024)
+	go func() {
+		conn.Write([]byte("set key 0 0 65536\r\n" + value + "\r\n"))
+		for i := 0; i < 1000; i++ {
+			if _, err := conn.Write([]byte("get key\r\n")); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		server.mu.Lock()
+		closed := server.totalConns == 1 && len(server.sessions) == 0
+		server.mu.Unlock()
+		if closed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the server to close the slow client")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestIntegrationDrain(t *testing.T) {
+	se := store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024 * 1024))
+	server := &Server{
+		port:       11204,
+		se:         se,
+		maxValSize: 1024 * 1024,
+		timeout:    10,
+		mu:         sync.Mutex{}}
+	started := make(chan struct{})
+	go func() {
+		server.Start()
+		close(started)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:11204")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer idle.Close()
+	conn, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+	testMessages(t, conn, []string{"set key 0 0 1\r\n1\r\n"}, []string{"STORED\r\n"})
+
+	// a session stuck writing to a client that does not read is closed once
+	// the drain timeout passes
+	slow, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer slow.Close()
+	value := strings.Repeat("x", 64*1024)
+	go func() {
+		slow.Write([]byte("set big 0 0 65536\r\n" + value + "\r\n"))
+		for i := 0; i < 1000; i++ {
+			if _, err := slow.Write([]byte("get big\r\n")); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	begin := time.Now()
+	if err := server.Drain(time.Second); err == nil {
+		t.Errorf("expected the slow session to outlast the drain timeout")
+	}
+	if elapsed := time.Since(begin); elapsed < time.Second || elapsed > 2*time.Second {
+		t.Errorf("expected drain to wait for the timeout, waited %v", elapsed)
+	}
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Errorf("expected the server to stop accepting connections")
+	}
+	server.Wait()
+	for _, c := range []net.Conn{idle, conn} {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("expected drained session to be closed, received %v", err)
+		}
+	}
+}
+
+// A drainingReader drains the session as a command is read off the wire.
+type drainingReader struct {
+	r       io.Reader
+	session *protocol.TextSession
+}
+
+func (d *drainingReader) Read(p []byte) (int, error) {
+	d.session.Drain()
+	return d.r.Read(p)
+}
+
+func TestDrainServesReadCommand(t *testing.T) {
+	se := store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	se.Set("key", store.Value{Bytes: []byte("1")})
+	client, conn := net.Pipe()
+	defer client.Close()
+	wireIn := &drainingReader{r: strings.NewReader("get key\r\n")}
+	session := protocol.NewSessionFromReader(conn, wireIn, se, &Server{se: se}, 0, 0, 0)
+	wireIn.session = session
+	replies := make(chan string)
+	go func() {
+		reply, _ := io.ReadAll(client)
+		replies <- string(reply)
+	}()
+
+	// the get read as the drain begins is answered before the session closes
+	if err := session.Serve(); err != nil {
+		t.Errorf("expected the get to be served, received %v", err)
+	}
+	if reply := <-replies; reply != "VALUE key 0 1\r\n1\r\nEND\r\n" {
+		t.Errorf("expected the value of key, received %q", reply)
+	}
+	if session.Alive() {
+		t.Errorf("expected the drained session to be closed")
+	}
+}
+
+func TestIntegrationMaxConns(t *testing.T) {
+	se := store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	server := &Server{
+		port:          11203,
+		se:            se,
+		maxValSize:    1024,
+		timeout:       10,
+		maxConns:      3,
+		reservedConns: 1,
+		mu:            sync.Mutex{}}
+	go server.Start()
+	defer server.Stop()
+	time.Sleep(500 * time.Millisecond)
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:11203")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectClosed := func(conn net.Conn) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("expected the connection to be closed, received %v", err)
+		}
+	}
+	first, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer first.Close()
+	testMessages(t, first, []string{"set key 0 0 1\r\n1\r\n"}, []string{"STORED\r\n"})
+	second, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer second.Close()
+	testMessages(t, second, []string{"get key\r\n"}, []string{"VALUE key 0 1\r\n", "1\r\n", "END\r\n"})
+
+	// the last connection is reserved for admin and stats commands
+	admin, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer admin.Close()
+	testMessages(t, admin,
+		[]string{"version\r\n", "get key\r\n"},
+		[]string{"VERSION " + protocol.Version + "\r\n", "SERVER_ERROR too many open connections\r\n"})
+	expectClosed(admin)
+	for open := 3; open > 2; time.Sleep(10 * time.Millisecond) {
+		server.mu.Lock()
+		open = len(server.sessions)
+		server.mu.Unlock()
+	}
+	admin, _ = net.DialTCP("tcp", nil, tcpAddr)
+	defer admin.Close()
+	testMessages(t, admin, []string{"verbosity 0\r\n"}, []string{"OK\r\n"})
+
+	// connections beyond the limit are rejected
+	over, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer over.Close()
+	testMessages(t, over, []string{}, []string{"SERVER_ERROR too many open connections\r\n"})
+	expectClosed(over)
+
+	stats := readStats(t, admin, "stats\r\n")
+	expectResponse(t, "3", stats["curr_connections"])
+	expectResponse(t, "2", stats["rejected_connections"])
+}
+
+func TestAdmitConcurrently(t *testing.T) {
+	server := &Server{maxConns: 3, reservedConns: 1}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	admitted, reserved := 0, 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, res := server.admit()
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				admitted++
+			}
+			if res {
+				reserved++
+			}
+		}()
+	}
+	wg.Wait()
+	if admitted != 3 || reserved != 1 || server.rejectedConns != 7 {
+		t.Errorf("expected 3 admitted, 1 reserved and 7 rejected, received %d, %d and %d", admitted, reserved, server.rejectedConns)
+	}
+
+	// a released slot can be admitted again
+	server.release()
+	if ok, res := server.admit(); !ok || !res {
+		t.Errorf("expected the released slot to be admitted as reserved")
+	}
+}
+
+func TestIntegrationListen(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "mcache.sock")
+	se := store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	server := &Server{
+		port:        11202,
+		listen:      []string{"localhost:11202", "unix:" + sock},
+		socketPerms: 0600,
+		se:          se,
+		maxValSize:  1024,
+		timeout:     10,
+		mu:          sync.Mutex{}}
+	stopped := make(chan struct{})
+	go func() {
+		server.Start()
+		close(stopped)
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected socket permissions 0600, received %04o", fi.Mode().Perm())
+	}
+
+	// both listeners serve the same storage engine
+	tcp, err := net.Dial("tcp", "localhost:11202")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	unix, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close()
+	testMessages(t, tcp, []string{"set key 0 0 1\r\n1\r\n"}, []string{"STORED\r\n"})
+	testMessages(t, unix, []string{"get key\r\n"}, []string{"VALUE key 0 1\r\n", "1\r\n", "END\r\n"})
+	stats := readStats(t, unix, "stats\r\n")
+	expectResponse(t, "2", stats["curr_connections"])
+	stats = readStats(t, unix, "stats settings\r\n")
+	expectResponse(t, "localhost:11202,unix:"+sock, stats["listen"])
+	expectResponse(t, "0600", stats["socket_perms"])
+	readStats(t, unix, "stats conns\r\n")
+
+	server.Stop()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected the server to stop listening")
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, received %v", err)
+	}
+}
+
+func TestUDPAddrs(t *testing.T) {
+	server := &Server{
+		port:    11211,
+		udpPort: 11212,
+		listen:  []string{"127.0.0.1:11211", "tls:127.0.0.1:11213", "unix:/tmp/mcache.sock", "[::1]:11211"},
+	}
+	expected := []string{"127.0.0.1:11212", "[::1]:11212"}
+	if addrs := server.udpAddrs(); !reflect.DeepEqual(expected, addrs) {
+		t.Errorf("expected udp addresses %v, received %v", expected, addrs)
+	}
+	server.listen = nil
+	if addrs := server.udpAddrs(); !reflect.DeepEqual([]string{":11212"}, addrs) {
+		t.Errorf("expected udp on every interface, received %v", addrs)
+	}
+}
+
+func TestIntegrationUDP(t *testing.T) {
+	se := store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(64 * 1024))
+	server := &Server{
+		port:       11201,
+		udpPort:    11201,
+		se:         se,
+		maxValSize: 8 * 1024,
+		timeout:    10,
+		mu:         sync.Mutex{}}
+	go server.Start()
+	defer server.Stop()
+	time.Sleep(500 * time.Millisecond)
+
+	conn, err := net.Dial("udp", "localhost:11201")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := func(id, seq, total uint16, commands string) string {
+		frame := make([]byte, 8, 8+len(commands))
+		binary.BigEndian.PutUint16(frame[0:2], id)
+		binary.BigEndian.PutUint16(frame[2:4], seq)
+		binary.BigEndian.PutUint16(frame[4:6], total)
+		conn.Write(append(frame, commands...))
+
+		// reassemble the response, checking every frame header
+		chunks := map[uint16]string{}
+		buf := make([]byte, 2048)
+		for expected := 1; len(chunks) < expected; {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("expected a response datagram, received %v", err)
+			}
+			if n > 1400 {
+				t.Errorf("expected datagrams of at most 1400 bytes, received %d", n)
+			}
+			if rid := binary.BigEndian.Uint16(buf[0:2]); rid != id {
+				t.Errorf("expected request id %d, received %d", id, rid)
+			}
+			expected = int(binary.BigEndian.Uint16(buf[4:6]))
+			chunks[binary.BigEndian.Uint16(buf[2:4])] = string(buf[8:n])
+		}
+		resp := ""
+		for seq := 0; seq < len(chunks); seq++ {
+			chunk, ok := chunks[uint16(seq)]
+			if !ok {
+				t.Errorf("expected a datagram with sequence number %d", seq)
+			}
+			resp += chunk
+		}
+		return resp
+	}
+
+	expectResponse(t, "STORED\r\n", request(1, 0, 1, "set key 0 0 1\r\n1\r\n"))
+	expectResponse(t, "VALUE key 0 1\r\n1\r\nEND\r\n2\r\n", request(2, 0, 1, "get key\r\nincr key 1\r\n"))
+
+	// a large value is split across datagrams
+	value := strings.Repeat("0123456789", 500)
+	expectResponse(t, "STORED\r\n", request(3, 0, 1, "set big 0 0 5000\r\n"+value+"\r\n"))
+	expectResponse(t, "VALUE big 0 5000\r\n"+value+"\r\nEND\r\n", request(4, 0, 1, "get big\r\n"))
+
+	expectResponse(t, "SERVER_ERROR multi-packet request not supported\r\n", request(5, 0, 2, "get key\r\n"))
+	expectResponse(t, "ERROR\r\n", request(6, 0, 1, "bogus\r\nget key\r\n"))
+}
+
+func TestIntegrationAuth(t *testing.T) {
+	if err := (&Server{port: 11199, requireAuth: true}).Start(); err == nil {
+		t.Errorf("expected requiring auth without a password file to fail")
+	}
+
+	passwords := filepath.Join(t.TempDir(), "passwords")
+	if err := os.WriteFile(passwords, []byte("# users\nalice:secret\n\nbob:hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	se := store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	server := &Server{
+		port:        11199,
+		authFile:    passwords,
+		requireAuth: true,
+		se:          se,
+		maxValSize:  1024,
+		timeout:     10,
+		mu:          sync.Mutex{}}
+	go server.Start()
+	defer server.Stop()
+	time.Sleep(500 * time.Millisecond)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", "localhost:11199")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	expectClosed := func(conn net.Conn) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("expected the connection to be closed, received %v", err)
+		}
+		conn.Close()
+	}
+
+	// the text protocol authenticates with a set carrying the credentials,
+	// and refuses every other command until then
+	for _, req := range []string{"get key\r\n", "stats\r\n"} {
+		conn := dial()
+		testMessages(t, conn, []string{req}, []string{"CLIENT_ERROR unauthenticated\r\n"})
+		expectClosed(conn)
+	}
+	conn := dial()
+	testMessages(t, conn, []string{"set auth 0 0 9\r\nalice bad\r\n"}, []string{"CLIENT_ERROR authentication failure\r\n"})
+	expectClosed(conn)
+	text := dial()
+	defer text.Close()
+	testMessages(t, text,
+		[]string{"set auth 0 0 12\r\nalice secret\r\n", "set key 0 0 1\r\n1\r\n", "get auth key\r\n"},
+		[]string{"STORED\r\n", "STORED\r\n", "VALUE key 0 1\r\n", "1\r\n", "END\r\n"})
+
+	// the binary protocol authenticates with SASL PLAIN
+	testBinary := func(conn net.Conn, requests, responses [][]byte) {
+		for _, r := range requests {
+			conn.Write(r)
+		}
+		buf := bufio.NewReader(conn)
+		for _, exp := range responses {
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			rec := make([]byte, len(exp))
+			if _, err := io.ReadFull(buf, rec); err != nil {
+				t.Fatalf("expected response %v, received %v", exp, err)
+			}
+			if !bytes.Equal(exp, rec) {
+				t.Errorf("expected response %v, received %v", exp, rec)
+			}
+		}
+	}
+	conn = dial()
+	testBinary(conn,
+		[][]byte{binaryPacket(0x80, 0x01, 0, 0, make([]byte, 8), []byte("key"), []byte("bob hunter2"))},
+		[][]byte{binaryPacket(0x81, 0x01, 0x20, 0, nil, nil, []byte("unauthenticated"))})
+	expectClosed(conn)
+	// a failed auth leaves the connection open for the client to retry
+	bin := dial()
+	defer bin.Close()
+	testBinary(bin,
+		[][]byte{
+			binaryPacket(0x80, 0x21, 0, 0, nil, []byte("PLAIN"), []byte("\x00bob\x00secret")),
+			binaryPacket(0x80, 0x20, 0, 0, nil, nil, nil),
+			binaryPacket(0x80, 0x21, 0, 0, nil, []byte("PLAIN"), []byte("\x00bob\x00hunter2")),
+			binaryPacket(0x80, 0x00, 0, 0, nil, []byte("key"), nil),
+		},
+		[][]byte{
+			binaryPacket(0x81, 0x21, 0x20, 0, nil, nil, []byte("authentication failure")),
+			binaryPacket(0x81, 0x20, 0, 0, nil, nil, []byte("PLAIN")),
+			binaryPacket(0x81, 0x21, 0, 0, nil, nil, []byte("Authenticated")),
+			binaryPacket(0x81, 0x00, 0, 1, []byte{0, 0, 0, 0}, nil, []byte("1")),
+		})
+
+	stats := readStats(t, text, "stats\r\n")
+	expectResponse(t, "4", stats["auth_cmds"])
+	expectResponse(t, "2", stats["auth_errors"])
+	stats = readStats(t, text, "stats settings\r\n")
+	expectResponse(t, "yes", stats["auth_enabled_sasl"])
+	expectResponse(t, "yes", stats["auth_required"])
+}
+
+// idleClientsAddrEnv and idleClientsCountEnv name the environment variables
+// holding the server address and number of connections when the test binary
+// is run as the idle clients helper process.
+const (
+	idleClientsAddrEnv  = "MCACHE_IDLE_CLIENTS_ADDR"
+	idleClientsCountEnv = "MCACHE_IDLE_CLIENTS_COUNT"
+)
+
+func TestIntegrationIdleTimeout(t *testing.T) {
+	se := store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	server := &Server{
+		port:       11206,
+		se:         se,
+		maxValSize: 1024,
+		timeout:    5,
+		mu:         sync.Mutex{}}
+	go server.Start()
+	defer server.Stop()
+	time.Sleep(500 * time.Millisecond)
+
+	testIdleSessions(t, server, 10000, 0)
+}
+
+// testIdleSessions opens idle connections to the running server, checking
+// that they use close to no CPU, that they are closed once the server's
+// timeout passes, and, if maxGoroutines > 0, that serving them takes at most
+// that many goroutines.
+func testIdleSessions(t *testing.T, server *Server, conns, maxGoroutines int) {
+	timeout := time.Duration(server.timeout) * time.Second
+
+	// the clients run in a helper process so that neither process needs a
+	// file descriptor per connection for both ends
+	helper := exec.Command(os.Args[0], "-test.run=^TestIdleClientsHelper$")
+	helper.Env = append(os.Environ(), fmt.Sprintf("%s=localhost:%d", idleClientsAddrEnv, server.port), fmt.Sprintf("%s=%d", idleClientsCountEnv, conns))
+	helper.Stderr = os.Stderr
+	out, err := helper.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	if err := helper.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer helper.Process.Kill()
+	lines := bufio.NewScanner(out)
+	for lines.Scan() && lines.Text() != "ready" {
+	}
+	openSessions := func() int {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.sessions)
+	}
+	for time.Since(started) < time.Second && openSessions() < conns {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// idle sessions should wait on the network without burning CPU
+	cpu := func() time.Duration {
+		var ru syscall.Rusage
+		syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+		return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+	}
+	before := cpu()
+	time.Sleep(2 * time.Second)
+	used := cpu() - before
+	t.Logf("%d idle sessions used %v of CPU in 2s", conns, used)
+	if used > 200*time.Millisecond {
+		t.Errorf("expected idle sessions to use close to no CPU, used %v in 2s", used)
+	}
+	if open := openSessions(); open != conns {
+		t.Errorf("expected %d sessions open before the timeout, found %d", conns, open)
+	}
+	if n := runtime.NumGoroutine(); maxGoroutines > 0 && n > maxGoroutines {
+		t.Errorf("expected at most %d goroutines serving %d idle sessions, found %d", maxGoroutines, conns, n)
+	}
+
+	// every session is closed once the timeout passes
+	for openSessions() > 0 {
+		if time.Since(started) > timeout+3*time.Second {
+			t.Fatalf("expected idle sessions to be closed after %v, %d still open", timeout, openSessions())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := helper.Wait(); err != nil {
+		t.Errorf("expected the server to close every idle client: %v", err)
+	}
+}
+
+// TestIdleClientsHelper opens idle connections for TestIntegrationIdleTimeout
+// and waits for the server to close them. It only runs as a helper process.
+func TestIdleClientsHelper(t *testing.T) {
+	addr := os.Getenv(idleClientsAddrEnv)
+	if addr == "" {
+		t.Skip("only runs as a helper process")
+	}
+	n, _ := strconv.Atoi(os.Getenv(idleClientsCountEnv))
+	conns := make([]net.Conn, n)
+	for i := range conns {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+	}
+	fmt.Println("ready")
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected the server to close the connection, received %v", err)
+		}
+	}
 }
 
 func expectResponse(t *testing.T, exp string, rec string) {
@@ -182,3 +887,517 @@ func testProtoCas(t *testing.T) {
 		},
 	)
 }
+
+func testProtoAddAndReplace(t *testing.T) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:11209")
+	if err != nil {
+		t.Error(err)
+	}
+	conn, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+
+	testMessages(t, conn,
+		[]string{
+			"replace key 3 0 1\r\n1\r\n",
+			"add key 3 0 1\r\n1\r\n",
+			"add key 4 0 1\r\n2\r\n",
+			"add key 4 0 1 noreply\r\n2\r\n",
+			"gets key\r\n",
+
+			"replace key 5 0 1\r\n3\r\n",
+			"replace key2 5 0 1 noreply\r\n3\r\n",
+			"gets key key2\r\n",
+		},
+		[]string{
+			"NOT_STORED\r\n",
+			"STORED\r\n",
+			"NOT_STORED\r\n",
+
+			"VALUE key 3 1 1\r\n",
+			"1\r\n",
+			"END\r\n",
+
+			"STORED\r\n",
+
+			"VALUE key 5 1 2\r\n",
+			"3\r\n",
+			"END\r\n",
+		},
+	)
+}
+
+func testProtoAppendAndPrepend(t *testing.T) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:11209")
+	if err != nil {
+		t.Error(err)
+	}
+	conn, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+
+	testMessages(t, conn,
+		[]string{
+			"append key 3 0 1\r\n1\r\n",
+			"prepend key 3 0 1\r\n1\r\n",
+			"set key 3 0 1\r\n1\r\n",
+			"append key 4 0 2\r\n23\r\n",
+			"prepend key 5 0 2 noreply\r\nab\r\n",
+			"gets key\r\n",
+		},
+		[]string{
+			"NOT_STORED\r\n",
+			"NOT_STORED\r\n",
+			"STORED\r\n",
+			"STORED\r\n",
+
+			"VALUE key 3 5 3\r\n",
+			"ab123\r\n",
+			"END\r\n",
+		},
+	)
+}
+
+func testProtoExpiration(t *testing.T, clock *testClock) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:11209")
+	if err != nil {
+		t.Error(err)
+	}
+	conn, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+
+	testMessages(t, conn,
+		[]string{
+			"set key 3 -1 1\r\n1\r\n",
+			"set key2 3 1000 1\r\n2\r\n",
+			"set key3 3 2592001 1\r\n3\r\n",
+			"set key4 3 2 1\r\n4\r\n",
+			"get key key2 key3 key4\r\n",
+		},
+		[]string{
+			"STORED\r\n",
+			"STORED\r\n",
+			"STORED\r\n",
+			"STORED\r\n",
+
+			"VALUE key2 3 1\r\n",
+			"2\r\n",
+			"VALUE key4 3 1\r\n",
+			"4\r\n",
+			"END\r\n",
+		},
+	)
+
+	// key4 expires after two seconds
+	clock.advance(2 * time.Second)
+	testMessages(t, conn,
+		[]string{
+			"get key2 key4\r\n",
+			"delete key4\r\n",
+		},
+		[]string{
+			"VALUE key2 3 1\r\n",
+			"2\r\n",
+			"END\r\n",
+			"NOT_FOUND\r\n",
+		},
+	)
+}
+
+func testProtoIncrAndDecr(t *testing.T) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:11209")
+	if err != nil {
+		t.Error(err)
+	}
+	conn, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+
+	testMessages(t, conn,
+		[]string{
+			"incr key 1\r\n",
+			"set key 3 0 2\r\n10\r\n",
+			"incr key 5\r\n",
+			"decr key 100\r\n",
+			"incr key 7 noreply\r\n",
+			"gets key\r\n",
+			"set key2 3 0 1\r\na\r\n",
+			"incr key2 1\r\n",
+		},
+		[]string{
+			"NOT_FOUND\r\n",
+			"STORED\r\n",
+			"15\r\n",
+			"0\r\n",
+
+			"VALUE key 3 1 4\r\n",
+			"7\r\n",
+			"END\r\n",
+
+			"STORED\r\n",
+			"CLIENT_ERROR cannot increment or decrement non-numeric value\r\n",
+		},
+	)
+}
+
+func testProtoTouchAndGat(t *testing.T) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:11209")
+	if err != nil {
+		t.Error(err)
+	}
+	conn, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+
+	testMessages(t, conn,
+		[]string{
+			"touch key 10\r\n",
+			"set key 3 0 1\r\n1\r\n",
+			"set key2 3 0 1\r\n2\r\n",
+			"touch key 10\r\n",
+			"touch key2 -1 noreply\r\n",
+			"gat 0 key key2\r\n",
+			"gats -1 key\r\n",
+			"get key\r\n",
+		},
+		[]string{
+			"NOT_FOUND\r\n",
+			"STORED\r\n",
+			"STORED\r\n",
+			"TOUCHED\r\n",
+
+			"VALUE key 3 1\r\n",
+			"1\r\n",
+			"END\r\n",
+
+			"VALUE key 3 1 1\r\n",
+			"1\r\n",
+			"END\r\n",
+
+			"END\r\n",
+		},
+	)
+}
+
+func testProtoFlushAll(t *testing.T, clock *testClock) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:11209")
+	if err != nil {
+		t.Error(err)
+	}
+	conn, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+
+	testMessages(t, conn,
+		[]string{
+			"set key 3 0 1\r\n1\r\n",
+			"flush_all\r\n",
+			"get key\r\n",
+			"set key 3 0 1\r\n1\r\n",
+			"flush_all 2 noreply\r\n",
+			"get key\r\n",
+		},
+		[]string{
+			"STORED\r\n",
+			"OK\r\n",
+			"END\r\n",
+			"STORED\r\n",
+
+			"VALUE key 3 1\r\n",
+			"1\r\n",
+			"END\r\n",
+		},
+	)
+
+	// the delayed flush invalidates key but not key2 stored afterwards
+	clock.advance(2 * time.Second)
+	testMessages(t, conn,
+		[]string{
+			"set key2 3 0 1\r\n2\r\n",
+			"get key key2\r\n",
+		},
+		[]string{
+			"STORED\r\n",
+			"VALUE key2 3 1\r\n",
+			"2\r\n",
+			"END\r\n",
+		},
+	)
+}
+
+// readStats sends the stats command and returns the received stats by name.
+func readStats(t *testing.T, conn net.Conn, command string) map[string]string {
+	buf := bufio.NewReader(conn)
+	conn.Write([]byte(command))
+	stats := map[string]string{}
+	for {
+		line, err := buf.ReadString('\n')
+		if err != nil {
+			t.Errorf("expected stats, received %v", err)
+			return stats
+		}
+		if line == "END\r\n" {
+			return stats
+		}
+		terms := strings.Split(strings.TrimSuffix(line, "\r\n"), " ")
+		if len(terms) != 3 || terms[0] != "STAT" {
+			t.Errorf("expected 'STAT <name> <value>' line, received %#v", line)
+			return stats
+		}
+		stats[terms[1]] = terms[2]
+	}
+}
+
+func testProtoStats(t *testing.T) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:11209")
+	if err != nil {
+		t.Error(err)
+	}
+	conn, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+
+	testMessages(t, conn,
+		[]string{
+			"set key 3 0 1\r\n1\r\n",
+			"get key key2\r\n",
+		},
+		[]string{
+			"STORED\r\n",
+			"VALUE key 3 1\r\n",
+			"1\r\n",
+			"END\r\n",
+		},
+	)
+
+	expected := map[string]string{
+		"version":        "0.1.0",
+		"cmd_get":        "2",
+		"get_hits":       "1",
+		"get_misses":     "1",
+		"cmd_set":        "1",
+		"curr_items":     "1",
+		"bytes":          "14",
+		"limit_maxbytes": "1024",
+		"evictions":      "0",
+	}
+	stats := readStats(t, conn, "stats\r\n")
+	for name, value := range expected {
+		expectResponse(t, value, stats[name])
+	}
+	for _, name := range []string{"pid", "uptime", "time", "curr_connections", "total_connections"} {
+		if _, ok := stats[name]; !ok {
+			t.Errorf("expected stat %s", name)
+		}
+	}
+	// the LRU policy neither adapts nor declines to admit keys
+	for _, name := range []string{"arc_p", "not_admitted"} {
+		if _, ok := stats[name]; ok {
+			t.Errorf("expected no stat %s", name)
+		}
+	}
+
+	stats = readStats(t, conn, "stats items\r\n")
+	expectResponse(t, "1", stats["items:1:number"])
+	stats = readStats(t, conn, "stats slabs\r\n")
+	expectResponse(t, "14", stats["total_malloced"])
+	stats = readStats(t, conn, "stats sizes\r\n")
+	expectResponse(t, "1", stats["32"])
+	stats = readStats(t, conn, "stats settings\r\n")
+	expectResponse(t, "1024", stats["maxbytes"])
+	expectResponse(t, "11209", stats["tcpport"])
+	stats = readStats(t, conn, "stats conns\r\n")
+	found := false
+	for name, value := range stats {
+		if strings.HasSuffix(name, ":addr") && value == "tcp:"+conn.LocalAddr().String() {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected stats conns to report %s, received %v", conn.LocalAddr(), stats)
+	}
+
+	testMessages(t, conn,
+		[]string{
+			"stats nothing\r\n",
+		},
+		[]string{
+			"ERROR\r\n",
+		},
+	)
+}
+
+func testProtoAdmin(t *testing.T) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:11209")
+	if err != nil {
+		t.Error(err)
+	}
+	conn, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+
+	verbosity := flag.Lookup("v").Value.String()
+	defer flag.Lookup("v").Value.Set(verbosity)
+
+	testMessages(t, conn,
+		[]string{
+			"version\r\n",
+			"verbosity 2\r\n",
+			"verbosity 1 noreply\r\n",
+			"verbosity\r\n",
+			"shutdown\r\n",
+		},
+		[]string{
+			"VERSION 0.1.0\r\n",
+			"OK\r\n",
+			"CLIENT_ERROR verbosity must take exactly 2 or 3 terms\r\n",
+		},
+	)
+	expectResponse(t, "1", flag.Lookup("v").Value.String())
+
+	// a rejected shutdown closes the session like any other client error
+	conn, _ = net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+	testMessages(t, conn,
+		[]string{
+			"shutdown\r\n",
+		},
+		[]string{
+			"CLIENT_ERROR shutdown not enabled\r\n",
+		},
+	)
+
+	conn, _ = net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+	testMessages(t, conn,
+		[]string{
+			"quit\r\n",
+			"version\r\n",
+		},
+		[]string{},
+	)
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected quit to close the connection, received %v", err)
+	}
+}
+
+// binaryPacket encodes a binary protocol packet with the given header fields and body.
+func binaryPacket(magic, opcode byte, status uint16, cas uint64, extras, key, value []byte) []byte {
+	packet := make([]byte, 24)
+	packet[0] = magic
+	packet[1] = opcode
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(key)))
+	packet[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(packet[6:8], status)
+	binary.BigEndian.PutUint32(packet[8:12], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint64(packet[16:24], cas)
+	packet = append(packet, extras...)
+	packet = append(packet, key...)
+	return append(packet, value...)
+}
+
+func testProtoBinary(t *testing.T) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:11209")
+	if err != nil {
+		t.Error(err)
+	}
+	conn, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+
+	setExtras := []byte{0, 0, 0, 3, 0, 0, 0, 0}
+	incrExtras := make([]byte, 20)
+	binary.BigEndian.PutUint64(incrExtras[0:8], 2)
+	binary.BigEndian.PutUint64(incrExtras[8:16], 10)
+	counter := make([]byte, 8)
+
+	requests := [][]byte{
+		binaryPacket(0x80, 0x01, 0, 0, setExtras, []byte("key"), []byte("val")),
+		binaryPacket(0x80, 0x11, 0, 0, setExtras, []byte("key2"), []byte("val2")),
+		binaryPacket(0x80, 0x02, 0, 0, setExtras, []byte("key"), []byte("val")),
+		binaryPacket(0x80, 0x0c, 0, 0, nil, []byte("key"), nil),
+		binaryPacket(0x80, 0x09, 0, 0, nil, []byte("missing"), nil),
+		binaryPacket(0x80, 0x04, 0, 0, nil, []byte("key2"), nil),
+		binaryPacket(0x80, 0x00, 0, 0, nil, []byte("key2"), nil),
+		binaryPacket(0x80, 0x05, 0, 0, incrExtras, []byte("counter"), nil),
+		binaryPacket(0x80, 0x05, 0, 0, incrExtras, []byte("counter"), nil),
+		binaryPacket(0x80, 0x0b, 0, 0, nil, nil, nil),
+		binaryPacket(0x80, 0x0a, 0, 0, nil, nil, nil),
+	}
+	binary.BigEndian.PutUint64(counter, 10)
+	initial := append([]byte{}, counter...)
+	binary.BigEndian.PutUint64(counter, 12)
+	responses := [][]byte{
+		binaryPacket(0x81, 0x01, 0, 0, nil, nil, nil),
+		binaryPacket(0x81, 0x02, 2, 0, nil, nil, []byte("Data exists for key.")),
+		binaryPacket(0x81, 0x0c, 0, 1, []byte{0, 0, 0, 3}, []byte("key"), []byte("val")),
+		binaryPacket(0x81, 0x04, 0, 0, nil, nil, nil),
+		binaryPacket(0x81, 0x00, 1, 0, nil, nil, []byte("Not found")),
+		binaryPacket(0x81, 0x05, 0, 0, nil, nil, initial),
+		binaryPacket(0x81, 0x05, 0, 0, nil, nil, counter),
+		binaryPacket(0x81, 0x0b, 0, 0, nil, nil, []byte("0.1.0")),
+		binaryPacket(0x81, 0x0a, 0, 0, nil, nil, nil),
+	}
+	for _, r := range requests {
+		conn.Write(r)
+	}
+	// TODO: depending on time can be flaky
+	time.Sleep(500 * time.Millisecond)
+	buf := bufio.NewReader(conn)
+	for _, exp := range responses {
+		rec := make([]byte, len(exp))
+		if _, err := io.ReadFull(buf, rec); err != nil {
+			t.Errorf("expected response %v, received %v", exp, err)
+			return
+		}
+		if !bytes.Equal(exp, rec) {
+			t.Errorf("expected response %v, received %v", exp, rec)
+		}
+	}
+	if buf.Buffered() > 0 {
+		t.Errorf("unexpected %d response bytes", buf.Buffered())
+	}
+}
+
+func testProtoMeta(t *testing.T) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:11209")
+	if err != nil {
+		t.Error(err)
+	}
+	conn, _ := net.DialTCP("tcp", nil, tcpAddr)
+	defer conn.Close()
+
+	testMessages(t, conn,
+		[]string{
+			"mg key v\r\n",
+			"mg key q v\r\n",
+			"ms key 3 F5 c\r\nval\r\n",
+			"mg key v f k s t Oabc\r\n",
+			"ms key 4 MA q\r\n_end\r\n",
+			"ms key 1 ME\r\nx\r\n",
+			"mg key v\r\n",
+			"md key I\r\n",
+			"mg key c\r\n",
+			"mg key\r\n",
+			"ms key 3 C1 I\r\nold\r\n",
+			"md key q\r\n",
+			"md key\r\n",
+			"ma counter\r\n",
+			"ma counter N0 J10 v\r\n",
+			"ma counter MD D4 v t\r\n",
+			"mn\r\n",
+		},
+		[]string{
+			"EN\r\n",
+			"HD c1\r\n",
+			"VA 3 f5 kkey s3 t-1 Oabc\r\n",
+			"val\r\n",
+			"NS\r\n",
+			"VA 7\r\n",
+			"val_end\r\n",
+			"HD\r\n",
+			"HD c3 W X\r\n",
+			"HD Z X\r\n",
+			"HD\r\n",
+			"NF\r\n",
+			"NF\r\n",
+			"VA 2\r\n",
+			"10\r\n",
+			"VA 1 t-1\r\n",
+			"6\r\n",
+			"MN\r\n",
+		},
+	)
+}
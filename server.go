@@ -1,80 +1,567 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/tshprecher/mcache/protocol"
 	"github.com/tshprecher/mcache/store"
 	"io"
 	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
-// handleSession wraps a TextSession and polls TextSession.Serve().
-// If an error occurs, the session is promptly closed.
-func handleSession(session *protocol.TextSession) {
-	glog.Infof("session started: addr=%v", session.RemoteAddr())
+var (
+	_ protocol.Host          = &Server{}
+	_ protocol.Authenticator = &Server{}
+)
+
+// handleSession wraps a TextSession and calls TextSession.Serve() until
+// the session ends. If an error occurs, including the client closing the
+// connection or the session timing out, the session is promptly closed.
+func (s *Server) handleSession(session *protocol.TextSession) {
+	defer s.endSession(session)
 	for session.Alive() {
-		err := session.Serve()
-		if nerr, ok := err.(net.Error); ok {
-			if !nerr.Temporary() {
-				glog.Errorf("error serving: %v", nerr)
-				session.Close()
+		if err := session.Serve(); err != nil {
+			if err != io.EOF {
+				glog.Errorf("error serving: %v", err)
 			}
-		} else if err != nil && err != io.EOF {
-			glog.Errorf("error serving: %v", err)
 			session.Close()
 		}
 	}
+}
+
+// endSession unregisters a session once it has been closed.
+func (s *Server) endSession(session *protocol.TextSession) {
 	glog.Infof("session ended: addr=%v", session.RemoteAddr())
+	s.removeSession(session)
+	s.wg.Done()
 }
 
 type Server struct {
 	port       uint16
 	se         store.StorageEngine
-	lis        net.Listener
+	listeners  []net.Listener
 	maxValSize int
 	timeout    int
-	mu         sync.Mutex
+	// listen holds the addresses to listen on, each either host:port or
+	// unix:/path/to.sock, defaulting to every interface on port
+	listen []string
+	// socketPerms are the permissions of unix sockets
+	socketPerms os.FileMode
+	// udpPort is the port to serve the text protocol over udp on, unless 0,
+	// on the hosts of the tcp listen addresses
+	udpPort uint16
+	udp     []net.PacketConn
+	// tlsOpts configure the listeners on tls:host:port addresses, whose
+	// certificates are loaded by tlsConf
+	tlsOpts tlsOptions
+	tlsConf *tlsReloader
+	// authFile is a password file clients can authenticate against, and
+	// requireAuth refuses them any other command until they have
+	authFile    string
+	requireAuth bool
+	// writeTimeout is the time in seconds a client has to accept a response
+	writeTimeout int
+	// netMode is "goroutines" to serve each connection with its own
+	// goroutine, or "epoll" to serve connections with an event loop of
+	// pollers handing readable sessions to a pool of workers
+	netMode string
+	pollers int
+	workers int
+	// enableShutdown allows clients to stop the server with the shutdown command
+	enableShutdown bool
+	mu             sync.Mutex
+	wg             sync.WaitGroup
+
+	// maxConns limits the open connections, unless <= 0. The last
+	// reservedConns of them are restricted to admin and stats commands.
+	maxConns      int
+	reservedConns int
+
+	// connection tracking for stats, guarded by mu. openConns counts the
+	// connections admitted until their sessions end, including those not
+	// yet registered in sessions.
+	started       time.Time
+	sessions      map[*protocol.TextSession]struct{}
+	openConns     int
+	totalConns    uint64
+	rejectedConns uint64
+
+	// the users of authFile and auth stats, guarded by mu
+	passwords  map[string]string
+	authCmds   uint64
+	authErrors uint64
 }
 
-func (s *Server) setListener(l net.Listener) {
+// admit checks a new connection against the connection limit, reserving
+// its slot until release or removeSession. It returns false if the
+// connection must be rejected, and reserved is true if it only fits in the
+// headroom reserved for admin connections.
+func (s *Server) admit() (ok, reserved bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.lis = l
+	open := s.openConns
+	if s.maxConns > 0 && open >= s.maxConns {
+		s.rejectedConns++
+		return false, false
+	}
+	s.openConns++
+	return true, s.maxConns > 0 && open >= s.maxConns-s.reservedConns
 }
 
-// Start opens up a port to listen, wraps each client connection
-// inside a TextSession, and spins up a goroutine to serve that
-// session.
+// release frees the slot of an admitted connection whose session never
+// started.
+func (s *Server) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.openConns--
+}
+
+// reject tells the client there are too many open connections and closes
+// the connection. It is run in its own goroutine, so a client that does not
+// read cannot stall the accept loop.
+func reject(conn net.Conn) {
+	glog.Warningf("rejecting connection: addr=%v", conn.RemoteAddr())
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write(protocol.TooManyConnections.Bytes())
+	conn.Close()
+}
+
+// addSession registers a session before its goroutine starts. It returns
+// false if the server is shutting down and the session should be dropped.
+func (s *Server) addSession(session *protocol.TextSession) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listeners == nil {
+		return false
+	}
+	if s.sessions == nil {
+		s.sessions = map[*protocol.TextSession]struct{}{}
+	}
+	s.sessions[session] = struct{}{}
+	s.totalConns++
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) removeSession(session *protocol.TextSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, session)
+	s.openConns--
+	if session.Rejected() {
+		s.rejectedConns++
+	}
+}
+
+// addrs returns the addresses the server listens on.
+func (s *Server) addrs() []string {
+	if len(s.listen) == 0 {
+		return []string{fmt.Sprintf(":%d", s.port)}
+	}
+	return s.listen
+}
+
+// udpAddrs returns the addresses to serve udp on: udpPort on each host the
+// server listens on over tcp, unless udpPort is 0.
+func (s *Server) udpAddrs() (addrs []string) {
+	if s.udpPort == 0 {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, addr := range s.addrs() {
+		if strings.HasPrefix(addr, "unix:") {
+			continue
+		}
+		host, _, err := net.SplitHostPort(strings.TrimPrefix(addr, "tls:"))
+		if err != nil || seen[host] {
+			continue
+		}
+		seen[host] = true
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(s.udpPort))))
+	}
+	return
+}
+
+// listenOn listens on a host:port address, on a unix socket for an
+// address of the form unix:/path/to.sock, or with TLS for an address of the
+// form tls:host:port.
+func (s *Server) listenOn(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "tls:") {
+		l, err := net.Listen("tcp", strings.TrimPrefix(addr, "tls:"))
+		if err != nil {
+			return nil, err
+		}
+		return tls.NewListener(l, s.tlsConf.serverConfig()), nil
+	}
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	// remove a socket left behind by a server that did not stop cleanly
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, s.socketPerms); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Start listens on every address, wraps each client connection
+// inside a TextSession, and either spins up a goroutine to serve that
+// session or, in the epoll network mode, hands it to the event loop. It
+// returns once the server stops listening.
 func (s *Server) Start() error {
 	glog.Info("starting server...")
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
-	if err != nil {
-		return err
+	var loop *eventLoop
+	switch s.netMode {
+	case "", "goroutines":
+	case "epoll":
+		var err error
+		loop, err = newEventLoop(s.pollers, s.workers, time.Duration(s.timeout)*time.Second, s.endSession)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// stop the event loop once every session it serves has ended
+			go func() {
+				s.wg.Wait()
+				loop.close()
+			}()
+		}()
+	default:
+		return fmt.Errorf("unknown network mode '%s'", s.netMode)
 	}
-	s.setListener(listener)
-	for {
-		conn, err := s.lis.Accept()
+	if s.requireAuth && s.authFile == "" {
+		return errors.New("requiring auth needs a password file")
+	}
+	if s.authFile != "" {
+		passwords, err := loadPasswords(s.authFile)
 		if err != nil {
-			glog.Warningf(err.Error())
-			s.lis = nil
-			break
+			return err
+		}
+		s.mu.Lock()
+		s.passwords = passwords
+		s.mu.Unlock()
+	}
+	for _, addr := range s.addrs() {
+		if strings.HasPrefix(addr, "tls:") && s.tlsConf == nil {
+			conf, err := newTLSReloader(s.tlsOpts)
+			if err != nil {
+				return err
+			}
+			s.mu.Lock()
+			s.tlsConf = conf
+			s.mu.Unlock()
+		}
+	}
+	if s.udpPort != 0 && len(s.udpAddrs()) == 0 {
+		return errors.New("serving udp needs a host:port listen address")
+	}
+	var listeners []net.Listener
+	for _, addr := range s.addrs() {
+		listener, err := s.listenOn(addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		glog.Infof("listening on %s", addr)
+		listeners = append(listeners, listener)
+	}
+	var udp []net.PacketConn
+	for _, addr := range s.udpAddrs() {
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			for _, pc := range udp {
+				pc.Close()
+			}
+			return err
+		}
+		glog.Infof("listening on udp %s", addr)
+		udp = append(udp, pc)
+	}
+	s.mu.Lock()
+	s.listeners = listeners
+	s.udp = udp
+	s.started = time.Now()
+	s.mu.Unlock()
+	var accepting sync.WaitGroup
+	for i, listener := range listeners {
+		// TLS connections have no file descriptor to poll, so they are
+		// always served by a goroutine each
+		polled := loop
+		if strings.HasPrefix(s.addrs()[i], "tls:") {
+			polled = nil
 		}
-		go handleSession(protocol.NewTextSession(conn, s.se, s.maxValSize, s.timeout))
+		accepting.Add(1)
+		go func(listener net.Listener, loop *eventLoop) {
+			defer accepting.Done()
+			s.accept(listener, loop)
+		}(listener, polled)
+	}
+	// datagrams from every packet connection share the workers
+	udpWorkers := make(chan struct{}, udpMaxInFlight)
+	for _, pc := range udp {
+		accepting.Add(1)
+		go func(pc net.PacketConn) {
+			defer accepting.Done()
+			s.serveUDP(pc, udpWorkers)
+		}(pc)
 	}
+	accepting.Wait()
 	return nil
 }
 
+// accept serves the connections accepted by the listener until it is
+// closed.
+func (s *Server) accept(listener net.Listener, loop *eventLoop) {
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+			// e.g. out of file descriptors, so back off until sessions end
+			if backoff *= 2; backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff > time.Second {
+				backoff = time.Second
+			}
+			glog.Warningf("error accepting, retrying in %v: %v", backoff, err)
+			time.Sleep(backoff)
+			continue
+		} else if err != nil {
+			glog.Warning(err.Error())
+			break
+		}
+		backoff = 0
+		ok, reserved := s.admit()
+		if !ok {
+			go reject(conn)
+			continue
+		}
+		var session *protocol.TextSession
+		if loop != nil {
+			if session, err = loop.newSession(conn, s); err != nil {
+				glog.Errorf("error starting session: %v", err)
+				conn.Close()
+				s.release()
+				continue
+			}
+		} else {
+			session = protocol.NewSession(conn, s.se, s, s.maxValSize, s.timeout, s.writeTimeout)
+		}
+		if reserved {
+			session.RestrictToAdmin()
+		}
+		s.enableAuth(session)
+		if !s.addSession(session) {
+			session.Close()
+			s.release()
+			break
+		}
+		glog.Infof("session started: addr=%v", session.RemoteAddr())
+		if loop == nil {
+			go s.handleSession(session)
+		} else if err := loop.add(session, conn); err != nil {
+			glog.Errorf("error polling session: %v", err)
+			session.Close()
+			s.endSession(session)
+		}
+	}
+}
+
 // Stop stops the server from listening for new connections, but goroutines
 // serving existing connections will continue to run until those sessions
 // have ended.
 func (s *Server) Stop() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.lis == nil {
+	if s.listeners == nil {
 		return
 	}
 	glog.Info("stopping server...")
-	s.lis.Close()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = nil
+	for _, pc := range s.udp {
+		pc.Close()
+	}
+	s.udp = nil
+}
+
+// Shutdown stops the server and drains every open session, so each one
+// closes once its in-flight command has been answered. It does not wait
+// for the sessions to end; use Wait for that. It returns an error unless
+// the server was created with shutdown enabled.
+func (s *Server) Shutdown() error {
+	if !s.enableShutdown {
+		return errors.New("shutdown not enabled")
+	}
+	s.drainSessions()
+	return nil
+}
+
+// drainSessions stops accepting connections and drains every open session.
+func (s *Server) drainSessions() {
+	s.Stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	glog.Infof("draining %d sessions...", len(s.sessions))
+	for session := range s.sessions {
+		session.Drain()
+	}
+}
+
+// Drain stops the server gracefully: it stops accepting connections, lets
+// every session finish its in-flight command, closes idle sessions, and
+// waits up to timeout for the sessions to end. Sessions still open after
+// the timeout are closed, and an error reports how many.
+func (s *Server) Drain(timeout time.Duration) error {
+	s.drainSessions()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for session := range s.sessions {
+		session.Close()
+	}
+	return fmt.Errorf("closed %d sessions still open after draining for %v", len(s.sessions), timeout)
+}
+
+// Wait blocks until every session started by the server has ended.
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+// SetVerbosity sets the glog verbosity level, as set by the -v flag.
+func (s *Server) SetVerbosity(level int) error {
+	f := flag.Lookup("v")
+	if f == nil {
+		return errors.New("verbosity flag not registered")
+	}
+	return f.Value.Set(strconv.Itoa(level))
+}
+
+// ReloadTLS reads the certificates of the TLS listeners again, so new
+// connections use them. Established connections are unaffected.
+func (s *Server) ReloadTLS() error {
+	s.mu.Lock()
+	conf := s.tlsConf
+	s.mu.Unlock()
+	if conf == nil {
+		return errors.New("no tls listeners")
+	}
+	return conf.reload()
+}
+
+// Stats returns the general server statistics for the stats command.
+func (s *Server) Stats() []protocol.Stat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	return []protocol.Stat{
+		protocol.NewStat("pid", os.Getpid()),
+		protocol.NewStat("uptime", int64(now.Sub(s.started).Seconds())),
+		protocol.NewStat("time", now.Unix()),
+		protocol.NewStat("version", protocol.Version),
+		protocol.NewStat("pointer_size", strconv.IntSize),
+		protocol.NewStat("curr_connections", len(s.sessions)),
+		protocol.NewStat("total_connections", s.totalConns),
+		protocol.NewStat("rejected_connections", s.rejectedConns),
+		protocol.NewStat("auth_cmds", s.authCmds),
+		protocol.NewStat("auth_errors", s.authErrors),
+	}
+}
+
+// Settings returns the server configuration for the stats settings command.
+func (s *Server) Settings() []protocol.Stat {
+	shutdown := "no"
+	if s.enableShutdown {
+		shutdown = "yes"
+	}
+	netMode := s.netMode
+	if netMode == "" {
+		netMode = "goroutines"
+	}
+	tlsEnabled, authEnabled, authRequired := "no", "no", "no"
+	s.mu.Lock()
+	if s.tlsConf != nil {
+		tlsEnabled = "yes"
+	}
+	if s.passwords != nil {
+		authEnabled = "yes"
+	}
+	s.mu.Unlock()
+	if s.requireAuth {
+		authRequired = "yes"
+	}
+	return []protocol.Stat{
+		protocol.NewStat("maxbytes", s.se.Stats().LimitMaxbytes),
+		protocol.NewStat("tcpport", s.port),
+		protocol.NewStat("udpport", s.udpPort),
+		protocol.NewStat("listen", strings.Join(s.addrs(), ",")),
+		protocol.NewStat("socket_perms", fmt.Sprintf("%04o", s.socketPerms)),
+		protocol.NewStat("ssl_enabled", tlsEnabled),
+		protocol.NewStat("auth_enabled_sasl", authEnabled),
+		protocol.NewStat("auth_required", authRequired),
+		protocol.NewStat("maxconns", s.maxConns),
+		protocol.NewStat("reserved_conns", s.reservedConns),
+		protocol.NewStat("idle_timeout", s.timeout),
+		protocol.NewStat("write_timeout", s.writeTimeout),
+		protocol.NewStat("net_mode", netMode),
+		protocol.NewStat("item_size_max", s.maxValSize),
+		protocol.NewStat("evictions", "on"),
+		protocol.NewStat("cas_enabled", "yes"),
+		protocol.NewStat("shutdown_enabled", shutdown),
+	}
+}
+
+// Conns returns per-connection statistics for the stats conns command,
+// keyed by session ID.
+func (s *Server) Conns() []protocol.Stat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]*protocol.TextSession, 0, len(s.sessions))
+	for session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID() < sessions[j].ID() })
+
+	now := time.Now()
+	stats := []protocol.Stat{}
+	for _, session := range sessions {
+		id := session.ID()
+		addr := session.RemoteAddr()
+		stats = append(stats,
+			protocol.NewStat(fmt.Sprintf("%d:addr", id), fmt.Sprintf("%s:%s", addr.Network(), addr)),
+			protocol.NewStat(fmt.Sprintf("%d:secs_since_last_cmd", id), int64(now.Sub(session.LastActive()).Seconds())))
+	}
+	return stats
 }
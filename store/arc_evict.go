@@ -0,0 +1,175 @@
+package store
+
+var _ AdaptiveEvictionPolicy = &arcEvictionPolicy{}
+
+// An arcEvictionPolicy is an ARC (Adaptive Replacement Cache) implementation
+// of an EvictionPolicy, adapted to capacities in bytes rather than keys.
+// Keys used once are kept in t1 and keys used again in t2, each most
+// recently used first. Evicted keys are remembered, without their values, in
+// the ghost lists b1 and b2. A miss on a ghost of b1 means t1 was too small,
+// so the target p of bytes for t1 grows, and a miss on a ghost of b2 shrinks
+// it, so the policy tunes itself between recency and frequency.
+type arcEvictionPolicy struct {
+	cap    int
+	p      int
+	t1, t2 *lruSegment
+	b1, b2 *lruSegment
+	kvMap  map[string]*segmentNode // resident and ghost keys
+}
+
+func NewArcEvictionPolicy(cap int) *arcEvictionPolicy {
+	if cap < 0 {
+		cap = 0
+	}
+	return &arcEvictionPolicy{
+		cap:   cap,
+		t1:    newLruSegment(),
+		t2:    newLruSegment(),
+		b1:    newLruSegment(),
+		b2:    newLruSegment(),
+		kvMap: map[string]*segmentNode{},
+	}
+}
+
+func (l *arcEvictionPolicy) Capacity() int {
+	return l.cap
+}
+
+func (l *arcEvictionPolicy) Used() int {
+	return l.t1.used + l.t2.used
+}
+
+// Target returns p, the bytes of keys used once that ARC currently aims to
+// keep.
+func (l *arcEvictionPolicy) Target() int {
+	return l.p
+}
+
+func (l *arcEvictionPolicy) ghost(node *segmentNode) bool {
+	return node.seg == l.b1 || node.seg == l.b2
+}
+
+func (l *arcEvictionPolicy) Touch(key string) bool {
+	node, ok := l.kvMap[key]
+	if !ok || l.ghost(node) {
+		return false
+	}
+	node.seg.unlink(node)
+	l.t2.pushFront(node)
+	return true
+}
+
+// victim returns the key to evict and the ghost list to remember it in. The
+// least recently used of t1 goes if t1 is over its target, or at it and the
+// new key was a ghost of b2, and otherwise the least recently used of t2.
+func (l *arcEvictionPolicy) victim(inB2 bool) (*segmentNode, *lruSegment) {
+	t1Victim := l.t1.used > l.p || (inB2 && l.t1.used == l.p)
+	if node := l.t1.back(); node != nil && (t1Victim || l.t2.back() == nil) {
+		return node, l.b1
+	}
+	return l.t2.back(), l.b2
+}
+
+// replace evicts keys to the ghost lists until there is room for size more
+// bytes.
+func (l *arcEvictionPolicy) replace(size int, inB2 bool) (evict []string) {
+	for l.Used()+size > l.cap {
+		node, ghosts := l.victim(inB2)
+		node.seg.unlink(node)
+		node.val = Value{}
+		ghosts.pushFront(node)
+		evict = append(evict, node.key)
+	}
+	return
+}
+
+// forget drops the least recently used ghost of the list.
+func (l *arcEvictionPolicy) forget(ghosts *lruSegment) {
+	node := ghosts.back()
+	ghosts.unlink(node)
+	delete(l.kvMap, node.key)
+}
+
+// adapt moves the target p towards t1 for a miss on a ghost of b1, and
+// towards t2 for a miss on a ghost of b2, by the size of the key, scaled by
+// the ratio of the ghost lists when the other is bigger.
+func (l *arcEvictionPolicy) adapt(node *segmentNode) {
+	delta := node.size
+	if node.seg == l.b1 {
+		if l.b1.used < l.b2.used {
+			delta = delta * l.b2.used / l.b1.used
+		}
+		if l.p += delta; l.p > l.cap {
+			l.p = l.cap
+		}
+		return
+	}
+	if l.b2.used < l.b1.used {
+		delta = delta * l.b1.used / l.b2.used
+	}
+	if l.p -= delta; l.p < 0 {
+		l.p = 0
+	}
+}
+
+func (l *arcEvictionPolicy) Add(key string, v Value) (evict []string, hasSpace bool) {
+	size := kvSize(key, v)
+	if size > l.cap {
+		hasSpace = false
+		return
+	}
+	hasSpace = true
+
+	node, exists := l.kvMap[key]
+	switch {
+	case exists && !l.ghost(node):
+		// an existing key is a hit, making room for its new size
+		node.seg.unlink(node)
+		evict = l.replace(size, false)
+	case exists:
+		// a miss on a ghost adapts the target, and is used again
+		l.adapt(node)
+		inB2 := node.seg == l.b2
+		node.seg.unlink(node)
+		evict = l.replace(size, inB2)
+	default:
+		// a new key drops the oldest ghosts to keep the lists of keys used
+		// once within the capacity, and of all keys within twice of it
+		for l.t1.used+l.b1.used+size > l.cap && l.b1.back() != nil {
+			l.forget(l.b1)
+		}
+		for l.Used()+l.b1.used+l.b2.used+size > 2*l.cap && l.b2.back() != nil {
+			l.forget(l.b2)
+		}
+		evict = l.replace(size, false)
+		node = &segmentNode{key: key}
+		l.kvMap[key] = node
+	}
+	node.val = v
+	node.size = size
+	if exists {
+		l.t2.pushFront(node)
+	} else {
+		l.t1.pushFront(node)
+	}
+
+	// the evicted keys may have grown the ghost lists past twice the capacity
+	for l.b1.used+l.b2.used+l.Used() > 2*l.cap {
+		if l.b2.used > l.b1.used {
+			l.forget(l.b2)
+		} else {
+			l.forget(l.b1)
+		}
+	}
+	return
+}
+
+func (l *arcEvictionPolicy) Remove(key string) bool {
+	node, ok := l.kvMap[key]
+	if !ok || l.ghost(node) {
+		return false
+	}
+	delete(l.kvMap, key)
+	node.seg.unlink(node)
+	return true
+}
@@ -0,0 +1,146 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func expectArcLists(t *testing.T, p *arcEvictionPolicy, t1, t2, b1, b2 []string) {
+	expected := [][]string{t1, t2, b1, b2}
+	received := [][]string{segmentKeys(p.t1), segmentKeys(p.t2), segmentKeys(p.b1), segmentKeys(p.b2)}
+	if !reflect.DeepEqual(expected, received) {
+		t.Errorf("expected lists %v, received %v", expected, received)
+	}
+}
+
+func TestArcTouchNonExisting(t *testing.T) {
+	p := NewArcEvictionPolicy(16)
+	ok := p.Touch("non_existing")
+	if ok {
+		t.Errorf("expected unsuccessful touch")
+	}
+}
+
+func TestArcTouchExisting(t *testing.T) {
+	p := NewArcEvictionPolicy(64)
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+	p.Add("key3", Value{Bytes: []byte{0}})
+	expectArcLists(t, p, []string{"key3", "key2", "key1"}, []string{}, []string{}, []string{})
+
+	// a touched key is used again
+	ok := p.Touch("key1")
+	if !ok {
+		t.Errorf("expected successful touch")
+	}
+	p.Touch("key3")
+	expectArcLists(t, p, []string{"key2"}, []string{"key3", "key1"}, []string{}, []string{})
+}
+
+func TestArcDelete(t *testing.T) {
+	p := NewArcEvictionPolicy(30)
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+	p.Add("key3", Value{Bytes: []byte{0}})
+
+	// ghosts are not managed, as they are not stored
+	if p.Remove("unknown") || p.Remove("key1") || p.Touch("key1") {
+		t.Errorf("expected the ghost key1 not to be managed")
+	}
+
+	p.Remove("key2")
+	p.Remove("key3")
+	if p.Used() != 0 {
+		t.Errorf("expected 0 used bytes, received %d", p.Used())
+	}
+	expectArcLists(t, p, []string{}, []string{}, []string{"key1"}, []string{})
+}
+
+func TestArcAdaptation(t *testing.T) {
+	p := NewArcEvictionPolicy(60)
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+	p.Add("key3", Value{Bytes: []byte{0}})
+	ev, sp := p.Add("key4", Value{Bytes: []byte{0}})
+	if ev != nil || sp == false {
+		t.Errorf("expected no evictions and can add")
+	}
+	p.Touch("key1")
+	p.Touch("key2")
+
+	// with a target of 0, keys used once are evicted first
+	ev, _ = p.Add("key5", Value{Bytes: []byte{0}})
+	if !reflect.DeepEqual(ev, []string{"key3"}) {
+		t.Errorf("expected eviction of key3, received %v", ev)
+	}
+
+	// a miss on a ghost of b1 grows the target
+	ev, _ = p.Add("key3", Value{Bytes: []byte{0}})
+	if !reflect.DeepEqual(ev, []string{"key4"}) || p.Target() != 15 {
+		t.Errorf("expected eviction of key4 and target 15, received %v and %d", ev, p.Target())
+	}
+	expectArcLists(t, p, []string{"key5"}, []string{"key3", "key2", "key1"}, []string{"key4"}, []string{})
+
+	// at its target, t1 keeps its keys
+	ev, _ = p.Add("key6", Value{Bytes: []byte{0}})
+	if !reflect.DeepEqual(ev, []string{"key1"}) {
+		t.Errorf("expected eviction of key1, received %v", ev)
+	}
+
+	// a miss on a ghost of b2 shrinks the target
+	ev, _ = p.Add("key1", Value{Bytes: []byte{0}})
+	if !reflect.DeepEqual(ev, []string{"key5"}) || p.Target() != 0 {
+		t.Errorf("expected eviction of key5 and target 0, received %v and %d", ev, p.Target())
+	}
+	expectArcLists(t, p, []string{"key6"}, []string{"key1", "key3", "key2"}, []string{"key5", "key4"}, []string{})
+	if p.Used() != 60 {
+		t.Errorf("expected 60 used bytes, received %d", p.Used())
+	}
+
+	ev, sp = p.Add("key7", Value{Bytes: make([]byte, 60)})
+	if ev != nil || sp == true {
+		t.Errorf("expected no evictions and cannot add")
+	}
+}
+
+func TestArcOverwrite(t *testing.T) {
+	p := NewArcEvictionPolicy(32)
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+
+	// overwriting key1 is a hit
+	ev, sp := p.Add("key1", Value{Bytes: []byte{1, 2}})
+	if ev != nil || sp == false {
+		t.Errorf("expected no evictions and can add")
+	}
+	if p.Used() != 31 {
+		t.Errorf("expected 31 used bytes, received %d", p.Used())
+	}
+	expectArcLists(t, p, []string{"key2"}, []string{"key1"}, []string{}, []string{})
+
+	// growing a key evicts others, but never itself
+	ev, sp = p.Add("key1", Value{Bytes: make([]byte, 15)})
+	if !reflect.DeepEqual(ev, []string{"key2"}) || sp == false {
+		t.Errorf("expected eviction of key2 and can add, received %v and %v", ev, sp)
+	}
+	expectArcLists(t, p, []string{}, []string{"key1"}, []string{"key2"}, []string{})
+}
+
+func TestArcGhostBounds(t *testing.T) {
+	p := NewArcEvictionPolicy(15 * 10)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("s%02d", i)
+		p.Add(key, Value{Bytes: []byte{0, 0}})
+		if i%3 == 0 {
+			p.Touch(key)
+		}
+		if p.t1.used+p.b1.used > p.cap || p.Used()+p.b1.used+p.b2.used > 2*p.cap {
+			t.Fatalf("expected lists within capacity, received t1 %d, t2 %d, b1 %d and b2 %d",
+				p.t1.used, p.t2.used, p.b1.used, p.b2.used)
+		}
+	}
+	if len(p.kvMap) > 20 {
+		t.Errorf("expected at most 20 keys remembered, received %d", len(p.kvMap))
+	}
+}
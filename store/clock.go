@@ -0,0 +1,26 @@
+package store
+
+import (
+	"time"
+)
+
+// A Clock supplies the current time and timers. It exists so that
+// time-dependent logic, like expiration, can be driven by tests
+// without sleeping.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel that receives the current time once
+	// the duration has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock backed by the time package.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (_ systemClock) Now() time.Time { return time.Now() }
+
+func (_ systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
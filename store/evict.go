@@ -1,6 +1,9 @@
 package store
 
-// kvSize returns the size in bytes of the key and value data
+// kvSize returns the size in bytes of the key and value data. Like the
+// ItemMeta kept beside it, the expiry is bookkeeping rather than data a
+// client reads back, so it is not counted and whether a value expires does
+// not change how much fits in the capacity.
 func kvSize(key string, val Value) int {
 	return len(key) + len(val.Bytes) + 2 /* flags */ + 8 /* cas unique */
 }
@@ -26,7 +29,10 @@ type EvictionPolicy interface {
 
 	// Add returns the set of keys that should be removed from the
 	// in-memory store and a boolean indicating if there is room to
-	// store the input value.
+	// store the input value. The value has no room if it is too big
+	// for the capacity, or if the policy declines to admit it, in which
+	// case the policy no longer manages the key. The keys to remove are
+	// removed either way.
 	Add(key string, v Value) (evict []string, hasSpace bool)
 
 	// Remove indicates that the key has been removed from the StorageEngine.
@@ -35,6 +41,22 @@ type EvictionPolicy interface {
 	Remove(key string) bool
 }
 
+// An AdaptiveEvictionPolicy is an EvictionPolicy that tunes itself to the
+// workload, reporting the target in bytes it adapts, such as ARC's p.
+type AdaptiveEvictionPolicy interface {
+	EvictionPolicy
+
+	// Target returns the current adaptive target in bytes.
+	Target() int
+}
+
+// An admissionPolicy is an EvictionPolicy that may decline to admit a key
+// that fits in its capacity.
+type admissionPolicy interface {
+	EvictionPolicy
+	admission()
+}
+
 // A lruEvictionPolicy is an LRU implementation of an EvictionPolicy
 // using doubly linked lists.
 type lruEvictionPolicy struct {
@@ -86,14 +108,11 @@ func (l *lruEvictionPolicy) Add(key string, v Value) (evict []string, hasSpace b
 	}
 	hasSpace = true
 
-	existing, ok := l.kvMap[key]
-	existingSize := 0
-	if ok {
-		existingSize = kvSize(key, existing.val)
-	}
+	// an existing node is replaced, so unlink it before making room
+	l.Remove(key)
 
 	// add evictions, if necessary
-	for l.used+size-existingSize > l.cap {
+	for l.used+size > l.cap {
 		// evict from the end of the list (least recent)
 		lruNode := l.sentinel.prev
 		l.used -= kvSize(lruNode.key, lruNode.val)
@@ -110,7 +129,7 @@ func (l *lruEvictionPolicy) Add(key string, v Value) (evict []string, hasSpace b
 	node.next.prev = node
 	l.sentinel.next = node
 	l.kvMap[key] = node
-	l.used += size - existingSize
+	l.used += size
 
 	return
 }
@@ -123,5 +142,6 @@ func (l *lruEvictionPolicy) Remove(key string) bool {
 	delete(l.kvMap, key)
 	node.prev.next = node.next
 	node.next.prev = node.prev
+	l.used -= kvSize(key, node.val)
 	return true
 }
@@ -4,6 +4,12 @@ import (
 	"testing"
 )
 
+func TestKvSizeIgnoresExpiry(t *testing.T) {
+	if kvSize("key", Value{Bytes: []byte("value"), Expiry: 100}) != kvSize("key", Value{Bytes: []byte("value")}) {
+		t.Errorf("expected the expiry not to count towards the size")
+	}
+}
+
 func TestLruTouchNonExisting(t *testing.T) {
 	p := NewLruEvictionPolicy(16)
 	ok := p.Touch("non_existing")
@@ -15,9 +21,9 @@ func TestLruTouchNonExisting(t *testing.T) {
 func TestLruTouchExisting(t *testing.T) {
 	p := NewLruEvictionPolicy(16)
 
-	node1 := &kvListNode{"key1", Value{0, 0, []byte{0}}, nil, nil}
-	node2 := &kvListNode{"key2", Value{0, 0, []byte{0}}, nil, nil}
-	node3 := &kvListNode{"key3", Value{0, 0, []byte{0}}, nil, nil}
+	node1 := &kvListNode{"key1", Value{Bytes: []byte{0}}, nil, nil}
+	node2 := &kvListNode{"key2", Value{Bytes: []byte{0}}, nil, nil}
+	node3 := &kvListNode{"key3", Value{Bytes: []byte{0}}, nil, nil}
 	p.kvMap["key1"] = node1
 	p.kvMap["key2"] = node2
 	p.kvMap["key3"] = node3
@@ -59,8 +65,8 @@ func TestLruTouchExisting(t *testing.T) {
 
 func TestLruDelete(t *testing.T) {
 	p := NewLruEvictionPolicy(32)
-	p.Add("key1", Value{0, 0, []byte{0}})
-	p.Add("key2", Value{0, 0, []byte{0}})
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
 
 	if len(p.kvMap) != 2 {
 		t.Errorf("expected 2 elements in kvMap, received %d", len(p.kvMap))
@@ -89,7 +95,7 @@ func TestLruDelete(t *testing.T) {
 func TestLruEviction(t *testing.T) {
 	p := NewLruEvictionPolicy(32)
 
-	ev, sp := p.Add("key1", Value{0, 0, []byte{0}})
+	ev, sp := p.Add("key1", Value{Bytes: []byte{0}})
 	if ev != nil || sp == false {
 		t.Errorf("expected no evictions and can add")
 	}
@@ -97,7 +103,7 @@ func TestLruEviction(t *testing.T) {
 		t.Errorf("expected 15 used bytes, received %d", p.Used())
 	}
 
-	ev, sp = p.Add("key2", Value{0, 0, []byte{0}})
+	ev, sp = p.Add("key2", Value{Bytes: []byte{0}})
 	if ev != nil || sp == false {
 		t.Errorf("expected no evictions and can add")
 	}
@@ -105,7 +111,7 @@ func TestLruEviction(t *testing.T) {
 		t.Errorf("expected 30 used bytes, received %d", p.Used())
 	}
 
-	ev, sp = p.Add("key3", Value{0, 0, []byte{1, 2, 3}})
+	ev, sp = p.Add("key3", Value{Bytes: []byte{1, 2, 3}})
 	if len(ev) != 1 {
 		t.Errorf("expected 1 eviction, received %d", len(ev))
 	}
@@ -119,3 +125,30 @@ func TestLruEviction(t *testing.T) {
 		t.Errorf("expected 32 used bytes, received %d", p.Used())
 	}
 }
+
+func TestLruOverwrite(t *testing.T) {
+	p := NewLruEvictionPolicy(32)
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+
+	// overwriting key1 replaces its node rather than adding a second one
+	ev, sp := p.Add("key1", Value{Bytes: []byte{1, 2}})
+	if ev != nil || sp == false {
+		t.Errorf("expected no evictions and can add")
+	}
+	if len(p.kvMap) != 2 {
+		t.Errorf("expected 2 elements in kvMap, received %d", len(p.kvMap))
+	}
+	if p.Used() != 31 {
+		t.Errorf("expected 31 used bytes, received %d", p.Used())
+	}
+	if p.sentinel.next.key != "key1" || p.sentinel.prev.key != "key2" {
+		t.Errorf("expected order key1, key2 but received %v, %v", p.sentinel.next.key, p.sentinel.prev.key)
+	}
+
+	// removing a key releases its bytes
+	p.Remove("key1")
+	if p.Used() != 15 {
+		t.Errorf("expected 15 used bytes, received %d", p.Used())
+	}
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+	"container/heap"
+	"github.com/golang/glog"
+	"time"
+)
+
+// minExpiryCompaction is the number of stale entries an expiryHeap may
+// accumulate beyond twice the number of stored Values before it is rebuilt.
+const minExpiryCompaction = 1024
+
+// An expiryEntry records that the key was written with the given expiry.
+type expiryEntry struct {
+	key    string
+	expiry int64
+}
+
+// An expiryHeap is a min-heap of expiryEntries ordered by expiry. Entries
+// are never updated in place: a key written again simply gets another
+// entry, and stale entries are discarded when they are popped.
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].expiry < h[j].expiry }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiryEntry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// newExpiryHeap builds an expiryHeap holding exactly one entry for each
+// Value with an expiry.
+func newExpiryHeap(values map[string]*item) expiryHeap {
+	h := expiryHeap{}
+	for k, v := range values {
+		if v.Expiry != 0 {
+			h = append(h, expiryEntry{k, v.Expiry})
+		}
+	}
+	heap.Init(&h)
+	return h
+}
+
+// push adds an entry for the key if the expiry is set.
+func (h *expiryHeap) push(key string, expiry int64) {
+	if expiry != 0 {
+		heap.Push(h, expiryEntry{key, expiry})
+	}
+}
+
+// peekExpired returns the earliest entry if it is due at the given unix time.
+func (h *expiryHeap) peekExpired(now int64) (e expiryEntry, ok bool) {
+	if h.Len() == 0 || (*h)[0].expiry > now {
+		return
+	}
+	return (*h)[0], true
+}
+
+// popExpired pops and returns the earliest entry if it is due at the
+// given unix time.
+func (h *expiryHeap) popExpired(now int64) (e expiryEntry, ok bool) {
+	if _, ok = h.peekExpired(now); !ok {
+		return
+	}
+	return heap.Pop(h).(expiryEntry), true
+}
+
+// A Reaper is a store whose expired Values can be actively removed.
+type Reaper interface {
+	// ReapExpired removes at most max expired Values, returning the
+	// number removed and whether more expired Values may remain.
+	ReapExpired(max int) (reaped int, more bool)
+}
+
+// An ExpiryReaper periodically removes expired Values from a Reaper so
+// that Values nobody reads again do not hold on to capacity in the
+// EvictionPolicy. Values are removed in bounded batches so the store is
+// never locked for long.
+type ExpiryReaper struct {
+	target   Reaper
+	clock    Clock
+	interval time.Duration
+	batch    int
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewExpiryReaper returns an ExpiryReaper that wakes up every interval
+// according to the clock and reaps the target in batches of the given size.
+func NewExpiryReaper(target Reaper, clock Clock, interval time.Duration, batch int) *ExpiryReaper {
+	if batch <= 0 {
+		batch = 1
+	}
+	return &ExpiryReaper{
+		target:   target,
+		clock:    clock,
+		interval: interval,
+		batch:    batch,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start starts reaping in a new goroutine.
+func (r *ExpiryReaper) Start() {
+	go r.run()
+}
+
+// Stop stops reaping and waits for the reaping goroutine to return.
+func (r *ExpiryReaper) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+func (r *ExpiryReaper) run() {
+	defer close(r.done)
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-r.clock.After(r.interval):
+		}
+
+		total := 0
+		for {
+			reaped, more := r.target.ReapExpired(r.batch)
+			total += reaped
+			if !more {
+				break
+			}
+			select {
+			case <-r.stop:
+				return
+			default:
+			}
+		}
+		if total > 0 {
+			glog.V(2).Infof("reaped %d expired keys", total)
+		}
+	}
+}
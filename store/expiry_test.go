@@ -0,0 +1,183 @@
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fakeClock is a Clock whose time only moves when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	waiting chan struct{}
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, waiting: make(chan struct{}, 16)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := fakeTimer{c.now.Add(d), make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	select {
+	case c.waiting <- struct{}{}:
+	default:
+	}
+	return timer.c
+}
+
+// Advance moves the clock forward, firing all timers that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if !timer.at.After(c.now) {
+			timer.c <- c.now
+		} else {
+			pending = append(pending, timer)
+		}
+	}
+	c.timers = pending
+}
+
+// A notifyingReaper signals on each call to ReapExpired.
+type notifyingReaper struct {
+	Reaper
+	reaped chan int
+}
+
+func (n *notifyingReaper) ReapExpired(max int) (reaped int, more bool) {
+	reaped, more = n.Reaper.ReapExpired(max)
+	n.reaped <- reaped
+	return
+}
+
+func TestExpiryHeapOrder(t *testing.T) {
+	h := expiryHeap{}
+	h.push("key3", 30)
+	h.push("key0", 0)
+	h.push("key1", 10)
+	h.push("key2", 20)
+	if h.Len() != 3 {
+		t.Errorf("expected 3 entries, received %d", h.Len())
+	}
+
+	e, ok := h.popExpired(20)
+	if !ok || e.key != "key1" {
+		t.Errorf("expected key1 to be popped, received %v", e)
+	}
+	e, ok = h.popExpired(20)
+	if !ok || e.key != "key2" {
+		t.Errorf("expected key2 to be popped, received %v", e)
+	}
+	_, ok = h.popExpired(20)
+	if ok {
+		t.Errorf("expected nothing to be popped")
+	}
+}
+
+func TestSimpleStorageEngineReapExpired(t *testing.T) {
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	ep := NewLruEvictionPolicy(1024)
+	s := NewSimpleStorageEngineWithClock(ep, clock)
+	now := clock.Now()
+
+	s.Set("key1", Value{Bytes: []byte("value1"), Expiry: Expiry(10, now)})
+	s.Set("key2", Value{Bytes: []byte("value2"), Expiry: Expiry(10, now)})
+	s.Set("key3", Value{Bytes: []byte("value3"), Expiry: Expiry(10, now)})
+	s.Set("key4", Value{Bytes: []byte("value4")})
+
+	// overwriting key3 leaves a stale entry behind
+	s.Set("key3", Value{Bytes: []byte("value3"), Expiry: Expiry(20, now)})
+
+	reaped, more := s.ReapExpired(10)
+	if reaped != 0 || more {
+		t.Errorf("expected nothing reaped, received %d reaped and more=%v", reaped, more)
+	}
+
+	clock.Advance(10 * time.Second)
+	reaped, more = s.ReapExpired(1)
+	if reaped != 1 || !more {
+		t.Errorf("expected 1 reaped and more, received %d reaped and more=%v", reaped, more)
+	}
+	reaped, more = s.ReapExpired(10)
+	if reaped != 1 || more {
+		t.Errorf("expected 1 reaped and no more, received %d reaped and more=%v", reaped, more)
+	}
+	if len(s.values) != 2 {
+		t.Errorf("expected 2 values left, received %d", len(s.values))
+	}
+	if ep.Used() != kvSize("key3", Value{Bytes: []byte("value3")})+kvSize("key4", Value{Bytes: []byte("value4")}) {
+		t.Errorf("expected only key3 and key4 to use bytes, received %d used bytes", ep.Used())
+	}
+}
+
+func TestSimpleStorageEngineCompactsExpiries(t *testing.T) {
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	s := NewSimpleStorageEngineWithClock(NewLruEvictionPolicy(1024), clock)
+	for i := 0; i < 10*minExpiryCompaction; i++ {
+		s.Set("key", Value{Bytes: []byte("value"), Expiry: Expiry(int64(i+1), clock.Now())})
+	}
+	if s.expiries.Len() > minExpiryCompaction+2 {
+		t.Errorf("expected at most %d expiry entries, received %d", minExpiryCompaction+2, s.expiries.Len())
+	}
+
+	// touching the key compacts the stale entries too
+	for i := 0; i < 10*minExpiryCompaction; i++ {
+		s.Touch("key", Expiry(int64(i+1), clock.Now()))
+	}
+	if s.expiries.Len() > minExpiryCompaction+2 {
+		t.Errorf("expected at most %d expiry entries after touching, received %d", minExpiryCompaction+2, s.expiries.Len())
+	}
+}
+
+func TestExpiryReaper(t *testing.T) {
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	s := NewSimpleStorageEngineWithClock(NewLruEvictionPolicy(1024), clock)
+	for _, k := range []string{"key1", "key2", "key3"} {
+		s.Set(k, Value{Bytes: []byte("value"), Expiry: Expiry(5, clock.Now())})
+	}
+	target := &notifyingReaper{s, make(chan int)}
+	r := NewExpiryReaper(target, clock, time.Second, 2)
+	r.Start()
+
+	// nothing is due after the first interval
+	<-clock.waiting
+	clock.Advance(time.Second)
+	if reaped := <-target.reaped; reaped != 0 {
+		t.Errorf("expected nothing reaped, received %d", reaped)
+	}
+
+	// all keys are due after five seconds and are reaped in batches of two
+	<-clock.waiting
+	clock.Advance(4 * time.Second)
+	if reaped := <-target.reaped; reaped != 2 {
+		t.Errorf("expected 2 reaped, received %d", reaped)
+	}
+	if reaped := <-target.reaped; reaped != 1 {
+		t.Errorf("expected 1 reaped, received %d", reaped)
+	}
+
+	<-clock.waiting
+	r.Stop()
+	if _, found := s.Get("key1"); found {
+		t.Errorf("expected key1 to be reaped")
+	}
+}
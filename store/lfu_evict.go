@@ -0,0 +1,214 @@
+package store
+
+// lfuNode represents a key-value pair in the doubly linked list of the
+// bucket holding the keys used as often as it.
+type lfuNode struct {
+	key        string
+	val        Value
+	bucket     *lfuBucket
+	prev, next *lfuNode
+}
+
+// lfuBucket holds the keys used freq times, most recently used first. The
+// buckets form a doubly linked list in increasing order of freq.
+type lfuBucket struct {
+	freq       int
+	sentinel   *lfuNode
+	prev, next *lfuBucket
+}
+
+func newLfuBucket(freq int) *lfuBucket {
+	s := &lfuNode{}
+	s.next = s
+	s.prev = s
+	return &lfuBucket{freq: freq, sentinel: s}
+}
+
+func (b *lfuBucket) empty() bool {
+	return b.sentinel.next == b.sentinel
+}
+
+// pushFront adds the node as the most recently used of the bucket.
+func (b *lfuBucket) pushFront(node *lfuNode) {
+	node.bucket = b
+	node.next = b.sentinel.next
+	node.prev = b.sentinel
+	b.sentinel.next.prev = node
+	b.sentinel.next = node
+}
+
+// A lfuEvictionPolicy is an LFU implementation of an EvictionPolicy that
+// evicts the least frequently used key, breaking ties by evicting the least
+// recently used. Every operation is O(1): keys are kept in buckets of equal
+// frequency, and a touched key moves to the next bucket.
+//
+// Unless decay is <= 0, every key's frequency is halved after every decay
+// touches and adds, so keys that were popular long ago can be evicted. Each
+// halving is O(n), but amortized over the decay operations before it.
+type lfuEvictionPolicy struct {
+	cap      int
+	used     int
+	decay    int
+	accesses int
+	buckets  *lfuBucket // the sentinel of the bucket list
+	kvMap    map[string]*lfuNode
+}
+
+func NewLfuEvictionPolicy(cap, decay int) *lfuEvictionPolicy {
+	if cap < 0 {
+		cap = 0
+	}
+	s := &lfuBucket{}
+	s.next = s
+	s.prev = s
+	return &lfuEvictionPolicy{cap: cap, decay: decay, buckets: s, kvMap: map[string]*lfuNode{}}
+}
+
+func (l *lfuEvictionPolicy) Capacity() int {
+	return l.cap
+}
+
+func (l *lfuEvictionPolicy) Used() int {
+	return l.used
+}
+
+// bucketAfter returns the bucket of the given frequency following b,
+// creating it if it does not exist.
+func (l *lfuEvictionPolicy) bucketAfter(b *lfuBucket, freq int) *lfuBucket {
+	if b.next != l.buckets && b.next.freq == freq {
+		return b.next
+	}
+	bucket := newLfuBucket(freq)
+	bucket.prev = b
+	bucket.next = b.next
+	b.next.prev = bucket
+	b.next = bucket
+	return bucket
+}
+
+// unlink pops the node from its bucket, dropping the bucket if it is left
+// empty.
+func (l *lfuEvictionPolicy) unlink(node *lfuNode) {
+	node.prev.next = node.next
+	node.next.prev = node.prev
+	if b := node.bucket; b.empty() {
+		b.prev.next = b.next
+		b.next.prev = b.prev
+	}
+	node.bucket = nil
+}
+
+// access counts a touch or add towards the next decay.
+func (l *lfuEvictionPolicy) access() {
+	if l.decay <= 0 {
+		return
+	}
+	if l.accesses++; l.accesses >= l.decay {
+		l.accesses = 0
+		l.halve()
+	}
+}
+
+// halve halves the frequency of every key, to at least 1. Buckets left
+// with the same frequency are merged, the keys of the formerly more
+// frequent bucket counting as more recently used.
+func (l *lfuEvictionPolicy) halve() {
+	for b := l.buckets.next; b != l.buckets; {
+		next := b.next
+		freq := b.freq / 2
+		if freq < 1 {
+			freq = 1
+		}
+		if prev := b.prev; prev != l.buckets && prev.freq == freq {
+			for node := b.sentinel.prev; node != b.sentinel; {
+				older := node.prev
+				prev.pushFront(node)
+				node = older
+			}
+			prev.next = next
+			next.prev = prev
+		} else {
+			b.freq = freq
+		}
+		b = next
+	}
+}
+
+func (l *lfuEvictionPolicy) touch(node *lfuNode) {
+	b := node.bucket
+	next := l.bucketAfter(b, b.freq+1)
+	l.unlink(node)
+	next.pushFront(node)
+	l.access()
+}
+
+func (l *lfuEvictionPolicy) Touch(key string) bool {
+	node, ok := l.kvMap[key]
+	if !ok {
+		return false
+	}
+	l.touch(node)
+	return true
+}
+
+// victim returns the least recently used key of the least frequently used
+// bucket, other than the given node.
+func (l *lfuEvictionPolicy) victim(except *lfuNode) *lfuNode {
+	b := l.buckets.next
+	node := b.sentinel.prev
+	if node == except {
+		if node = node.prev; node == b.sentinel {
+			node = b.next.sentinel.prev
+		}
+	}
+	return node
+}
+
+func (l *lfuEvictionPolicy) Add(key string, v Value) (evict []string, hasSpace bool) {
+	size := kvSize(key, v)
+	if size > l.cap {
+		hasSpace = false
+		return
+	}
+	hasSpace = true
+
+	// an existing key keeps its node, so it keeps its frequency
+	node, exists := l.kvMap[key]
+	if exists {
+		l.used -= kvSize(key, node.val)
+	}
+
+	// add evictions, if necessary
+	for l.used+size > l.cap {
+		lfuNode := l.victim(node)
+		l.used -= kvSize(lfuNode.key, lfuNode.val)
+		delete(l.kvMap, lfuNode.key)
+		l.unlink(lfuNode)
+		evict = append(evict, lfuNode.key)
+	}
+
+	l.used += size
+	if exists {
+		node.val = v
+		l.touch(node)
+		return
+	}
+
+	// finally, add the new node as the most recent of the keys used once
+	node = &lfuNode{key: key, val: v}
+	l.bucketAfter(l.buckets, 1).pushFront(node)
+	l.kvMap[key] = node
+	l.access()
+	return
+}
+
+func (l *lfuEvictionPolicy) Remove(key string) bool {
+	node, ok := l.kvMap[key]
+	if !ok {
+		return false
+	}
+	delete(l.kvMap, key)
+	l.unlink(node)
+	l.used -= kvSize(key, node.val)
+	return true
+}
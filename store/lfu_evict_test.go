@@ -0,0 +1,214 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// lfuOrder returns the frequency of each bucket in increasing order, and the
+// keys of each bucket, most recently used first.
+func lfuOrder(p *lfuEvictionPolicy) (freqs []int, keys [][]string) {
+	for b := p.buckets.next; b != p.buckets; b = b.next {
+		bucket := []string{}
+		for node := b.sentinel.next; node != b.sentinel; node = node.next {
+			if node.bucket != b {
+				panic("node in the wrong bucket")
+			}
+			bucket = append(bucket, node.key)
+		}
+		freqs = append(freqs, b.freq)
+		keys = append(keys, bucket)
+	}
+	return
+}
+
+func expectLfuOrder(t *testing.T, p *lfuEvictionPolicy, freqs []int, keys [][]string) {
+	recFreqs, recKeys := lfuOrder(p)
+	if !reflect.DeepEqual(freqs, recFreqs) || !reflect.DeepEqual(keys, recKeys) {
+		t.Errorf("expected buckets %v holding %v, received %v holding %v", freqs, keys, recFreqs, recKeys)
+	}
+}
+
+func TestLfuTouchNonExisting(t *testing.T) {
+	p := NewLfuEvictionPolicy(16, 0)
+	ok := p.Touch("non_existing")
+	if ok {
+		t.Errorf("expected unsuccessful touch")
+	}
+}
+
+func TestLfuTouchExisting(t *testing.T) {
+	p := NewLfuEvictionPolicy(64, 0)
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+	p.Add("key3", Value{Bytes: []byte{0}})
+	expectLfuOrder(t, p, []int{1}, [][]string{{"key3", "key2", "key1"}})
+
+	// touch key2
+	ok := p.Touch("key2")
+	if !ok {
+		t.Errorf("expected successful touch")
+	}
+	expectLfuOrder(t, p, []int{1, 2}, [][]string{{"key3", "key1"}, {"key2"}})
+
+	// touch key2 again, emptying the bucket it leaves
+	p.Touch("key2")
+	p.Touch("key1")
+	expectLfuOrder(t, p, []int{1, 2, 3}, [][]string{{"key3"}, {"key1"}, {"key2"}})
+	p.Touch("key1")
+	expectLfuOrder(t, p, []int{1, 3}, [][]string{{"key3"}, {"key1", "key2"}})
+}
+
+func TestLfuDelete(t *testing.T) {
+	p := NewLfuEvictionPolicy(32, 0)
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+	p.Touch("key2")
+
+	if len(p.kvMap) != 2 {
+		t.Errorf("expected 2 elements in kvMap, received %d", len(p.kvMap))
+	}
+
+	p.Remove("unknown")
+	if len(p.kvMap) != 2 {
+		t.Errorf("expected 2 elements in kvMap, received %d", len(p.kvMap))
+	}
+
+	p.Remove("key1")
+	if len(p.kvMap) != 1 {
+		t.Errorf("expected 1 element in kvMap, received %d", len(p.kvMap))
+	}
+
+	p.Remove("key2")
+	if len(p.kvMap) != 0 {
+		t.Errorf("expected 0 elements in kvMap, received %d", len(p.kvMap))
+	}
+
+	if p.buckets.next != p.buckets || p.Used() != 0 {
+		t.Error("expected 0 elements in list")
+	}
+}
+
+func TestLfuEviction(t *testing.T) {
+	p := NewLfuEvictionPolicy(45, 0)
+
+	ev, sp := p.Add("key1", Value{Bytes: []byte{0}})
+	if ev != nil || sp == false {
+		t.Errorf("expected no evictions and can add")
+	}
+	p.Add("key2", Value{Bytes: []byte{0}})
+	p.Add("key3", Value{Bytes: []byte{0}})
+	if p.Used() != 45 {
+		t.Errorf("expected 45 used bytes, received %d", p.Used())
+	}
+
+	// key1 is used most often, so the least recently used of the others goes
+	p.Touch("key1")
+	p.Touch("key1")
+	p.Touch("key3")
+	ev, sp = p.Add("key4", Value{Bytes: []byte{0}})
+	if len(ev) != 1 || ev[0] != "key2" {
+		t.Errorf("expected eviction of key2, received %v", ev)
+	}
+	if sp == false {
+		t.Errorf("expected can add")
+	}
+
+	// a new key evicts the least frequent, even if more recent
+	ev, _ = p.Add("key5", Value{Bytes: []byte{0}})
+	if len(ev) != 1 || ev[0] != "key4" {
+		t.Errorf("expected eviction of key4, received %v", ev)
+	}
+
+	// a large value evicts as many keys as it needs, least frequent first
+	ev, _ = p.Add("key6", Value{Bytes: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}})
+	if !reflect.DeepEqual(ev, []string{"key5", "key3"}) {
+		t.Errorf("expected eviction of key5 and key3, received %v", ev)
+	}
+	if p.Used() != 44 {
+		t.Errorf("expected 44 used bytes, received %d", p.Used())
+	}
+
+	ev, sp = p.Add("key7", Value{Bytes: make([]byte, 40)})
+	if ev != nil || sp == true {
+		t.Errorf("expected no evictions and cannot add")
+	}
+}
+
+func TestLfuScanResistance(t *testing.T) {
+	p := NewLfuEvictionPolicy(15*10, 0)
+	hot := []string{"hot1", "hot2", "hot3"}
+	for _, k := range hot {
+		p.Add(k, Value{Bytes: []byte{0}})
+		p.Touch(k)
+	}
+
+	// a scan of many keys used once never evicts the hot set
+	for i := 0; i < 100; i++ {
+		p.Add(fmt.Sprintf("s%02d", i), Value{Bytes: []byte{0, 0}})
+	}
+	for _, k := range hot {
+		if _, ok := p.kvMap[k]; !ok {
+			t.Errorf("expected %s to survive the scan", k)
+		}
+	}
+}
+
+func TestLfuOverwrite(t *testing.T) {
+	p := NewLfuEvictionPolicy(32, 0)
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+
+	// overwriting key1 keeps its node and counts as a use
+	ev, sp := p.Add("key1", Value{Bytes: []byte{1, 2}})
+	if ev != nil || sp == false {
+		t.Errorf("expected no evictions and can add")
+	}
+	if len(p.kvMap) != 2 {
+		t.Errorf("expected 2 elements in kvMap, received %d", len(p.kvMap))
+	}
+	if p.Used() != 31 {
+		t.Errorf("expected 31 used bytes, received %d", p.Used())
+	}
+	expectLfuOrder(t, p, []int{1, 2}, [][]string{{"key2"}, {"key1"}})
+
+	// growing the least frequent key evicts others, but never itself
+	p.Touch("key1")
+	ev, sp = p.Add("key2", Value{Bytes: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}})
+	if !reflect.DeepEqual(ev, []string{"key1"}) || sp == false {
+		t.Errorf("expected eviction of key1 and can add, received %v and %v", ev, sp)
+	}
+	expectLfuOrder(t, p, []int{2}, [][]string{{"key2"}})
+
+	// removing a key releases its bytes
+	p.Remove("key2")
+	if p.Used() != 0 {
+		t.Errorf("expected 0 used bytes, received %d", p.Used())
+	}
+}
+
+func TestLfuDecay(t *testing.T) {
+	p := NewLfuEvictionPolicy(64, 9)
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+	p.Add("key3", Value{Bytes: []byte{0}})
+	for i := 0; i < 4; i++ {
+		p.Touch("key1")
+	}
+	p.Touch("key2")
+	expectLfuOrder(t, p, []int{1, 2, 5}, [][]string{{"key3"}, {"key2"}, {"key1"}})
+
+	// the ninth access halves every frequency, merging the buckets of key2
+	// and key3 with key2 as the more recently used
+	p.Touch("key1")
+	expectLfuOrder(t, p, []int{1, 3}, [][]string{{"key2", "key3"}, {"key1"}})
+
+	// without decay, popularity never fades
+	p = NewLfuEvictionPolicy(64, 0)
+	p.Add("key1", Value{Bytes: []byte{0}})
+	for i := 0; i < 100; i++ {
+		p.Touch("key1")
+	}
+	expectLfuOrder(t, p, []int{101}, [][]string{{"key1"}})
+}
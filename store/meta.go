@@ -0,0 +1,261 @@
+package store
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// An ItemMeta holds the metadata of a stored Value exposed by the meta
+// protocol.
+type ItemMeta struct {
+	// Stale is true if the Value has been invalidated but is still served
+	// until a client recaches it.
+	Stale bool
+	// WinSent is true if a client has been handed the win token to
+	// recache the Value.
+	WinSent bool
+	// Fetched is true if the Value has been fetched since it was written.
+	Fetched bool
+	// LastAccess is the unix time in seconds the Value was last written
+	// or fetched.
+	LastAccess int64
+}
+
+// A MetaResult is the outcome of a meta operation.
+type MetaResult int
+
+const (
+	MetaOK MetaResult = iota
+	MetaNotStored
+	MetaExists
+	MetaNotFound
+)
+
+// A SetMode selects the storage operation a MetaSet performs.
+type SetMode int
+
+const (
+	SetModeSet SetMode = iota
+	SetModeAdd
+	SetModeReplace
+	SetModeAppend
+	SetModePrepend
+)
+
+// MetaGetOptions configures a MetaGet.
+type MetaGetOptions struct {
+	// Touch overwrites the expiry of a found Value with Expiry.
+	Touch  bool
+	Expiry int64
+
+	// Vivify creates an empty Value expiring at VivifyExpiry on a miss,
+	// handing the caller the win.
+	Vivify       bool
+	VivifyExpiry int64
+
+	// RecacheBelow hands the caller the win if the Value expires in fewer
+	// seconds. It is ignored if 0.
+	RecacheBelow int64
+}
+
+// MetaSetOptions configures a MetaSet.
+type MetaSetOptions struct {
+	Mode SetMode
+
+	// CompareCas only writes the Value if it matches the stored cas
+	// unique. It is ignored if 0.
+	CompareCas int64
+
+	// Invalidate writes the Value as stale, rather than failing, if
+	// CompareCas is older than the stored cas unique.
+	Invalidate bool
+}
+
+// MetaDeleteOptions configures a MetaDelete.
+type MetaDeleteOptions struct {
+	// CompareCas only deletes the Value if it matches the stored cas
+	// unique. It is ignored if 0.
+	CompareCas int64
+
+	// Invalidate marks the Value as stale instead of deleting it, so
+	// it is served until a client recaches it.
+	Invalidate bool
+
+	// Touch overwrites the expiry of an invalidated Value with Expiry.
+	Touch  bool
+	Expiry int64
+}
+
+// MetaArithmeticOptions configures a MetaArithmetic.
+type MetaArithmeticOptions struct {
+	Incr  bool
+	Delta uint64
+
+	// Vivify creates a Value holding Initial and expiring at VivifyExpiry
+	// on a miss.
+	Vivify       bool
+	Initial      uint64
+	VivifyExpiry int64
+
+	// CompareCas only writes the result if it matches the stored cas
+	// unique. It is ignored if 0.
+	CompareCas int64
+
+	// Touch overwrites the expiry of the result with Expiry.
+	Touch  bool
+	Expiry int64
+}
+
+func (s *SimpleStorageEngine) MetaGet(key string, opts MetaGetOptions) (value Value, meta ItemMeta, win, found bool) {
+	s.lock()
+	defer s.mu.Unlock()
+	s.stats.CmdGet++
+	it, found := s.lookupItem(key)
+	if !found {
+		s.stats.GetMisses++
+		if !opts.Vivify || !s.insertWithEvictions(key, Value{Expiry: opts.VivifyExpiry}) {
+			return
+		}
+		it = s.values[key]
+		it.WinSent = true
+		return it.Value, ItemMeta{}, true, true
+	}
+	s.stats.GetHits++
+	meta = it.ItemMeta
+	if opts.Touch {
+		s.stats.CmdTouch++
+		s.stats.TouchHits++
+		s.touch(key, it, opts.Expiry)
+	} else {
+		s.ep.Touch(key)
+	}
+	now := s.clock.Now().Unix()
+	if !it.WinSent && (it.Stale || opts.RecacheBelow > 0 && it.Expiry != 0 && it.Expiry-now < opts.RecacheBelow) {
+		it.WinSent = true
+		win = true
+	}
+	s.access(it)
+	return it.Value, meta, win, true
+}
+
+func (s *SimpleStorageEngine) MetaSet(key string, value Value, opts MetaSetOptions) (casUnique int64, result MetaResult) {
+	s.lock()
+	defer s.mu.Unlock()
+	s.stats.CmdSet++
+	it, found := s.lookupItem(key)
+	stale := false
+	if opts.CompareCas != 0 {
+		if !found {
+			s.stats.CasMisses++
+			return 0, MetaNotFound
+		}
+		if it.CasUnique != opts.CompareCas {
+			if !opts.Invalidate || opts.CompareCas > it.CasUnique {
+				s.stats.CasBadval++
+				return 0, MetaExists
+			}
+			// an invalidating write with an older cas is still written,
+			// but stale until it is recached
+			stale = true
+		}
+		s.stats.CasHits++
+	}
+	switch opts.Mode {
+	case SetModeAdd:
+		if found {
+			s.ep.Touch(key)
+			return 0, MetaNotStored
+		}
+	case SetModeReplace:
+		if !found {
+			return 0, MetaNotStored
+		}
+	case SetModeAppend, SetModePrepend:
+		if !found {
+			return 0, MetaNotStored
+		}
+		bytes := concat(it.Bytes, value.Bytes)
+		if opts.Mode == SetModePrepend {
+			bytes = concat(value.Bytes, it.Bytes)
+		}
+		value = Value{Flags: it.Flags, Bytes: bytes, Expiry: it.Expiry}
+	}
+	if !s.insertWithEvictions(key, value) {
+		return 0, MetaNotStored
+	}
+	it = s.values[key]
+	it.Stale = stale
+	return it.CasUnique, MetaOK
+}
+
+func (s *SimpleStorageEngine) MetaDelete(key string, opts MetaDeleteOptions) MetaResult {
+	s.lock()
+	defer s.mu.Unlock()
+	it, found := s.lookupItem(key)
+	if !found {
+		s.stats.DeleteMisses++
+		return MetaNotFound
+	}
+	if opts.CompareCas != 0 && opts.CompareCas != it.CasUnique {
+		return MetaExists
+	}
+	s.stats.DeleteHits++
+	if opts.Invalidate {
+		it.Stale = true
+		it.WinSent = false
+		it.CasUnique = atomic.AddInt64(s.casUnique, 1)
+		if opts.Touch {
+			s.touch(key, it, opts.Expiry)
+		}
+		return MetaOK
+	}
+	s.remove(key)
+	return MetaOK
+}
+
+func (s *SimpleStorageEngine) MetaArithmetic(key string, opts MetaArithmeticOptions) (value Value, result MetaResult, err error) {
+	s.lock()
+	defer s.mu.Unlock()
+	it, found := s.lookupItem(key)
+	s.countArithmetic(found, opts.Incr)
+	if !found {
+		if !opts.Vivify {
+			return Value{}, MetaNotFound, nil
+		}
+		value = Value{Bytes: strconv.AppendUint(nil, opts.Initial, 10), Expiry: opts.VivifyExpiry}
+	} else {
+		if opts.CompareCas != 0 && opts.CompareCas != it.CasUnique {
+			return Value{}, MetaExists, nil
+		}
+		n, perr := strconv.ParseUint(string(it.Bytes), 10, 64)
+		if perr != nil {
+			return Value{}, MetaNotStored, ErrNotNumeric
+		}
+		value = it.Value
+		value.Bytes = strconv.AppendUint(nil, applyDelta(n, opts.Delta, opts.Incr), 10)
+		if opts.Touch {
+			value.Expiry = opts.Expiry
+		}
+	}
+	if !s.insertWithEvictions(key, value) {
+		return Value{}, MetaNotStored, nil
+	}
+	return s.values[key].Value, MetaOK, nil
+}
+
+func (s *SimpleStorageEngine) MetaDebug(key string) (value Value, meta ItemMeta, found bool) {
+	s.lock()
+	defer s.mu.Unlock()
+	it, found := s.lookupItem(key)
+	if !found {
+		return
+	}
+	return it.Value, it.ItemMeta, true
+}
+
+// concat returns a new slice holding the bytes of a followed by b.
+func concat(a, b []byte) []byte {
+	c := make([]byte, 0, len(a)+len(b))
+	c = append(c, a...)
+	return append(c, b...)
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+// future is an absolute expiry that is never reached during the tests
+const future = 4000000000
+
+func expectMetaResultEquals(t *testing.T, exp, rec MetaResult) {
+	if exp != rec {
+		t.Errorf("expected meta result %v, received %v", exp, rec)
+	}
+}
+
+func testMetaGet(t *testing.T, s StorageEngine, clock *fakeClock) {
+	now := clock.Now()
+
+	// a miss with vivify creates an empty value and hands out the win once
+	_, _, win, found := s.MetaGet("key", MetaGetOptions{})
+	expectBoolEquals(t, false, found)
+	value, _, win, found := s.MetaGet("key", MetaGetOptions{Vivify: true, VivifyExpiry: Expiry(30, now)})
+	expectBoolEquals(t, true, found)
+	expectBoolEquals(t, true, win)
+	expectValueEquals(t, Value{CasUnique: value.CasUnique, Expiry: now.Unix() + 30}, value)
+	_, meta, win, found := s.MetaGet("key", MetaGetOptions{Vivify: true, VivifyExpiry: Expiry(30, now)})
+	expectBoolEquals(t, true, found)
+	expectBoolEquals(t, false, win)
+	expectBoolEquals(t, true, meta.WinSent)
+
+	// recache hands out the win when the value is about to expire
+	s.Set("key2", Value{Flags: 1, Bytes: []byte("value"), Expiry: Expiry(30, now)})
+	_, meta, win, _ = s.MetaGet("key2", MetaGetOptions{RecacheBelow: 10})
+	expectBoolEquals(t, false, win)
+	expectBoolEquals(t, false, meta.Fetched)
+	clock.Advance(25 * time.Second)
+	_, meta, win, _ = s.MetaGet("key2", MetaGetOptions{RecacheBelow: 10})
+	expectBoolEquals(t, true, win)
+	expectBoolEquals(t, true, meta.Fetched)
+	if meta.LastAccess != now.Unix() {
+		t.Errorf("expected last access %d, received %d", now.Unix(), meta.LastAccess)
+	}
+	_, meta, win, _ = s.MetaGet("key2", MetaGetOptions{RecacheBelow: 10})
+	expectBoolEquals(t, false, win)
+	expectBoolEquals(t, true, meta.WinSent)
+
+	// touching extends the expiry
+	value, _, _, _ = s.MetaGet("key2", MetaGetOptions{Touch: true, Expiry: clock.Now().Unix() + 100})
+	expectValueEquals(t, Value{Flags: 1, CasUnique: value.CasUnique, Bytes: []byte("value"), Expiry: clock.Now().Unix() + 100}, value)
+}
+
+func testMetaSetAndDelete(t *testing.T, s StorageEngine) {
+	_, result := s.MetaSet("key", Value{Flags: 1, Bytes: []byte("value")}, MetaSetOptions{Mode: SetModeReplace})
+	expectMetaResultEquals(t, MetaNotStored, result)
+	cas, result := s.MetaSet("key", Value{Flags: 1, Bytes: []byte("value")}, MetaSetOptions{Mode: SetModeAdd})
+	expectMetaResultEquals(t, MetaOK, result)
+	_, result = s.MetaSet("key", Value{Flags: 1, Bytes: []byte("other")}, MetaSetOptions{Mode: SetModeAdd})
+	expectMetaResultEquals(t, MetaNotStored, result)
+	cas, result = s.MetaSet("key", Value{Flags: 2, Bytes: []byte("_tail")}, MetaSetOptions{Mode: SetModeAppend, CompareCas: cas})
+	expectMetaResultEquals(t, MetaOK, result)
+	value, _ := s.Get("key")
+	expectValueEquals(t, Value{Flags: 1, CasUnique: cas, Bytes: []byte("value_tail")}, value)
+	_, result = s.MetaSet("key", Value{Flags: 1, Bytes: []byte("value")}, MetaSetOptions{CompareCas: cas + 100})
+	expectMetaResultEquals(t, MetaExists, result)
+	_, result = s.MetaSet("missing", Value{Flags: 1, Bytes: []byte("value")}, MetaSetOptions{CompareCas: cas})
+	expectMetaResultEquals(t, MetaNotFound, result)
+
+	// invalidating marks the value stale and hands out the win to one client
+	expectMetaResultEquals(t, MetaExists, s.MetaDelete("key", MetaDeleteOptions{CompareCas: cas + 100}))
+	expectMetaResultEquals(t, MetaOK, s.MetaDelete("key", MetaDeleteOptions{Invalidate: true, Touch: true, Expiry: future}))
+	value, meta, found := s.MetaDebug("key")
+	expectBoolEquals(t, true, found)
+	expectBoolEquals(t, true, meta.Stale)
+	expectValueEquals(t, Value{Flags: 1, CasUnique: value.CasUnique, Bytes: []byte("value_tail"), Expiry: future}, value)
+	if value.CasUnique <= cas {
+		t.Errorf("expected invalidation to bump the cas unique past %d, received %d", cas, value.CasUnique)
+	}
+	_, _, win, _ := s.MetaGet("key", MetaGetOptions{})
+	expectBoolEquals(t, true, win)
+	_, _, win, _ = s.MetaGet("key", MetaGetOptions{})
+	expectBoolEquals(t, false, win)
+
+	// an invalidating set with an older cas is written, but stays stale
+	cas, result = s.MetaSet("key", Value{Flags: 1, Bytes: []byte("old")}, MetaSetOptions{CompareCas: cas, Invalidate: true})
+	expectMetaResultEquals(t, MetaOK, result)
+	_, meta, _ = s.MetaDebug("key")
+	expectBoolEquals(t, true, meta.Stale)
+	expectBoolEquals(t, false, meta.WinSent)
+	_, result = s.MetaSet("key", Value{Flags: 1, Bytes: []byte("new")}, MetaSetOptions{CompareCas: cas})
+	expectMetaResultEquals(t, MetaOK, result)
+	_, meta, _ = s.MetaDebug("key")
+	expectBoolEquals(t, false, meta.Stale)
+
+	expectMetaResultEquals(t, MetaOK, s.MetaDelete("key", MetaDeleteOptions{}))
+	expectMetaResultEquals(t, MetaNotFound, s.MetaDelete("key", MetaDeleteOptions{}))
+}
+
+func testMetaArithmetic(t *testing.T, s StorageEngine) {
+	_, result, _ := s.MetaArithmetic("key", MetaArithmeticOptions{Incr: true, Delta: 1})
+	expectMetaResultEquals(t, MetaNotFound, result)
+	value, result, _ := s.MetaArithmetic("key", MetaArithmeticOptions{Incr: true, Delta: 1, Vivify: true, Initial: 10, VivifyExpiry: future})
+	expectMetaResultEquals(t, MetaOK, result)
+	expectValueEquals(t, Value{CasUnique: value.CasUnique, Bytes: []byte("10"), Expiry: future}, value)
+	value, result, _ = s.MetaArithmetic("key", MetaArithmeticOptions{Delta: 15, CompareCas: value.CasUnique, Touch: true, Expiry: future + 100})
+	expectMetaResultEquals(t, MetaOK, result)
+	expectValueEquals(t, Value{CasUnique: value.CasUnique, Bytes: []byte("0"), Expiry: future + 100}, value)
+	_, result, _ = s.MetaArithmetic("key", MetaArithmeticOptions{Incr: true, Delta: 1, CompareCas: value.CasUnique + 100})
+	expectMetaResultEquals(t, MetaExists, result)
+
+	s.Set("key2", Value{Bytes: []byte("abc")})
+	_, _, err := s.MetaArithmetic("key2", MetaArithmeticOptions{Incr: true, Delta: 1})
+	if err != ErrNotNumeric {
+		t.Errorf("expected ErrNotNumeric, received %v", err)
+	}
+}
+
+func TestSimpleStorageEngineMeta(t *testing.T) {
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	testMetaGet(t, NewSimpleStorageEngineWithClock(NewLruEvictionPolicy(1024), clock), clock)
+	testMetaSetAndDelete(t, NewSimpleStorageEngine(NewLruEvictionPolicy(1024)))
+	testMetaArithmetic(t, NewSimpleStorageEngine(NewLruEvictionPolicy(1024)))
+}
+
+func TestStripedLockingStorageEngineMeta(t *testing.T) {
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	testMetaGet(t, NewStripedLockingStorageEngine(4, 4096, newLruPolicy, clock), clock)
+	testMetaSetAndDelete(t, NewStripedLockingStorageEngine(4, 4096, newLruPolicy, SystemClock))
+	testMetaArithmetic(t, NewStripedLockingStorageEngine(4, 4096, newLruPolicy, SystemClock))
+}
@@ -0,0 +1,164 @@
+package store
+
+import (
+	"sync/atomic"
+)
+
+// s3FifoMaxFreq is the count at which the uses of a key saturate.
+const s3FifoMaxFreq = 3
+
+// A s3FifoEvictionPolicy is an S3-FIFO implementation of an EvictionPolicy
+// using three FIFO queues. New keys enter the small queue, holding about 10%
+// of the capacity. A key leaving the small queue moves to the main queue if
+// it was used while there, and is otherwise evicted and remembered, without
+// its value, in the ghost queue. A key in the main queue used since it was
+// last considered goes back to the front instead of being evicted. A new key
+// found in the ghost queue goes straight to the main queue.
+//
+// Using a key only increments its counter atomically, so unlike the LRU,
+// Touch never relinks the queues and can be called concurrently with other
+// calls to Touch, though not with Add or Remove.
+type s3FifoEvictionPolicy struct {
+	cap      int
+	smallCap int
+	small    *lruSegment
+	main     *lruSegment
+	ghost    *lruSegment
+	kvMap    map[string]*segmentNode // resident and ghost keys
+}
+
+func NewS3FifoEvictionPolicy(cap int) *s3FifoEvictionPolicy {
+	if cap < 0 {
+		cap = 0
+	}
+	return &s3FifoEvictionPolicy{
+		cap:      cap,
+		smallCap: cap / 10,
+		small:    newLruSegment(),
+		main:     newLruSegment(),
+		ghost:    newLruSegment(),
+		kvMap:    map[string]*segmentNode{},
+	}
+}
+
+func (l *s3FifoEvictionPolicy) Capacity() int {
+	return l.cap
+}
+
+func (l *s3FifoEvictionPolicy) Used() int {
+	return l.small.used + l.main.used
+}
+
+func (l *s3FifoEvictionPolicy) Touch(key string) bool {
+	node, ok := l.kvMap[key]
+	if !ok || node.seg == l.ghost {
+		return false
+	}
+	incrementFreq(node)
+	return true
+}
+
+// incrementFreq increments the uses of the node, up to s3FifoMaxFreq.
+func incrementFreq(node *segmentNode) {
+	for {
+		freq := atomic.LoadInt32(&node.freq)
+		if freq >= s3FifoMaxFreq || atomic.CompareAndSwapInt32(&node.freq, freq, freq+1) {
+			return
+		}
+	}
+}
+
+// evictSmall evicts the first key of the small queue not used while there,
+// moving those used to the main queue. It returns false if the small queue
+// empties first.
+func (l *s3FifoEvictionPolicy) evictSmall(evict *[]string) bool {
+	for node := l.small.back(); node != nil; node = l.small.back() {
+		l.small.unlink(node)
+		if node.freq > 0 {
+			node.freq = 0
+			l.main.pushFront(node)
+			continue
+		}
+		l.toGhost(node)
+		*evict = append(*evict, node.key)
+		return true
+	}
+	return false
+}
+
+// evictMain evicts the first key of the main queue not used since it was
+// last considered, moving those used back to the front with one use less.
+func (l *s3FifoEvictionPolicy) evictMain(evict *[]string) {
+	for node := l.main.back(); node != nil; node = l.main.back() {
+		l.main.unlink(node)
+		if node.freq > 0 {
+			node.freq--
+			l.main.pushFront(node)
+			continue
+		}
+		delete(l.kvMap, node.key)
+		*evict = append(*evict, node.key)
+		return
+	}
+}
+
+// toGhost remembers the evicted node in the ghost queue, which is bounded to
+// the capacity of the main queue.
+func (l *s3FifoEvictionPolicy) toGhost(node *segmentNode) {
+	node.val = Value{}
+	l.ghost.pushFront(node)
+	for l.ghost.used > l.cap-l.smallCap {
+		forgotten := l.ghost.back()
+		l.ghost.unlink(forgotten)
+		delete(l.kvMap, forgotten.key)
+	}
+}
+
+func (l *s3FifoEvictionPolicy) Add(key string, v Value) (evict []string, hasSpace bool) {
+	size := kvSize(key, v)
+	if size > l.cap {
+		hasSpace = false
+		return
+	}
+	hasSpace = true
+
+	// an existing key is a use, and leaves its queue while making room so
+	// it is not evicted itself
+	node, exists := l.kvMap[key]
+	seg := l.small
+	if exists {
+		if node.seg != l.ghost {
+			incrementFreq(node)
+			seg = node.seg
+		} else {
+			seg = l.main
+		}
+		node.seg.unlink(node)
+	}
+
+	// add evictions, if necessary
+	for l.Used()+size > l.cap {
+		if (l.small.used < l.smallCap && l.main.back() != nil) || !l.evictSmall(&evict) {
+			l.evictMain(&evict)
+		}
+	}
+
+	if !exists {
+		node = &segmentNode{key: key}
+		l.kvMap[key] = node
+	}
+	node.val = v
+	node.size = size
+	seg.pushFront(node)
+	return
+}
+
+func (l *s3FifoEvictionPolicy) Remove(key string) bool {
+	node, ok := l.kvMap[key]
+	if !ok || node.seg == l.ghost {
+		return false
+	}
+	delete(l.kvMap, key)
+	node.seg.unlink(node)
+	return true
+}
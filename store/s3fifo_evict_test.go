@@ -0,0 +1,175 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func expectQueues(t *testing.T, p *s3FifoEvictionPolicy, small, main, ghost []string) {
+	expected := [][]string{small, main, ghost}
+	received := [][]string{segmentKeys(p.small), segmentKeys(p.main), segmentKeys(p.ghost)}
+	if !reflect.DeepEqual(expected, received) {
+		t.Errorf("expected queues %v, received %v", expected, received)
+	}
+}
+
+func TestS3FifoTouchNonExisting(t *testing.T) {
+	p := NewS3FifoEvictionPolicy(16)
+	ok := p.Touch("non_existing")
+	if ok {
+		t.Errorf("expected unsuccessful touch")
+	}
+}
+
+func TestS3FifoTouchExisting(t *testing.T) {
+	p := NewS3FifoEvictionPolicy(64)
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+
+	// touching only counts uses, up to the maximum, without reordering
+	for i := 0; i < 5; i++ {
+		if ok := p.Touch("key1"); !ok {
+			t.Errorf("expected successful touch")
+		}
+	}
+	expectQueues(t, p, []string{"key2", "key1"}, []string{}, []string{})
+	if freq := p.kvMap["key1"].freq; freq != s3FifoMaxFreq {
+		t.Errorf("expected %d uses, received %d", s3FifoMaxFreq, freq)
+	}
+}
+
+func TestS3FifoConcurrentTouch(t *testing.T) {
+	p := NewS3FifoEvictionPolicy(64)
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Touch("key1")
+			p.Touch("key2")
+		}()
+	}
+	wg.Wait()
+	if p.kvMap["key1"].freq != s3FifoMaxFreq || p.kvMap["key2"].freq != s3FifoMaxFreq {
+		t.Errorf("expected %d uses of each key", s3FifoMaxFreq)
+	}
+}
+
+func TestS3FifoDelete(t *testing.T) {
+	p := NewS3FifoEvictionPolicy(30)
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+	p.Add("key3", Value{Bytes: []byte{0}})
+
+	// ghosts are not managed, as they are not stored
+	if p.Remove("unknown") || p.Remove("key1") || p.Touch("key1") {
+		t.Errorf("expected the ghost key1 not to be managed")
+	}
+
+	p.Remove("key2")
+	p.Remove("key3")
+	if p.Used() != 0 {
+		t.Errorf("expected 0 used bytes, received %d", p.Used())
+	}
+	expectQueues(t, p, []string{}, []string{}, []string{"key1"})
+}
+
+func TestS3FifoEviction(t *testing.T) {
+	p := NewS3FifoEvictionPolicy(15 * 20)
+	for i := 0; i < 20; i++ {
+		ev, sp := p.Add(fmt.Sprintf("k%03d", i), Value{Bytes: []byte{0}})
+		if ev != nil || sp == false {
+			t.Errorf("expected no evictions and can add")
+		}
+	}
+	for i := 0; i < 17; i++ {
+		p.Touch(fmt.Sprintf("k%03d", i))
+	}
+
+	// the keys used in the small queue move to the main queue
+	ev, _ := p.Add("k020", Value{Bytes: []byte{0}})
+	if !reflect.DeepEqual(ev, []string{"k017"}) {
+		t.Errorf("expected eviction of k017, received %v", ev)
+	}
+	expectQueues(t, p, []string{"k020", "k019", "k018"}, segmentKeys(p.main), []string{"k017"})
+	if len(segmentKeys(p.main)) != 17 {
+		t.Errorf("expected 17 keys in the main queue, received %v", segmentKeys(p.main))
+	}
+
+	// emptying the small queue evicts from the main queue
+	p.Touch("k018")
+	p.Touch("k019")
+	p.Touch("k020")
+	ev, _ = p.Add("k021", Value{Bytes: []byte{0}})
+	if !reflect.DeepEqual(ev, []string{"k000"}) {
+		t.Errorf("expected eviction of k000, received %v", ev)
+	}
+
+	// a key used in the main queue is given another pass
+	p.Touch("k001")
+	ev, _ = p.Add("k022", Value{Bytes: []byte{0}})
+	if !reflect.DeepEqual(ev, []string{"k002"}) {
+		t.Errorf("expected eviction of k002, received %v", ev)
+	}
+	if main := segmentKeys(p.main); main[0] != "k001" {
+		t.Errorf("expected k001 at the front of the main queue, received %v", main)
+	}
+
+	// a key remembered by the ghost queue goes straight to the main queue
+	ev, _ = p.Add("k017", Value{Bytes: []byte{0}})
+	if !reflect.DeepEqual(ev, []string{"k021"}) {
+		t.Errorf("expected eviction of k021, received %v", ev)
+	}
+	if main := segmentKeys(p.main); main[0] != "k017" {
+		t.Errorf("expected k017 at the front of the main queue, received %v", main)
+	}
+	expectQueues(t, p, []string{"k022"}, segmentKeys(p.main), []string{"k021"})
+	if p.Used() != 300 {
+		t.Errorf("expected 300 used bytes, received %d", p.Used())
+	}
+
+	ev, sp := p.Add("big", Value{Bytes: make([]byte, 300)})
+	if ev != nil || sp == true {
+		t.Errorf("expected no evictions and cannot add")
+	}
+}
+
+func TestS3FifoOverwrite(t *testing.T) {
+	p := NewS3FifoEvictionPolicy(30)
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+
+	// growing a key evicts others, but never itself
+	ev, sp := p.Add("key1", Value{Bytes: []byte{1, 2}})
+	if !reflect.DeepEqual(ev, []string{"key2"}) || sp == false {
+		t.Errorf("expected eviction of key2 and can add, received %v and %v", ev, sp)
+	}
+	if p.Used() != 16 || p.kvMap["key1"].freq != 1 {
+		t.Errorf("expected 16 used bytes and 1 use, received %d and %d", p.Used(), p.kvMap["key1"].freq)
+	}
+	expectQueues(t, p, []string{"key1"}, []string{}, []string{"key2"})
+
+	// removing a key releases its bytes
+	p.Remove("key1")
+	if p.Used() != 0 {
+		t.Errorf("expected 0 used bytes, received %d", p.Used())
+	}
+}
+
+func TestS3FifoGhostBounds(t *testing.T) {
+	p := NewS3FifoEvictionPolicy(15 * 10)
+	for i := 0; i < 100; i++ {
+		p.Add(fmt.Sprintf("s%02d", i), Value{Bytes: []byte{0, 0}})
+		if p.Used() > p.cap || p.ghost.used > p.cap-p.smallCap {
+			t.Fatalf("expected queues within capacity, received %d used and %d ghost bytes", p.Used(), p.ghost.used)
+		}
+	}
+	if len(p.kvMap) > 19 {
+		t.Errorf("expected at most 19 keys remembered, received %d", len(p.kvMap))
+	}
+}
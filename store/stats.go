@@ -0,0 +1,82 @@
+package store
+
+// sizeBucket is the granularity, in bytes, of the item size histogram.
+const sizeBucket = 32
+
+// EngineStats holds the counters and gauges reported by a StorageEngine.
+// The counters follow the meaning of their memcache stats counterparts.
+type EngineStats struct {
+	// counters
+	CmdGet       uint64
+	CmdSet       uint64
+	CmdTouch     uint64
+	CmdFlush     uint64
+	GetHits      uint64
+	GetMisses    uint64
+	DeleteHits   uint64
+	DeleteMisses uint64
+	IncrHits     uint64
+	IncrMisses   uint64
+	DecrHits     uint64
+	DecrMisses   uint64
+	CasHits      uint64
+	CasMisses    uint64
+	CasBadval    uint64
+	TouchHits    uint64
+	TouchMisses  uint64
+	TotalItems   uint64
+	Evictions    uint64
+	Reclaimed    uint64
+	NotAdmitted  uint64
+
+	// gauges
+	CurrItems     uint64
+	Bytes         uint64
+	LimitMaxbytes uint64
+	// ArcP is the target of an AdaptiveEvictionPolicy, summed over the
+	// shards of a StripedLockingStorageEngine.
+	ArcP uint64
+
+	// Adaptive is true if the EvictionPolicy reports ArcP, and Admission
+	// if it may decline to admit keys, counted by NotAdmitted.
+	Adaptive  bool
+	Admission bool
+}
+
+// add accumulates the counters and gauges of o into e.
+func (e *EngineStats) add(o EngineStats) {
+	e.CmdGet += o.CmdGet
+	e.CmdSet += o.CmdSet
+	e.CmdTouch += o.CmdTouch
+	e.CmdFlush += o.CmdFlush
+	e.GetHits += o.GetHits
+	e.GetMisses += o.GetMisses
+	e.DeleteHits += o.DeleteHits
+	e.DeleteMisses += o.DeleteMisses
+	e.IncrHits += o.IncrHits
+	e.IncrMisses += o.IncrMisses
+	e.DecrHits += o.DecrHits
+	e.DecrMisses += o.DecrMisses
+	e.CasHits += o.CasHits
+	e.CasMisses += o.CasMisses
+	e.CasBadval += o.CasBadval
+	e.TouchHits += o.TouchHits
+	e.TouchMisses += o.TouchMisses
+	e.TotalItems += o.TotalItems
+	e.Evictions += o.Evictions
+	e.Reclaimed += o.Reclaimed
+	e.NotAdmitted += o.NotAdmitted
+	e.CurrItems += o.CurrItems
+	e.Bytes += o.Bytes
+	e.LimitMaxbytes += o.LimitMaxbytes
+	e.ArcP += o.ArcP
+	e.Adaptive = e.Adaptive || o.Adaptive
+	e.Admission = e.Admission || o.Admission
+}
+
+// sizeBucketOf returns the histogram bucket of the key and value, which is
+// their size rounded up to the nearest multiple of sizeBucket.
+func sizeBucketOf(key string, val Value) int {
+	size := kvSize(key, val)
+	return (size + sizeBucket - 1) / sizeBucket * sizeBucket
+}
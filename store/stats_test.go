@@ -0,0 +1,132 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testStats(t *testing.T, s StorageEngine) {
+	s.Set("key1", Value{Bytes: []byte("1")})
+	s.Add("key1", Value{Bytes: []byte("1")})
+	s.Get("key1")
+	s.Get("key2")
+	s.Cas("key1", Value{CasUnique: 100, Bytes: []byte("2")})
+	s.Cas("key1", Value{CasUnique: 1, Bytes: []byte("2")})
+	s.Cas("key2", Value{CasUnique: 1, Bytes: []byte("2")})
+	s.IncrDecr("key1", 1, true)
+	s.IncrDecr("key2", 1, false)
+	s.Touch("key1", 0)
+	s.Touch("key2", 0)
+	s.Set("key2", Value{Bytes: []byte("value")})
+	s.Delete("key2")
+	s.Delete("key2")
+
+	expected := EngineStats{
+		CmdGet:        2,
+		CmdSet:        6,
+		CmdTouch:      2,
+		GetHits:       1,
+		GetMisses:     1,
+		DeleteHits:    1,
+		DeleteMisses:  1,
+		IncrHits:      1,
+		DecrMisses:    1,
+		CasHits:       1,
+		CasMisses:     1,
+		CasBadval:     1,
+		TouchHits:     1,
+		TouchMisses:   1,
+		TotalItems:    4,
+		CurrItems:     1,
+		Bytes:         uint64(kvSize("key1", Value{Bytes: []byte("3")})),
+		LimitMaxbytes: 4096,
+	}
+	if stats := s.Stats(); !reflect.DeepEqual(expected, stats) {
+		t.Errorf("expected stats %+v, received %+v", expected, stats)
+	}
+
+	s.FlushAll(0)
+	stats := s.Stats()
+	if stats.CurrItems != 0 || stats.Bytes != 0 {
+		t.Errorf("expected no items or bytes after flush, received %d and %d", stats.CurrItems, stats.Bytes)
+	}
+}
+
+func testSizeHistogram(t *testing.T, s StorageEngine) {
+	s.Set("key1", Value{Bytes: make([]byte, 1)})
+	s.Set("key2", Value{Bytes: make([]byte, 18)})
+	s.Set("key3", Value{Bytes: make([]byte, 19)})
+	s.Set("key4", Value{Bytes: make([]byte, 100)})
+
+	expected := map[int]uint64{32: 2, 64: 1, 128: 1}
+	if sizes := s.SizeHistogram(); !reflect.DeepEqual(expected, sizes) {
+		t.Errorf("expected sizes %v, received %v", expected, sizes)
+	}
+}
+
+func TestSimpleStorageEngineStats(t *testing.T) {
+	testStats(t, NewSimpleStorageEngine(NewLruEvictionPolicy(4096)))
+	testSizeHistogram(t, NewSimpleStorageEngine(NewLruEvictionPolicy(4096)))
+}
+
+func TestStripedLockingStorageEngineStats(t *testing.T) {
+	testStats(t, NewStripedLockingStorageEngine(4, 4096, newLruPolicy, SystemClock))
+	testSizeHistogram(t, NewStripedLockingStorageEngine(4, 4096, newLruPolicy, SystemClock))
+}
+
+func TestEvictionStats(t *testing.T) {
+	s := NewSimpleStorageEngine(NewLruEvictionPolicy(32))
+	s.Set("key1", Value{Bytes: []byte{0}})
+	s.Set("key2", Value{Bytes: []byte{0}})
+	s.Set("key3", Value{Bytes: []byte{0}})
+	if stats := s.Stats(); stats.Evictions != 1 || stats.CurrItems != 2 {
+		t.Errorf("expected 1 eviction and 2 items, received %d and %d", stats.Evictions, stats.CurrItems)
+	}
+}
+
+func TestNotAdmittedStats(t *testing.T) {
+	s := NewSimpleStorageEngine(newTinyLfuEvictionPolicy(30, 0, 0, 1<<16))
+	s.Set("key1", Value{Bytes: []byte{0}})
+	s.Set("key2", Value{Bytes: []byte{0}})
+
+	// a key used once is not admitted over the keys already stored
+	if s.Set("key3", Value{Bytes: []byte{0}}) {
+		t.Errorf("expected key3 not to be admitted")
+	}
+	if _, ok := s.Get("key3"); ok {
+		t.Errorf("expected key3 to miss")
+	}
+	if stats := s.Stats(); stats.NotAdmitted != 1 || stats.Evictions != 0 || stats.CurrItems != 2 {
+		t.Errorf("expected 1 not admitted, 0 evictions and 2 items, received %d, %d and %d", stats.NotAdmitted, stats.Evictions, stats.CurrItems)
+	}
+	if stats := s.Stats(); !stats.Admission || stats.Adaptive {
+		t.Errorf("expected only admission to be reported")
+	}
+
+	// used again, it is admitted over the least recently used
+	if !s.Set("key3", Value{Bytes: []byte{0}}) {
+		t.Errorf("expected key3 to be admitted")
+	}
+	if stats := s.Stats(); stats.NotAdmitted != 1 || stats.Evictions != 1 || stats.CurrItems != 2 {
+		t.Errorf("expected 1 not admitted, 1 eviction and 2 items, received %d, %d and %d", stats.NotAdmitted, stats.Evictions, stats.CurrItems)
+	}
+}
+
+func TestArcStats(t *testing.T) {
+	s := NewSimpleStorageEngine(NewArcEvictionPolicy(60))
+	for _, k := range []string{"key1", "key2", "key3", "key4"} {
+		s.Set(k, Value{Bytes: []byte{0}})
+	}
+	s.Get("key1")
+	s.Get("key2")
+	s.Set("key5", Value{Bytes: []byte{0}})
+
+	// setting the evicted key3 again grows the target for keys used once
+	s.Set("key3", Value{Bytes: []byte{0}})
+	if stats := s.Stats(); stats.ArcP != 15 || stats.Evictions != 2 {
+		t.Errorf("expected arc_p of 15 and 2 evictions, received %d and %d", stats.ArcP, stats.Evictions)
+	}
+	if stats := s.Stats(); !stats.Adaptive || stats.Admission {
+		t.Errorf("expected only the adaptive target to be reported")
+	}
+}
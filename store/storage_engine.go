@@ -1,16 +1,60 @@
 package store
 
 import (
+	"errors"
 	"github.com/golang/glog"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrNotNumeric is returned when incrementing or decrementing a Value
+// whose bytes are not a 64 bit unsigned decimal integer.
+var ErrNotNumeric = errors.New("cannot increment or decrement non-numeric value")
+
+// maxRelativeExpTime is the largest exptime, in seconds, treated as relative
+// to the current time rather than as an absolute unix timestamp.
+const maxRelativeExpTime = 60 * 60 * 24 * 30
+
 // A Value represents a stored value, including the raw bytes,
-// flags, and cas_unique.
+// flags, cas_unique, and expiry. The Expiry is the absolute unix
+// time in seconds at which the Value expires, or 0 if it never
+// expires.
 type Value struct {
 	Flags     uint16
 	CasUnique int64
 	Bytes     []byte
+	Expiry    int64
+}
+
+// Expired returns true if and only if the Value has an expiry
+// that is not after the given time.
+func (v Value) Expired(now time.Time) bool {
+	return v.Expiry != 0 && v.Expiry <= now.Unix()
+}
+
+// An item is a stored Value along with its metadata.
+type item struct {
+	Value
+	ItemMeta
+}
+
+// Expiry converts a memcache exptime into an absolute Value.Expiry given
+// the current time. An exptime of 0 never expires, exptimes up to 30 days
+// are relative seconds from now, larger exptimes are absolute unix
+// timestamps, and negative exptimes are already expired.
+func Expiry(expTime int64, now time.Time) int64 {
+	switch {
+	case expTime == 0:
+		return 0
+	case expTime < 0:
+		return now.Unix()
+	case expTime <= maxRelativeExpTime:
+		return now.Unix() + expTime
+	default:
+		return expTime
+	}
 }
 
 // StorageEngine defines the operations of a generic in-memory
@@ -20,8 +64,30 @@ type StorageEngine interface {
 	// true if and only if the value is successfully written.
 	Set(key string, value Value) (ok bool)
 
+	// Add writes the Value in the store if and only if the key
+	// does not already exist, returning true if and only if the
+	// value is successfully written.
+	Add(key string, value Value) (ok bool)
+
+	// Replace overwrites the Value in the store if and only if the
+	// key already exists, returning true if and only if the value
+	// is successfully written.
+	Replace(key string, value Value) (ok bool)
+
+	// Append adds the bytes of the Value to the end of the existing
+	// Value's bytes, keeping the existing flags. It returns true if
+	// and only if the key exists and the value is successfully written.
+	Append(key string, value Value) (ok bool)
+
+	// Prepend adds the bytes of the Value to the beginning of the
+	// existing Value's bytes, keeping the existing flags. It returns
+	// true if and only if the key exists and the value is successfully
+	// written.
+	Prepend(key string, value Value) (ok bool)
+
 	// Get returns the Value requested by the key along with
 	// a boolean indicating if the Value is found in the store.
+	// Expired Values are never found.
 	Get(key string) (value Value, found bool)
 
 	// Cas overwrites a Value in the store if and only if the
@@ -38,12 +104,85 @@ type StorageEngine interface {
 	// Delete deletes the Value mapped to by the key, returning true
 	// if and only if the key exists and the item is properly deleted.
 	Delete(key string) bool
+
+	// IncrDecr treats the bytes of the Value mapped to by the key as a
+	// 64 bit unsigned decimal integer and increments it by delta if incr
+	// is true, otherwise decrements it by delta. Incrementing wraps around
+	// on overflow and decrementing stops at 0. The new value is written
+	// back keeping the existing flags and expiry, and returned along with
+	// a boolean indicating if the key is found. ErrNotNumeric is returned
+	// if the existing bytes are not a number.
+	IncrDecr(key string, delta uint64, incr bool) (value uint64, found bool, err error)
+
+	// Touch overwrites the expiry of the Value mapped to by the key
+	// without changing its cas unique, and marks the key as recently
+	// used. It returns the updated Value along with a boolean indicating
+	// if the Value is found in the store.
+	Touch(key string, expiry int64) (value Value, found bool)
+
+	// FlushAll invalidates every Value in the store as of the given
+	// absolute unix time in seconds. If the time is not after the
+	// current time, every Value is invalidated immediately. Otherwise
+	// the flush happens lazily once that time is reached, so Values
+	// written after that time survive. A later call replaces a pending
+	// flush.
+	FlushAll(at int64)
+
+	// Stats returns the engine's current counters and gauges.
+	Stats() EngineStats
+
+	// Clock returns the Clock the engine expires Values by.
+	Clock() Clock
+
+	// SizeHistogram returns the number of stored Values by size,
+	// including keys, rounded up to the nearest 32 bytes.
+	SizeHistogram() map[int]uint64
+
+	// MetaGet returns the Value mapped to by the key like Get, applying
+	// the options of a meta get. The returned ItemMeta is that of the
+	// item before this access, and win is true if and only if the caller
+	// has been handed the token to recache the Value.
+	MetaGet(key string, opts MetaGetOptions) (value Value, meta ItemMeta, win, found bool)
+
+	// MetaSet writes the Value according to the options, returning the
+	// cas unique of the written Value and the MetaResult.
+	MetaSet(key string, value Value, opts MetaSetOptions) (casUnique int64, result MetaResult)
+
+	// MetaDelete deletes or invalidates the Value mapped to by the key
+	// according to the options.
+	MetaDelete(key string, opts MetaDeleteOptions) MetaResult
+
+	// MetaArithmetic increments or decrements the Value mapped to by the
+	// key like IncrDecr, according to the options. It returns the new
+	// Value holding the decimal result.
+	MetaArithmetic(key string, opts MetaArithmeticOptions) (value Value, result MetaResult, err error)
+
+	// MetaDebug returns the Value and ItemMeta mapped to by the key
+	// without counting as an access.
+	MetaDebug(key string) (value Value, meta ItemMeta, found bool)
 }
 
 // NewSimpleStorageEngine takes an EvictionPolicy and returns a
 // SimpleStorageEngine configured with that eviction policy.
 func NewSimpleStorageEngine(ep EvictionPolicy) *SimpleStorageEngine {
-	return &SimpleStorageEngine{map[string]Value{}, ep, 0, sync.Mutex{}}
+	return NewSimpleStorageEngineWithClock(ep, SystemClock)
+}
+
+// NewSimpleStorageEngineWithClock returns a SimpleStorageEngine configured
+// with the eviction policy that expires Values according to the clock.
+func NewSimpleStorageEngineWithClock(ep EvictionPolicy, clock Clock) *SimpleStorageEngine {
+	return newSimpleStorageEngine(ep, clock, new(int64))
+}
+
+// newSimpleStorageEngine returns a SimpleStorageEngine drawing cas uniques
+// from the given counter, which may be shared with other engines.
+func newSimpleStorageEngine(ep EvictionPolicy, clock Clock, casUnique *int64) *SimpleStorageEngine {
+	return &SimpleStorageEngine{
+		values:    map[string]*item{},
+		ep:        ep,
+		casUnique: casUnique,
+		clock:     clock,
+	}
 }
 
 // A SimpleStorageEngine is coarsely locked StorageEngine. To
@@ -57,56 +196,214 @@ func NewSimpleStorageEngine(ep EvictionPolicy) *SimpleStorageEngine {
 // simply using RWLock here without a proper write lock on the
 // EvictionPolicy may improve performance, but it could cause contention
 type SimpleStorageEngine struct {
-	values       map[string]Value
-	ep           EvictionPolicy
-	curCasUnique int64
-	mu           sync.Mutex
+	values    map[string]*item
+	ep        EvictionPolicy
+	casUnique *int64
+	clock     Clock
+	expiries  expiryHeap
+	flushAt   int64
+	stats     EngineStats
+	mu        sync.Mutex
+}
+
+// lock acquires the engine's lock and applies a pending flush if it is due,
+// so that every operation observes the flush before touching any Value.
+func (s *SimpleStorageEngine) lock() {
+	s.mu.Lock()
+	if s.flushAt != 0 && s.clock.Now().Unix() >= s.flushAt {
+		s.flush()
+	}
+}
+
+// flush removes every Value from the store and the EvictionPolicy.
+func (s *SimpleStorageEngine) flush() {
+	glog.Infof("flushing %d keys", len(s.values))
+	for k := range s.values {
+		s.ep.Remove(k)
+	}
+	s.values = map[string]*item{}
+	s.expiries = nil
+	s.flushAt = 0
+}
+
+// lookup returns the Value mapped to by the key. An expired Value
+// is treated as missing and is removed from the store, releasing
+// its space in the EvictionPolicy.
+func (s *SimpleStorageEngine) lookup(key string) (value Value, found bool) {
+	it, found := s.lookupItem(key)
+	if !found {
+		return Value{}, false
+	}
+	return it.Value, true
+}
+
+// lookupItem is lookup returning the stored item, which may be modified
+// in place.
+func (s *SimpleStorageEngine) lookupItem(key string) (it *item, found bool) {
+	it, found = s.values[key]
+	if found && it.Expired(s.clock.Now()) {
+		glog.V(2).Infof("expiring key '%s'", key)
+		s.remove(key)
+		s.stats.Reclaimed++
+		return nil, false
+	}
+	return
+}
+
+// access marks the item as fetched now.
+func (s *SimpleStorageEngine) access(it *item) {
+	it.Fetched = true
+	it.LastAccess = s.clock.Now().Unix()
+}
+
+func (s *SimpleStorageEngine) remove(key string) {
+	s.ep.Remove(key)
+	delete(s.values, key)
 }
 
 func (s *SimpleStorageEngine) insertWithEvictions(key string, value Value) bool {
 	evict, ok := s.ep.Add(key, value)
+	for _, e := range evict {
+		if it, ok := s.values[e]; ok {
+			glog.Infof("evicting key '%s' (%d bytes)", e, kvSize(e, it.Value))
+			delete(s.values, e)
+		}
+	}
+	s.stats.Evictions += uint64(len(evict))
 	if !ok {
-		glog.Warning("value exceeds total cache capacity")
+		if kvSize(key, value) > s.ep.Capacity() {
+			glog.Warning("value exceeds total cache capacity")
+			return false
+		}
+		// the policy prefers the keys it has, dropping any old value
+		glog.Infof("not admitting key '%s'", key)
+		delete(s.values, key)
+		s.stats.NotAdmitted++
 		return false
 	}
-	for _, e := range evict {
-		v := s.values[e]
-		glog.Infof("evicting key '%s' (%d bytes)", e, kvSize(e, v))
-		delete(s.values, e)
-	}
+	s.stats.TotalItems++
 
-	s.curCasUnique++
-	value.CasUnique = s.curCasUnique
-	s.values[key] = value
+	value.CasUnique = atomic.AddInt64(s.casUnique, 1)
+	s.values[key] = &item{Value: value, ItemMeta: ItemMeta{LastAccess: s.clock.Now().Unix()}}
+	s.pushExpiry(key, value.Expiry)
 	return true
 }
 
+// pushExpiry records the key's new expiry, rebuilding the expiry heap once
+// stale entries outnumber the stored values.
+func (s *SimpleStorageEngine) pushExpiry(key string, expiry int64) {
+	s.expiries.push(key, expiry)
+	if s.expiries.Len() > 2*len(s.values)+minExpiryCompaction {
+		s.expiries = newExpiryHeap(s.values)
+	}
+}
+
+// ReapExpired pops at most max entries from the expiry heap, removing
+// the Values that have expired. It returns the number of Values removed
+// and whether more entries are due.
+func (s *SimpleStorageEngine) ReapExpired(max int) (reaped int, more bool) {
+	s.lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	for i := 0; i < max; i++ {
+		e, ok := s.expiries.popExpired(now.Unix())
+		if !ok {
+			return reaped, false
+		}
+		if v, found := s.values[e.key]; found && v.Expired(now) {
+			s.remove(e.key)
+			s.stats.Reclaimed++
+			reaped++
+		}
+	}
+	_, more = s.expiries.peekExpired(now.Unix())
+	return
+}
+
 func (s *SimpleStorageEngine) Set(key string, value Value) bool {
-	s.mu.Lock()
+	s.lock()
+	defer s.mu.Unlock()
+	s.stats.CmdSet++
+	return s.insertWithEvictions(key, value)
+}
+
+func (s *SimpleStorageEngine) Add(key string, value Value) bool {
+	s.lock()
 	defer s.mu.Unlock()
+	s.stats.CmdSet++
+	if _, ok := s.lookup(key); ok {
+		s.ep.Touch(key)
+		return false
+	}
+	return s.insertWithEvictions(key, value)
+}
+
+func (s *SimpleStorageEngine) Replace(key string, value Value) bool {
+	s.lock()
+	defer s.mu.Unlock()
+	s.stats.CmdSet++
+	if _, ok := s.lookup(key); !ok {
+		return false
+	}
 	return s.insertWithEvictions(key, value)
 }
 
+func (s *SimpleStorageEngine) Append(key string, value Value) bool {
+	s.lock()
+	defer s.mu.Unlock()
+	s.stats.CmdSet++
+	existing, ok := s.lookup(key)
+	if !ok {
+		return false
+	}
+	existing.Bytes = concat(existing.Bytes, value.Bytes)
+	return s.insertWithEvictions(key, existing)
+}
+
+func (s *SimpleStorageEngine) Prepend(key string, value Value) bool {
+	s.lock()
+	defer s.mu.Unlock()
+	s.stats.CmdSet++
+	existing, ok := s.lookup(key)
+	if !ok {
+		return false
+	}
+	existing.Bytes = concat(value.Bytes, existing.Bytes)
+	return s.insertWithEvictions(key, existing)
+}
+
 func (s *SimpleStorageEngine) Get(key string) (value Value, found bool) {
-	s.mu.Lock()
+	s.lock()
 	defer s.mu.Unlock()
-	value, found = s.values[key]
+	it, found := s.lookupItem(key)
 	s.ep.Touch(key)
+	s.stats.CmdGet++
+	if found {
+		s.stats.GetHits++
+		s.access(it)
+		value = it.Value
+	} else {
+		s.stats.GetMisses++
+	}
 	return
 }
 
 func (s *SimpleStorageEngine) Cas(key string, value Value) (exists, notFound bool) {
-	s.mu.Lock()
+	s.lock()
 	defer s.mu.Unlock()
-	val, ok := s.values[key]
+	s.stats.CmdSet++
+	val, ok := s.lookup(key)
 	if !ok {
+		s.stats.CasMisses++
 		notFound = true
 		return
 	}
 	if val.CasUnique != value.CasUnique {
+		s.stats.CasBadval++
 		exists = true
 		return
 	}
+	s.stats.CasHits++
 
 	// TODO: handle error on out of space?
 	s.insertWithEvictions(key, value)
@@ -114,10 +411,118 @@ func (s *SimpleStorageEngine) Cas(key string, value Value) (exists, notFound boo
 }
 
 func (s *SimpleStorageEngine) Delete(key string) bool {
-	s.mu.Lock()
+	s.lock()
 	defer s.mu.Unlock()
-	_, ok := s.values[key]
-	s.ep.Remove(key)
-	delete(s.values, key)
+	_, ok := s.lookup(key)
+	s.remove(key)
+	if ok {
+		s.stats.DeleteHits++
+	} else {
+		s.stats.DeleteMisses++
+	}
 	return ok
 }
+
+func (s *SimpleStorageEngine) IncrDecr(key string, delta uint64, incr bool) (value uint64, found bool, err error) {
+	s.lock()
+	defer s.mu.Unlock()
+	existing, found := s.lookup(key)
+	s.countArithmetic(found, incr)
+	if !found {
+		return
+	}
+	value, err = strconv.ParseUint(string(existing.Bytes), 10, 64)
+	if err != nil {
+		err = ErrNotNumeric
+		return
+	}
+	value = applyDelta(value, delta, incr)
+	existing.Bytes = strconv.AppendUint(nil, value, 10)
+	s.insertWithEvictions(key, existing)
+	return
+}
+
+func (s *SimpleStorageEngine) countArithmetic(found, incr bool) {
+	switch {
+	case found && incr:
+		s.stats.IncrHits++
+	case found && !incr:
+		s.stats.DecrHits++
+	case !found && incr:
+		s.stats.IncrMisses++
+	default:
+		s.stats.DecrMisses++
+	}
+}
+
+// applyDelta increments value by delta, wrapping around on overflow, if
+// incr is true, otherwise decrements it by delta, stopping at 0.
+func applyDelta(value, delta uint64, incr bool) uint64 {
+	if incr {
+		return value + delta
+	} else if delta > value {
+		return 0
+	}
+	return value - delta
+}
+
+func (s *SimpleStorageEngine) Touch(key string, expiry int64) (value Value, found bool) {
+	s.lock()
+	defer s.mu.Unlock()
+	it, found := s.lookupItem(key)
+	s.stats.CmdTouch++
+	if !found {
+		s.stats.TouchMisses++
+		return
+	}
+	s.stats.TouchHits++
+	s.touch(key, it, expiry)
+	return it.Value, true
+}
+
+// touch overwrites the item's expiry and marks the key as recently used.
+func (s *SimpleStorageEngine) touch(key string, it *item, expiry int64) {
+	it.Expiry = expiry
+	s.pushExpiry(key, expiry)
+	s.ep.Touch(key)
+}
+
+func (s *SimpleStorageEngine) FlushAll(at int64) {
+	s.lock()
+	defer s.mu.Unlock()
+	s.stats.CmdFlush++
+	if at <= s.clock.Now().Unix() {
+		s.flush()
+		return
+	}
+	s.flushAt = at
+}
+
+func (s *SimpleStorageEngine) Stats() EngineStats {
+	s.lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.CurrItems = uint64(len(s.values))
+	stats.Bytes = uint64(s.ep.Used())
+	stats.LimitMaxbytes = uint64(s.ep.Capacity())
+	if ep, ok := s.ep.(AdaptiveEvictionPolicy); ok {
+		stats.ArcP = uint64(ep.Target())
+		stats.Adaptive = true
+	}
+	_, stats.Admission = s.ep.(admissionPolicy)
+	return stats
+}
+
+func (s *SimpleStorageEngine) Clock() Clock {
+	return s.clock
+}
+
+func (s *SimpleStorageEngine) SizeHistogram() map[int]uint64 {
+	s.lock()
+	defer s.mu.Unlock()
+	sizes := map[int]uint64{}
+	for k, v := range s.values {
+		sizes[sizeBucketOf(k, v.Value)]++
+	}
+	return sizes
+}
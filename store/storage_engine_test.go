@@ -2,6 +2,7 @@ package store
 
 import (
 	"testing"
+	"time"
 )
 
 func expectBoolEquals(t *testing.T, exp, rec bool) {
@@ -11,7 +12,7 @@ func expectBoolEquals(t *testing.T, exp, rec bool) {
 }
 
 func expectValueEquals(t *testing.T, exp, rec Value) {
-	if exp.Flags != rec.Flags || exp.CasUnique != rec.CasUnique {
+	if exp.Flags != rec.Flags || exp.CasUnique != rec.CasUnique || exp.Expiry != rec.Expiry {
 		t.Errorf("expected value %v, received %v", exp, rec)
 		return
 	}
@@ -36,35 +37,35 @@ func testAddGetDelete(t *testing.T, s StorageEngine) {
 	expectValueEquals(t, Value{}, value)
 
 	// set key1, then read it
-	set := s.Set("key1", Value{1, 0, []byte("value1")})
+	set := s.Set("key1", Value{Flags: 1, Bytes: []byte("value1")})
 	expectBoolEquals(t, true, set)
 	value, found = s.Get("key1")
 	expectBoolEquals(t, true, found)
-	expectValueEquals(t, Value{1, 1, []byte("value1")}, value)
+	expectValueEquals(t, Value{Flags: 1, CasUnique: 1, Bytes: []byte("value1")}, value)
 
 	// overwrite key1, then read it
-	set = s.Set("key1", Value{2, 0, []byte("value2")})
+	set = s.Set("key1", Value{Flags: 2, Bytes: []byte("value2")})
 	expectBoolEquals(t, true, set)
 	value, found = s.Get("key1")
 	expectBoolEquals(t, true, found)
-	expectValueEquals(t, Value{2, 2, []byte("value2")}, value)
+	expectValueEquals(t, Value{Flags: 2, CasUnique: 2, Bytes: []byte("value2")}, value)
 
 	// deleting a key that does not exist returns false
 	deleted := s.Delete("key_not_existing")
 	expectBoolEquals(t, false, deleted)
 
 	// set second key, then read it
-	set = s.Set("key2", Value{0, 100, []byte("value3")})
+	set = s.Set("key2", Value{CasUnique: 100, Bytes: []byte("value3")})
 	expectBoolEquals(t, true, set)
 	value, found = s.Get("key2")
 	expectBoolEquals(t, true, found)
-	expectValueEquals(t, Value{0, 3, []byte("value3")}, value)
+	expectValueEquals(t, Value{CasUnique: 3, Bytes: []byte("value3")}, value)
 
 	// read first key to make sure it's not modified
 	value, found = s.Get("key1")
 	expectBoolEquals(t, true, found)
 	expectBoolEquals(t, true, set)
-	expectValueEquals(t, Value{2, 2, []byte("value2")}, value)
+	expectValueEquals(t, Value{Flags: 2, CasUnique: 2, Bytes: []byte("value2")}, value)
 
 	// successfully delete both keys
 	deleted = s.Delete("key1")
@@ -87,9 +88,9 @@ func testCas(t *testing.T, s StorageEngine) {
 		found bool
 	)
 
-	s.Set("key", Value{0, 100, []byte("value")})
+	s.Set("key", Value{CasUnique: 100, Bytes: []byte("value")})
 	value, _ = s.Get("key")
-	exists, notFound := s.Cas("key2", Value{0, 100, []byte("cas_value")})
+	exists, notFound := s.Cas("key2", Value{CasUnique: 100, Bytes: []byte("cas_value")})
 	if notFound == false {
 		t.Error("expected notFound = true")
 	}
@@ -97,7 +98,7 @@ func testCas(t *testing.T, s StorageEngine) {
 		t.Error("expected exists = false")
 	}
 
-	exists, notFound = s.Cas("key", Value{0, 100, []byte("cas_value")})
+	exists, notFound = s.Cas("key", Value{CasUnique: 100, Bytes: []byte("cas_value")})
 	if notFound == true {
 		t.Error("expected notFound = false")
 	}
@@ -106,9 +107,9 @@ func testCas(t *testing.T, s StorageEngine) {
 	}
 	value, found = s.Get("key")
 	expectBoolEquals(t, true, found)
-	expectValueEquals(t, Value{0, 1, []byte("value")}, value)
+	expectValueEquals(t, Value{CasUnique: 1, Bytes: []byte("value")}, value)
 
-	exists, notFound = s.Cas("key", Value{0, 1, []byte("cas_value")})
+	exists, notFound = s.Cas("key", Value{CasUnique: 1, Bytes: []byte("cas_value")})
 	if notFound == true {
 		t.Error("expected notFound = false")
 	}
@@ -117,10 +118,276 @@ func testCas(t *testing.T, s StorageEngine) {
 	}
 	value, found = s.Get("key")
 	expectBoolEquals(t, true, found)
-	expectValueEquals(t, Value{0, 2, []byte("cas_value")}, value)
+	expectValueEquals(t, Value{CasUnique: 2, Bytes: []byte("cas_value")}, value)
+}
+
+func testAddAndReplace(t *testing.T, s StorageEngine) {
+	// replacing a key that does not exist stores nothing
+	ok := s.Replace("key", Value{Flags: 1, Bytes: []byte("value1")})
+	expectBoolEquals(t, false, ok)
+	_, found := s.Get("key")
+	expectBoolEquals(t, false, found)
+
+	// adding a key that does not exist stores it
+	ok = s.Add("key", Value{Flags: 1, Bytes: []byte("value1")})
+	expectBoolEquals(t, true, ok)
+	value, found := s.Get("key")
+	expectBoolEquals(t, true, found)
+	expectValueEquals(t, Value{Flags: 1, CasUnique: 1, Bytes: []byte("value1")}, value)
+
+	// adding a key that exists stores nothing
+	ok = s.Add("key", Value{Flags: 2, Bytes: []byte("value2")})
+	expectBoolEquals(t, false, ok)
+	value, found = s.Get("key")
+	expectBoolEquals(t, true, found)
+	expectValueEquals(t, Value{Flags: 1, CasUnique: 1, Bytes: []byte("value1")}, value)
+
+	// replacing a key that exists overwrites it
+	ok = s.Replace("key", Value{Flags: 3, Bytes: []byte("value3")})
+	expectBoolEquals(t, true, ok)
+	value, found = s.Get("key")
+	expectBoolEquals(t, true, found)
+	expectValueEquals(t, Value{Flags: 3, CasUnique: 2, Bytes: []byte("value3")}, value)
+}
+
+func testAppendAndPrepend(t *testing.T, s StorageEngine) {
+	// appending or prepending to a key that does not exist stores nothing
+	ok := s.Append("key", Value{Flags: 1, Bytes: []byte("tail")})
+	expectBoolEquals(t, false, ok)
+	ok = s.Prepend("key", Value{Flags: 1, Bytes: []byte("head")})
+	expectBoolEquals(t, false, ok)
+	_, found := s.Get("key")
+	expectBoolEquals(t, false, found)
+
+	s.Set("key", Value{Flags: 1, Bytes: []byte("value")})
+
+	// the existing flags are kept and the cas unique is bumped
+	ok = s.Append("key", Value{Flags: 2, Bytes: []byte("_tail")})
+	expectBoolEquals(t, true, ok)
+	value, found := s.Get("key")
+	expectBoolEquals(t, true, found)
+	expectValueEquals(t, Value{Flags: 1, CasUnique: 2, Bytes: []byte("value_tail")}, value)
+
+	ok = s.Prepend("key", Value{Flags: 3, Bytes: []byte("head_")})
+	expectBoolEquals(t, true, ok)
+	value, found = s.Get("key")
+	expectBoolEquals(t, true, found)
+	expectValueEquals(t, Value{Flags: 1, CasUnique: 3, Bytes: []byte("head_value_tail")}, value)
+}
+
+func testIncrDecr(t *testing.T, s StorageEngine) {
+	_, found, err := s.IncrDecr("key", 1, true)
+	expectBoolEquals(t, false, found)
+	if err != nil {
+		t.Errorf("expected nil error, received %v", err)
+	}
+
+	s.Set("key", Value{Flags: 3, Bytes: []byte("10")})
+	value, found, err := s.IncrDecr("key", 5, true)
+	expectBoolEquals(t, true, found)
+	if err != nil || value != 15 {
+		t.Errorf("expected value 15 and nil error, received %d and %v", value, err)
+	}
+	stored, _ := s.Get("key")
+	expectValueEquals(t, Value{Flags: 3, CasUnique: 2, Bytes: []byte("15")}, stored)
+
+	// decrementing stops at 0
+	value, _, _ = s.IncrDecr("key", 20, false)
+	if value != 0 {
+		t.Errorf("expected value 0, received %d", value)
+	}
+	stored, _ = s.Get("key")
+	expectValueEquals(t, Value{Flags: 3, CasUnique: 3, Bytes: []byte("0")}, stored)
+
+	// incrementing wraps around
+	s.Set("key", Value{Bytes: []byte("18446744073709551615")})
+	value, _, _ = s.IncrDecr("key", 2, true)
+	if value != 1 {
+		t.Errorf("expected value 1, received %d", value)
+	}
+
+	// non-numeric values are left untouched
+	s.Set("key", Value{Bytes: []byte("abc")})
+	_, found, err = s.IncrDecr("key", 1, true)
+	expectBoolEquals(t, true, found)
+	if err != ErrNotNumeric {
+		t.Errorf("expected ErrNotNumeric, received %v", err)
+	}
+	stored, _ = s.Get("key")
+	expectValueEquals(t, Value{CasUnique: 6, Bytes: []byte("abc")}, stored)
+}
+
+func testTouch(t *testing.T, s StorageEngine) {
+	_, found := s.Touch("key", 100)
+	expectBoolEquals(t, false, found)
+
+	s.Set("key", Value{Flags: 3, Bytes: []byte("value")})
+	value, found := s.Touch("key", 100)
+	expectBoolEquals(t, true, found)
+	expectValueEquals(t, Value{Flags: 3, CasUnique: 1, Bytes: []byte("value"), Expiry: 100}, value)
+
+	// touching an expired value does not revive it
+	value, found = s.Touch("key", 0)
+	expectBoolEquals(t, false, found)
+	expectValueEquals(t, Value{}, value)
+}
+
+func testFlushAll(t *testing.T, s StorageEngine) {
+	s.Set("key1", Value{Bytes: []byte("value1")})
+	s.Set("key2", Value{Bytes: []byte("value2")})
+	s.FlushAll(0)
+	_, found := s.Get("key1")
+	expectBoolEquals(t, false, found)
+	_, found = s.Get("key2")
+	expectBoolEquals(t, false, found)
+
+	// the store is still usable after a flush
+	s.Set("key1", Value{Bytes: []byte("value1")})
+	_, found = s.Get("key1")
+	expectBoolEquals(t, true, found)
 }
 
 func TestSimpleStorageEngineCommon(t *testing.T) {
 	testAddGetDelete(t, NewSimpleStorageEngine(NewLruEvictionPolicy(1024)))
 	testCas(t, NewSimpleStorageEngine(NewLruEvictionPolicy(1024)))
+	testAddAndReplace(t, NewSimpleStorageEngine(NewLruEvictionPolicy(1024)))
+	testAppendAndPrepend(t, NewSimpleStorageEngine(NewLruEvictionPolicy(1024)))
+	testIncrDecr(t, NewSimpleStorageEngine(NewLruEvictionPolicy(1024)))
+	testTouch(t, NewSimpleStorageEngine(NewLruEvictionPolicy(1024)))
+	testFlushAll(t, NewSimpleStorageEngine(NewLruEvictionPolicy(1024)))
+}
+
+func TestSimpleStorageEngineFlushAll(t *testing.T) {
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	ep := NewLruEvictionPolicy(1024)
+	s := NewSimpleStorageEngineWithClock(ep, clock)
+
+	// an immediate flush resets the EvictionPolicy accounting
+	s.Set("key1", Value{Bytes: []byte("value1"), Expiry: Expiry(5, clock.Now())})
+	s.Set("key2", Value{Bytes: []byte("value2")})
+	s.FlushAll(Expiry(-1, clock.Now()))
+	if ep.Used() != 0 {
+		t.Errorf("expected 0 used bytes, received %d", ep.Used())
+	}
+	if s.expiries.Len() != 0 {
+		t.Errorf("expected 0 expiry entries, received %d", s.expiries.Len())
+	}
+
+	// a delayed flush keeps values until the flush time
+	s.Set("key1", Value{Bytes: []byte("value1")})
+	s.FlushAll(Expiry(10, clock.Now()))
+	clock.Advance(5 * time.Second)
+	s.Set("key2", Value{Bytes: []byte("value2")})
+	_, found := s.Get("key1")
+	expectBoolEquals(t, true, found)
+
+	// values written before the flush time are gone, but values written after survive
+	clock.Advance(5 * time.Second)
+	s.Set("key3", Value{Bytes: []byte("value3")})
+	_, found = s.Get("key1")
+	expectBoolEquals(t, false, found)
+	_, found = s.Get("key2")
+	expectBoolEquals(t, false, found)
+	_, found = s.Get("key3")
+	expectBoolEquals(t, true, found)
+	if ep.Used() != kvSize("key3", Value{Bytes: []byte("value3")}) {
+		t.Errorf("expected only key3 to use bytes, received %d used bytes", ep.Used())
+	}
+}
+
+func TestSimpleStorageEngineAppendEvicts(t *testing.T) {
+	ep := NewLruEvictionPolicy(32)
+	s := NewSimpleStorageEngine(ep)
+	s.Set("key1", Value{Bytes: []byte{0}})
+	s.Set("key2", Value{Bytes: []byte{0}})
+	if ep.Used() != 30 {
+		t.Errorf("expected 30 used bytes, received %d", ep.Used())
+	}
+
+	// growing key2 by three bytes requires evicting key1
+	ok := s.Append("key2", Value{Bytes: []byte{1, 2, 3}})
+	expectBoolEquals(t, true, ok)
+	_, found := s.Get("key1")
+	expectBoolEquals(t, false, found)
+	value, found := s.Get("key2")
+	expectBoolEquals(t, true, found)
+	expectValueEquals(t, Value{CasUnique: 3, Bytes: []byte{0, 1, 2, 3}}, value)
+	if ep.Used() != 18 {
+		t.Errorf("expected 18 used bytes, received %d", ep.Used())
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tests := []struct {
+		expTime int64
+		expiry  int64
+	}{
+		{0, 0},
+		{-1, 1500000000},
+		{1, 1500000001},
+		{60 * 60 * 24 * 30, 1500000000 + 60*60*24*30},
+		{60*60*24*30 + 1, 60*60*24*30 + 1},
+		{1600000000, 1600000000},
+	}
+	for _, test := range tests {
+		if e := Expiry(test.expTime, now); e != test.expiry {
+			t.Errorf("expected expiry %d for exptime %d, received %d", test.expiry, test.expTime, e)
+		}
+	}
+}
+
+func TestSimpleStorageEngineExpiration(t *testing.T) {
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	now := clock.Now()
+	ep := NewLruEvictionPolicy(1024)
+	s := NewSimpleStorageEngineWithClock(ep, clock)
+
+	s.Set("key1", Value{Bytes: []byte("value1"), Expiry: Expiry(10, now)})
+	s.Set("key2", Value{Bytes: []byte("value2"), Expiry: Expiry(20, now)})
+	s.Set("key3", Value{Bytes: []byte("value3"), Expiry: Expiry(-1, now)})
+	s.Set("key4", Value{Bytes: []byte("value4")})
+
+	// an already expired value is never found
+	_, found := s.Get("key3")
+	expectBoolEquals(t, false, found)
+	value, found := s.Get("key1")
+	expectBoolEquals(t, true, found)
+	expectValueEquals(t, Value{CasUnique: 1, Bytes: []byte("value1"), Expiry: 1500000010}, value)
+
+	// move past the expiry of key1
+	clock.Advance(10 * time.Second)
+	_, found = s.Get("key1")
+	expectBoolEquals(t, false, found)
+	exists, notFound := s.Cas("key2", Value{CasUnique: 2, Bytes: []byte("cas_value")})
+	expectBoolEquals(t, false, exists)
+	expectBoolEquals(t, false, notFound)
+
+	// the cas removed the expiry of key2
+	clock.Advance(10 * time.Second)
+	now = clock.Now()
+
+	// touching key4 makes it expire along with its position in the expiry heap
+	value, found = s.Touch("key4", Expiry(5, now))
+	expectBoolEquals(t, true, found)
+	expectValueEquals(t, Value{CasUnique: 4, Bytes: []byte("value4"), Expiry: 1500000025}, value)
+	clock.Advance(5 * time.Second)
+	if reaped, _ := s.ReapExpired(10); reaped != 1 {
+		t.Errorf("expected key4 to be reaped, received %d reaped", reaped)
+	}
+	s.Set("key4", Value{Bytes: []byte("value4")})
+	now = clock.Now()
+	value, found = s.Get("key2")
+	expectBoolEquals(t, true, found)
+	expectValueEquals(t, Value{CasUnique: 5, Bytes: []byte("cas_value")}, value)
+
+	// expired keys release their bytes and behave as missing for all operations
+	if ep.Used() != kvSize("key2", value)+kvSize("key4", Value{Bytes: []byte("value4")}) {
+		t.Errorf("expected only key2 and key4 to use bytes, received %d used bytes", ep.Used())
+	}
+	s.Set("key5", Value{Bytes: []byte("value5"), Expiry: Expiry(-1, now)})
+	expectBoolEquals(t, false, s.Delete("key5"))
+	s.Set("key5", Value{Bytes: []byte("value5"), Expiry: Expiry(-1, now)})
+	expectBoolEquals(t, false, s.Append("key5", Value{Bytes: []byte("tail")}))
+	expectBoolEquals(t, true, s.Add("key5", Value{Bytes: []byte("value5")}))
 }
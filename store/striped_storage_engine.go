@@ -0,0 +1,148 @@
+package store
+
+var _ StorageEngine = &StripedLockingStorageEngine{}
+
+// NewStripedLockingStorageEngine returns a StripedLockingStorageEngine with
+// the given number of shards. The total capacity is divided evenly among the
+// shards, each managed by its own EvictionPolicy built by newPolicy.
+func NewStripedLockingStorageEngine(shards, cap int, newPolicy func(cap int) EvictionPolicy, clock Clock) *StripedLockingStorageEngine {
+	if shards <= 0 {
+		shards = 1
+	}
+	s := &StripedLockingStorageEngine{
+		shards: make([]*SimpleStorageEngine, shards),
+	}
+	for i := range s.shards {
+		shardCap := cap / shards
+		if i < cap%shards {
+			shardCap++
+		}
+		s.shards[i] = newSimpleStorageEngine(newPolicy(shardCap), clock, &s.casUnique)
+	}
+	return s
+}
+
+// A StripedLockingStorageEngine is a StorageEngine that partitions keys
+// across shards by key hash. Each shard is a SimpleStorageEngine with its
+// own map, lock, and share of the capacity, so operations on keys in
+// different shards never contend with each other. Cas uniques are drawn
+// from a single atomic counter shared by all shards, keeping them globally
+// unique and monotonic.
+//
+// Note: because each shard evicts independently, a key may be evicted
+// while another shard still has room.
+type StripedLockingStorageEngine struct {
+	shards    []*SimpleStorageEngine
+	casUnique int64
+}
+
+// shard returns the shard owning the key using the 32 bit FNV-1a hash.
+func (s *StripedLockingStorageEngine) shard(key string) *SimpleStorageEngine {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return s.shards[h%uint32(len(s.shards))]
+}
+
+// ReapExpired reaps each shard in turn, removing at most max expired
+// Values in total.
+func (s *StripedLockingStorageEngine) ReapExpired(max int) (reaped int, more bool) {
+	for _, shard := range s.shards {
+		if reaped >= max {
+			return reaped, true
+		}
+		r, m := shard.ReapExpired(max - reaped)
+		reaped += r
+		more = more || m
+	}
+	return
+}
+
+func (s *StripedLockingStorageEngine) Set(key string, value Value) bool {
+	return s.shard(key).Set(key, value)
+}
+
+func (s *StripedLockingStorageEngine) Add(key string, value Value) bool {
+	return s.shard(key).Add(key, value)
+}
+
+func (s *StripedLockingStorageEngine) Replace(key string, value Value) bool {
+	return s.shard(key).Replace(key, value)
+}
+
+func (s *StripedLockingStorageEngine) Append(key string, value Value) bool {
+	return s.shard(key).Append(key, value)
+}
+
+func (s *StripedLockingStorageEngine) Prepend(key string, value Value) bool {
+	return s.shard(key).Prepend(key, value)
+}
+
+func (s *StripedLockingStorageEngine) Get(key string) (value Value, found bool) {
+	return s.shard(key).Get(key)
+}
+
+func (s *StripedLockingStorageEngine) Cas(key string, value Value) (exists, notFound bool) {
+	return s.shard(key).Cas(key, value)
+}
+
+func (s *StripedLockingStorageEngine) Delete(key string) bool {
+	return s.shard(key).Delete(key)
+}
+
+func (s *StripedLockingStorageEngine) IncrDecr(key string, delta uint64, incr bool) (value uint64, found bool, err error) {
+	return s.shard(key).IncrDecr(key, delta, incr)
+}
+
+func (s *StripedLockingStorageEngine) Touch(key string, expiry int64) (value Value, found bool) {
+	return s.shard(key).Touch(key, expiry)
+}
+
+func (s *StripedLockingStorageEngine) FlushAll(at int64) {
+	for _, shard := range s.shards {
+		shard.FlushAll(at)
+	}
+}
+
+func (s *StripedLockingStorageEngine) Stats() (stats EngineStats) {
+	for _, shard := range s.shards {
+		stats.add(shard.Stats())
+	}
+	return
+}
+
+func (s *StripedLockingStorageEngine) Clock() Clock {
+	return s.shards[0].Clock()
+}
+
+func (s *StripedLockingStorageEngine) SizeHistogram() map[int]uint64 {
+	sizes := map[int]uint64{}
+	for _, shard := range s.shards {
+		for size, count := range shard.SizeHistogram() {
+			sizes[size] += count
+		}
+	}
+	return sizes
+}
+
+func (s *StripedLockingStorageEngine) MetaGet(key string, opts MetaGetOptions) (value Value, meta ItemMeta, win, found bool) {
+	return s.shard(key).MetaGet(key, opts)
+}
+
+func (s *StripedLockingStorageEngine) MetaSet(key string, value Value, opts MetaSetOptions) (casUnique int64, result MetaResult) {
+	return s.shard(key).MetaSet(key, value, opts)
+}
+
+func (s *StripedLockingStorageEngine) MetaDelete(key string, opts MetaDeleteOptions) MetaResult {
+	return s.shard(key).MetaDelete(key, opts)
+}
+
+func (s *StripedLockingStorageEngine) MetaArithmetic(key string, opts MetaArithmeticOptions) (value Value, result MetaResult, err error) {
+	return s.shard(key).MetaArithmetic(key, opts)
+}
+
+func (s *StripedLockingStorageEngine) MetaDebug(key string) (value Value, meta ItemMeta, found bool) {
+	return s.shard(key).MetaDebug(key)
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newLruPolicy(cap int) EvictionPolicy { return NewLruEvictionPolicy(cap) }
+
+func TestStripedLockingStorageEngineCommon(t *testing.T) {
+	testAddGetDelete(t, NewStripedLockingStorageEngine(4, 4096, newLruPolicy, SystemClock))
+	testCas(t, NewStripedLockingStorageEngine(4, 4096, newLruPolicy, SystemClock))
+	testAddAndReplace(t, NewStripedLockingStorageEngine(4, 4096, newLruPolicy, SystemClock))
+	testAppendAndPrepend(t, NewStripedLockingStorageEngine(4, 4096, newLruPolicy, SystemClock))
+	testIncrDecr(t, NewStripedLockingStorageEngine(4, 4096, newLruPolicy, SystemClock))
+	testTouch(t, NewStripedLockingStorageEngine(4, 4096, newLruPolicy, SystemClock))
+	testFlushAll(t, NewStripedLockingStorageEngine(4, 4096, newLruPolicy, SystemClock))
+}
+
+func TestStripedLockingStorageEngineCapacity(t *testing.T) {
+	s := NewStripedLockingStorageEngine(3, 100, newLruPolicy, SystemClock)
+	total := 0
+	for i, shard := range s.shards {
+		expected := 33
+		if i == 0 {
+			expected = 34
+		}
+		if shard.ep.Capacity() != expected {
+			t.Errorf("expected shard %d capacity %d, received %d", i, expected, shard.ep.Capacity())
+		}
+		total += shard.ep.Capacity()
+	}
+	if total != 100 {
+		t.Errorf("expected total capacity 100, received %d", total)
+	}
+}
+
+func TestStripedLockingStorageEngineDistributesKeys(t *testing.T) {
+	s := NewStripedLockingStorageEngine(4, 1024*1024, newLruPolicy, SystemClock)
+	for i := 0; i < 1000; i++ {
+		s.Set(fmt.Sprintf("key%d", i), Value{Bytes: []byte("value")})
+	}
+	for i, shard := range s.shards {
+		if len(shard.values) < 100 {
+			t.Errorf("expected shard %d to hold at least 100 keys, received %d", i, len(shard.values))
+		}
+	}
+}
+
+func TestStripedLockingStorageEngineUniqueCas(t *testing.T) {
+	s := NewStripedLockingStorageEngine(8, 1024*1024, newLruPolicy, SystemClock)
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				s.Set(fmt.Sprintf("key%d_%d", g, i), Value{Bytes: []byte("value")})
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	seen := map[int64]bool{}
+	for g := 0; g < 8; g++ {
+		for i := 0; i < 100; i++ {
+			v, found := s.Get(fmt.Sprintf("key%d_%d", g, i))
+			expectBoolEquals(t, true, found)
+			if v.CasUnique < 1 || v.CasUnique > 800 || seen[v.CasUnique] {
+				t.Errorf("expected a unique cas in [1, 800], received %d", v.CasUnique)
+			}
+			seen[v.CasUnique] = true
+		}
+	}
+}
+
+func TestStripedLockingStorageEngineReapExpired(t *testing.T) {
+	clock := newFakeClock(time.Unix(1500000000, 0))
+	s := NewStripedLockingStorageEngine(4, 1024*1024, newLruPolicy, clock)
+	for i := 0; i < 10; i++ {
+		s.Set(fmt.Sprintf("key%d", i), Value{Bytes: []byte("value"), Expiry: Expiry(1, clock.Now())})
+	}
+	clock.Advance(time.Second)
+
+	total := 0
+	for {
+		reaped, more := s.ReapExpired(3)
+		if reaped > 3 {
+			t.Errorf("expected at most 3 reaped, received %d", reaped)
+		}
+		total += reaped
+		if !more {
+			break
+		}
+	}
+	if total != 10 {
+		t.Errorf("expected 10 reaped, received %d", total)
+	}
+}
@@ -0,0 +1,343 @@
+package store
+
+import (
+	"hash/maphash"
+)
+
+var _ admissionPolicy = &tinyLfuEvictionPolicy{}
+
+const (
+	// sketchDepth is the number of rows of counters in a countMinSketch.
+	sketchDepth = 4
+	// sketchMaxCount is the count at which a counter saturates.
+	sketchMaxCount = 15
+	// tinyLfuBytesPerCounter is the space per counter in each row of the
+	// sketch, sized for items of around this many bytes.
+	tinyLfuBytesPerCounter = 256
+)
+
+// A countMinSketch estimates how often keys were seen within a fixed space.
+// Each key increments one saturating counter per row, and the estimate is
+// the smallest of them, which only overcounts on collisions. After every
+// sampleSize increments, all counters are halved so old popularity fades.
+type countMinSketch struct {
+	seed       maphash.Seed
+	rows       [sketchDepth][]uint8
+	mask       uint64
+	sampleSize int
+	additions  int
+}
+
+// newCountMinSketch returns a sketch with at least width counters per row.
+func newCountMinSketch(width int) *countMinSketch {
+	size := 16
+	for size < width {
+		size *= 2
+	}
+	c := &countMinSketch{seed: maphash.MakeSeed(), mask: uint64(size - 1), sampleSize: 10 * size}
+	for i := range c.rows {
+		c.rows[i] = make([]uint8, size)
+	}
+	return c
+}
+
+// indexes returns the counter of the key in each row, by double hashing.
+func (c *countMinSketch) indexes(key string) (idx [sketchDepth]uint64) {
+	h := maphash.String(c.seed, key)
+	h1, h2 := h, h>>32|1
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & c.mask
+	}
+	return
+}
+
+func (c *countMinSketch) increment(key string) {
+	for i, j := range c.indexes(key) {
+		if c.rows[i][j] < sketchMaxCount {
+			c.rows[i][j]++
+		}
+	}
+	if c.additions++; c.additions >= c.sampleSize {
+		c.halve()
+	}
+}
+
+func (c *countMinSketch) estimate(key string) int {
+	min := uint8(sketchMaxCount)
+	for i, j := range c.indexes(key) {
+		if c.rows[i][j] < min {
+			min = c.rows[i][j]
+		}
+	}
+	return int(min)
+}
+
+func (c *countMinSketch) halve() {
+	for _, row := range c.rows {
+		for j := range row {
+			row[j] /= 2
+		}
+	}
+	c.additions /= 2
+}
+
+// segmentNode represents a key-value pair in the doubly linked list of an
+// lruSegment. The size is kept apart from the value so that a node can be
+// kept as a ghost of an evicted key without its value. The freq counts uses
+// for policies that do not relink a node when it is used.
+type segmentNode struct {
+	key        string
+	val        Value
+	size       int
+	freq       int32
+	seg        *lruSegment
+	prev, next *segmentNode
+}
+
+// An lruSegment is a doubly linked list of keys, most recently used first,
+// and the bytes they use.
+type lruSegment struct {
+	used     int
+	sentinel *segmentNode
+}
+
+func newLruSegment() *lruSegment {
+	s := &segmentNode{}
+	s.next = s
+	s.prev = s
+	return &lruSegment{sentinel: s}
+}
+
+func (s *lruSegment) pushFront(node *segmentNode) {
+	node.seg = s
+	node.next = s.sentinel.next
+	node.prev = s.sentinel
+	s.sentinel.next.prev = node
+	s.sentinel.next = node
+	s.used += node.size
+}
+
+func (s *lruSegment) unlink(node *segmentNode) {
+	node.prev.next = node.next
+	node.next.prev = node.prev
+	node.seg = nil
+	s.used -= node.size
+}
+
+// back returns the least recently used key, or nil if the segment is empty.
+func (s *lruSegment) back() *segmentNode {
+	if s.sentinel.prev == s.sentinel {
+		return nil
+	}
+	return s.sentinel.prev
+}
+
+// A tinyLfuEvictionPolicy is a W-TinyLFU implementation of an
+// EvictionPolicy. New keys enter a small window LRU. Keys leaving the window
+// are candidates for the main space, a segmented LRU of a probation segment
+// and a protected segment for keys used again while on probation. A
+// candidate is only admitted if a count-min sketch estimates it is used more
+// often than each of the keys it would evict from the main space, so a scan
+// of keys used once cannot flush keys that are used often.
+type tinyLfuEvictionPolicy struct {
+	cap          int
+	used         int
+	windowCap    int
+	protectedCap int
+	window       *lruSegment
+	probation    *lruSegment
+	protected    *lruSegment
+	sketch       *countMinSketch
+	kvMap        map[string]*segmentNode
+}
+
+// NewTinyLfuEvictionPolicy returns a W-TinyLFU policy with a window of 1%
+// of the capacity, and a protected segment of 80% of the rest, as in
+// Caffeine.
+func NewTinyLfuEvictionPolicy(cap int) *tinyLfuEvictionPolicy {
+	if cap < 0 {
+		cap = 0
+	}
+	window := cap / 100
+	return newTinyLfuEvictionPolicy(cap, window, (cap-window)*8/10, cap/tinyLfuBytesPerCounter)
+}
+
+func newTinyLfuEvictionPolicy(cap, windowCap, protectedCap, sketchWidth int) *tinyLfuEvictionPolicy {
+	return &tinyLfuEvictionPolicy{
+		cap:          cap,
+		windowCap:    windowCap,
+		protectedCap: protectedCap,
+		window:       newLruSegment(),
+		probation:    newLruSegment(),
+		protected:    newLruSegment(),
+		sketch:       newCountMinSketch(sketchWidth),
+		kvMap:        map[string]*segmentNode{},
+	}
+}
+
+// admission marks the policy as declining to admit keys used less often
+// than those they would evict.
+func (l *tinyLfuEvictionPolicy) admission() {}
+
+func (l *tinyLfuEvictionPolicy) Capacity() int {
+	return l.cap
+}
+
+func (l *tinyLfuEvictionPolicy) Used() int {
+	return l.used
+}
+
+// mainCap returns the capacity of the probation and protected segments.
+func (l *tinyLfuEvictionPolicy) mainCap() int {
+	return l.cap - l.windowCap
+}
+
+func (l *tinyLfuEvictionPolicy) mainUsed() int {
+	return l.probation.used + l.protected.used
+}
+
+// touch moves the node to the front of its segment, promoting it to the
+// protected segment if it is on probation.
+func (l *tinyLfuEvictionPolicy) touch(node *segmentNode) {
+	seg := node.seg
+	seg.unlink(node)
+	if seg == l.probation {
+		seg = l.protected
+	}
+	seg.pushFront(node)
+	// demote the least recently used of the protected keys to probation
+	for l.protected.used > l.protectedCap {
+		demoted := l.protected.back()
+		l.protected.unlink(demoted)
+		l.probation.pushFront(demoted)
+	}
+}
+
+func (l *tinyLfuEvictionPolicy) Touch(key string) bool {
+	node, ok := l.kvMap[key]
+	if !ok {
+		return false
+	}
+	l.sketch.increment(key)
+	l.touch(node)
+	return true
+}
+
+// remove forgets the node, recording its key as evicted.
+func (l *tinyLfuEvictionPolicy) remove(node *segmentNode, evict *[]string) {
+	node.seg.unlink(node)
+	delete(l.kvMap, node.key)
+	l.used -= node.size
+	*evict = append(*evict, node.key)
+}
+
+// mainVictim returns the key to evict first from the main space other than
+// the given node: the least recently used on probation, then protected.
+func (l *tinyLfuEvictionPolicy) mainVictim(except *segmentNode) *segmentNode {
+	for _, seg := range []*lruSegment{l.probation, l.protected} {
+		for node := seg.sentinel.prev; node != seg.sentinel; node = node.prev {
+			if node != except {
+				return node
+			}
+		}
+	}
+	return nil
+}
+
+// admit returns true if the candidate leaving the window is estimated to be
+// used more often than every key of the main space it would evict to fit,
+// evicting them. The except node, the key being added, is never evicted.
+func (l *tinyLfuEvictionPolicy) admit(candidate, except *segmentNode, evict *[]string) bool {
+	size := candidate.size
+	if size > l.mainCap() {
+		return false
+	}
+	freq := l.sketch.estimate(candidate.key)
+	var victims []*segmentNode
+	free := l.mainCap() - l.mainUsed()
+	for _, seg := range []*lruSegment{l.probation, l.protected} {
+		for node := seg.sentinel.prev; free < size && node != seg.sentinel; node = node.prev {
+			if node == except {
+				continue
+			}
+			if l.sketch.estimate(node.key) >= freq {
+				return false
+			}
+			victims = append(victims, node)
+			free += node.size
+		}
+	}
+	if free < size {
+		return false
+	}
+	for _, victim := range victims {
+		l.remove(victim, evict)
+	}
+	return true
+}
+
+func (l *tinyLfuEvictionPolicy) Add(key string, v Value) (evict []string, hasSpace bool) {
+	size := kvSize(key, v)
+	if size > l.cap {
+		hasSpace = false
+		return
+	}
+	l.sketch.increment(key)
+
+	// an existing node is updated in place, keeping its segment
+	node, exists := l.kvMap[key]
+	if exists {
+		seg := node.seg
+		seg.unlink(node)
+		l.used -= node.size
+		node.val = v
+		node.size = size
+		seg.pushFront(node)
+		l.touch(node)
+	} else {
+		node = &segmentNode{key: key, val: v, size: size}
+		l.window.pushFront(node)
+		l.kvMap[key] = node
+	}
+	l.used += size
+
+	// the keys overflowing the window are admitted to probation, or evicted
+	for l.window.used > l.windowCap {
+		candidate := l.window.back()
+		l.window.unlink(candidate)
+		if l.admit(candidate, node, &evict) {
+			l.probation.pushFront(candidate)
+			continue
+		}
+		delete(l.kvMap, candidate.key)
+		l.used -= candidate.size
+		if candidate != node {
+			evict = append(evict, candidate.key)
+		}
+	}
+	// a key that grew in the main space makes room for itself, unless it
+	// cannot fit even alone
+	for l.mainUsed() > l.mainCap() {
+		victim := l.mainVictim(node)
+		if victim == nil {
+			node.seg.unlink(node)
+			delete(l.kvMap, key)
+			l.used -= size
+			break
+		}
+		l.remove(victim, &evict)
+	}
+	_, hasSpace = l.kvMap[key]
+	return
+}
+
+func (l *tinyLfuEvictionPolicy) Remove(key string) bool {
+	node, ok := l.kvMap[key]
+	if !ok {
+		return false
+	}
+	delete(l.kvMap, key)
+	node.seg.unlink(node)
+	l.used -= node.size
+	return true
+}
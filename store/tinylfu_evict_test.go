@@ -0,0 +1,231 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// segmentKeys returns the keys of the segment, most recently used first.
+func segmentKeys(s *lruSegment) []string {
+	keys := []string{}
+	for node := s.sentinel.next; node != s.sentinel; node = node.next {
+		if node.seg != s {
+			panic("node in the wrong segment")
+		}
+		keys = append(keys, node.key)
+	}
+	return keys
+}
+
+func expectSegments(t *testing.T, p *tinyLfuEvictionPolicy, window, probation, protected []string) {
+	recWindow, recProbation, recProtected := segmentKeys(p.window), segmentKeys(p.probation), segmentKeys(p.protected)
+	if !reflect.DeepEqual(window, recWindow) || !reflect.DeepEqual(probation, recProbation) || !reflect.DeepEqual(protected, recProtected) {
+		t.Errorf("expected segments %v %v %v, received %v %v %v", window, probation, protected, recWindow, recProbation, recProtected)
+	}
+}
+
+// newTestTinyLfu returns a policy of 4 items of 15 bytes, one of them in the
+// window and two protected, with a sketch wide enough to avoid collisions.
+func newTestTinyLfu() *tinyLfuEvictionPolicy {
+	return newTinyLfuEvictionPolicy(60, 15, 30, 1<<16)
+}
+
+func TestCountMinSketch(t *testing.T) {
+	c := newCountMinSketch(1 << 16)
+	for i := 0; i < 20; i++ {
+		c.increment("key1")
+	}
+	c.increment("key2")
+	if c.estimate("key1") != sketchMaxCount || c.estimate("key2") != 1 || c.estimate("key3") != 0 {
+		t.Errorf("expected estimates 15, 1 and 0, received %d, %d and %d", c.estimate("key1"), c.estimate("key2"), c.estimate("key3"))
+	}
+
+	c.halve()
+	if c.estimate("key1") != 7 || c.estimate("key2") != 0 {
+		t.Errorf("expected estimates 7 and 0, received %d and %d", c.estimate("key1"), c.estimate("key2"))
+	}
+
+	// the counters are halved after every sample of increments
+	c = newCountMinSketch(1 << 16)
+	c.sampleSize = 4
+	for i := 0; i < 4; i++ {
+		c.increment("key1")
+	}
+	if c.estimate("key1") != 2 || c.additions != 2 {
+		t.Errorf("expected estimate 2 after 2 additions, received %d after %d", c.estimate("key1"), c.additions)
+	}
+}
+
+func TestTinyLfuTouchNonExisting(t *testing.T) {
+	p := NewTinyLfuEvictionPolicy(16)
+	ok := p.Touch("non_existing")
+	if ok {
+		t.Errorf("expected unsuccessful touch")
+	}
+}
+
+func TestTinyLfuTouchExisting(t *testing.T) {
+	p := newTestTinyLfu()
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+	p.Add("key3", Value{Bytes: []byte{0}})
+	expectSegments(t, p, []string{"key3"}, []string{"key2", "key1"}, []string{})
+
+	// a touched key on probation is protected
+	ok := p.Touch("key1")
+	if !ok {
+		t.Errorf("expected successful touch")
+	}
+	expectSegments(t, p, []string{"key3"}, []string{"key2"}, []string{"key1"})
+
+	// protecting too many keys demotes the least recently used
+	p.Touch("key2")
+	p.Add("key4", Value{Bytes: []byte{0}})
+	expectSegments(t, p, []string{"key4"}, []string{"key3"}, []string{"key2", "key1"})
+	p.Touch("key3")
+	expectSegments(t, p, []string{"key4"}, []string{"key1"}, []string{"key3", "key2"})
+}
+
+func TestTinyLfuDelete(t *testing.T) {
+	p := newTestTinyLfu()
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+	p.Touch("key1")
+
+	p.Remove("unknown")
+	if len(p.kvMap) != 2 {
+		t.Errorf("expected 2 elements in kvMap, received %d", len(p.kvMap))
+	}
+
+	p.Remove("key1")
+	p.Remove("key2")
+	if len(p.kvMap) != 0 {
+		t.Errorf("expected 0 elements in kvMap, received %d", len(p.kvMap))
+	}
+	if p.Used() != 0 || p.window.used != 0 || p.mainUsed() != 0 {
+		t.Error("expected 0 used bytes")
+	}
+	expectSegments(t, p, []string{}, []string{}, []string{})
+}
+
+func TestTinyLfuAdmission(t *testing.T) {
+	p := newTestTinyLfu()
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+	p.Add("key3", Value{Bytes: []byte{0}})
+	ev, sp := p.Add("key4", Value{Bytes: []byte{0}})
+	if ev != nil || sp == false {
+		t.Errorf("expected no evictions and can add")
+	}
+	if p.Used() != 60 {
+		t.Errorf("expected 60 used bytes, received %d", p.Used())
+	}
+	p.Touch("key1")
+	p.Touch("key2")
+
+	// key4 leaves the window, but is used no more often than key3
+	ev, sp = p.Add("key5", Value{Bytes: []byte{0}})
+	if !reflect.DeepEqual(ev, []string{"key4"}) || sp == false {
+		t.Errorf("expected eviction of key4 and can add, received %v and %v", ev, sp)
+	}
+
+	// key5 is used more often than key3, so replaces it
+	p.Touch("key5")
+	p.Touch("key5")
+	ev, _ = p.Add("key6", Value{Bytes: []byte{0}})
+	if !reflect.DeepEqual(ev, []string{"key3"}) {
+		t.Errorf("expected eviction of key3, received %v", ev)
+	}
+	expectSegments(t, p, []string{"key6"}, []string{"key5"}, []string{"key2", "key1"})
+
+	// a new key pushing out the window is not admitted itself
+	ev, sp = p.Add("big", Value{Bytes: make([]byte, 21)})
+	if !reflect.DeepEqual(ev, []string{"key6"}) || sp == true {
+		t.Errorf("expected eviction of key6 and cannot add, received %v and %v", ev, sp)
+	}
+	if _, ok := p.kvMap["big"]; ok || p.Used() != 45 {
+		t.Errorf("expected big to be forgotten and 45 used bytes, received %d", p.Used())
+	}
+
+	ev, sp = p.Add("key7", Value{Bytes: make([]byte, 60)})
+	if ev != nil || sp == true {
+		t.Errorf("expected no evictions and cannot add")
+	}
+}
+
+func TestTinyLfuOverwrite(t *testing.T) {
+	p := newTestTinyLfu()
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+
+	// overwriting key1 keeps its node and counts as a use
+	ev, sp := p.Add("key1", Value{Bytes: []byte{1, 2}})
+	if ev != nil || sp == false {
+		t.Errorf("expected no evictions and can add")
+	}
+	if p.Used() != 31 {
+		t.Errorf("expected 31 used bytes, received %d", p.Used())
+	}
+	expectSegments(t, p, []string{"key2"}, []string{}, []string{"key1"})
+
+	// growing a key in the main space evicts others, but never itself
+	p.Add("key3", Value{Bytes: []byte{0}})
+	ev, sp = p.Add("key1", Value{Bytes: make([]byte, 25)})
+	if !reflect.DeepEqual(ev, []string{"key2"}) || sp == false {
+		t.Errorf("expected eviction of key2 and can add, received %v and %v", ev, sp)
+	}
+	if p.Used() != 54 {
+		t.Errorf("expected 54 used bytes, received %d", p.Used())
+	}
+
+	// removing a key releases its bytes
+	p.Remove("key1")
+	p.Remove("key3")
+	if p.Used() != 0 {
+		t.Errorf("expected 0 used bytes, received %d", p.Used())
+	}
+}
+
+func TestTinyLfuOverwriteWhileWindowOverflows(t *testing.T) {
+	p := newTinyLfuEvictionPolicy(60, 45, 30, 1<<16)
+	p.Add("key1", Value{Bytes: []byte{0}})
+	p.Add("key2", Value{Bytes: []byte{0}})
+	p.Touch("key2")
+	p.Touch("key2")
+	p.Touch("key2")
+	p.Add("key3", Value{Bytes: []byte{0}})
+	p.Add("key4", Value{Bytes: []byte{0}})
+	expectSegments(t, p, []string{"key4", "key3", "key2"}, []string{"key1"}, []string{})
+
+	// shrinking the window leaves it overflowing when key1, in the main
+	// space, grows; key2 is used more often but must not evict key1 to fit
+	p.windowCap = 30
+	ev, sp := p.Add("key1", Value{Bytes: []byte{0, 1}})
+	if !reflect.DeepEqual(ev, []string{"key2"}) || sp == false {
+		t.Errorf("expected eviction of key2 and can add, received %v and %v", ev, sp)
+	}
+	expectSegments(t, p, []string{"key4", "key3"}, []string{}, []string{"key1"})
+	if p.Used() != 46 {
+		t.Errorf("expected 46 used bytes, received %d", p.Used())
+	}
+}
+
+func TestTinyLfuScanResistance(t *testing.T) {
+	p := newTinyLfuEvictionPolicy(15*10, 15, 15*6, 1<<16)
+	hot := []string{"hot1", "hot2", "hot3"}
+	for _, k := range hot {
+		p.Add(k, Value{Bytes: []byte{0}})
+		p.Touch(k)
+	}
+
+	// a scan of many keys used once never evicts the hot set
+	for i := 0; i < 100; i++ {
+		p.Add(fmt.Sprintf("s%02d", i), Value{Bytes: []byte{0, 0}})
+	}
+	for _, k := range hot {
+		if _, ok := p.kvMap[k]; !ok {
+			t.Errorf("expected %s to survive the scan", k)
+		}
+	}
+}
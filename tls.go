@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// tlsOptions configure the tls: listeners of a Server.
+type tlsOptions struct {
+	certFile string
+	keyFile  string
+	// caFile is a bundle of CA certificates in PEM format. If set, clients
+	// must present a certificate signed by one of them.
+	caFile string
+	// minVersion is the minimum TLS version accepted: 1.0, 1.1, 1.2 or 1.3,
+	// defaulting to 1.2.
+	minVersion string
+	// ciphers names the cipher suites accepted for TLS 1.2 and below,
+	// defaulting to Go's secure defaults.
+	ciphers []string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// load reads the certificates and builds the tls.Config they describe.
+func (o tlsOptions) load() (*tls.Config, error) {
+	if o.certFile == "" || o.keyFile == "" {
+		return nil, errors.New("tls needs a certificate and key file")
+	}
+	cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if o.minVersion != "" {
+		version, ok := tlsVersions[o.minVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls version '%s'", o.minVersion)
+		}
+		config.MinVersion = version
+	}
+	if len(o.ciphers) > 0 {
+		suites := map[string]uint16{}
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range o.ciphers {
+			id, ok := suites[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown cipher suite '%s'", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+	if o.caFile != "" {
+		pem, err := ioutil.ReadFile(o.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in '%s'", o.caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// A tlsReloader hands new connections the tls.Config most recently loaded
+// from its options, so certificates can be replaced without restarting.
+type tlsReloader struct {
+	opts   tlsOptions
+	mu     sync.RWMutex
+	config *tls.Config
+}
+
+func newTLSReloader(opts tlsOptions) (*tlsReloader, error) {
+	r := &tlsReloader{opts: opts}
+	return r, r.reload()
+}
+
+// reload reads the certificates again, keeping the current ones if they
+// cannot be loaded.
+func (r *tlsReloader) reload() error {
+	config, err := r.opts.load()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.config = config
+	return nil
+}
+
+// serverConfig returns the config for listeners, which picks up the
+// current config on every handshake.
+func (r *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return r.config, nil
+		},
+	}
+}
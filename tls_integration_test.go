@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/tshprecher/mcache/store"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and key generated for a test.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCert returns a certificate for localhost signed by the parent, or
+// self-signed if parent is nil.
+func newTestCert(t *testing.T, serial int64, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "mcache test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// write writes the certificate and key in PEM format to the given files.
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, c.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// tlsProxy accepts plaintext connections and forwards them over TLS to the
+// server, so a client without TLS support can talk to a TLS listener. It
+// returns the address to connect to.
+func tlsProxy(t *testing.T, server string, config *tls.Config) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				upstream, err := tls.Dial("tcp", server, config)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestIntegrationTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	ca := newTestCert(t, 1, nil, true)
+	ioutil.WriteFile(caFile, ca.pem, 0600)
+	newTestCert(t, 2, ca, false).write(t, certFile, keyFile)
+	client := newTestCert(t, 3, ca, false)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	se := store.NewSimpleStorageEngine(store.NewLruEvictionPolicy(1024))
+	server := &Server{
+		port:       11200,
+		listen:     []string{"tls:localhost:11200"},
+		tlsOpts:    tlsOptions{certFile: certFile, keyFile: keyFile, caFile: caFile, minVersion: "1.2"},
+		se:         se,
+		maxValSize: 1024,
+		timeout:    10,
+		mu:         sync.Mutex{}}
+	go server.Start()
+	defer server.Stop()
+	time.Sleep(500 * time.Millisecond)
+
+	// the client talks to the server over mTLS through the proxy
+	config := &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: []tls.Certificate{client.tlsCertificate()}}
+	mc := memcache.New(tlsProxy(t, "localhost:11200", config))
+	if err := mc.Set(&memcache.Item{Key: "key", Value: []byte("value"), Flags: 3}); err != nil {
+		t.Fatal(err)
+	}
+	item, err := mc.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !itemValuesEqual(&memcache.Item{Key: "key", Value: []byte("value"), Flags: 3}, item) {
+		t.Errorf("expected value 'value', received %#v", item)
+	}
+	if err := mc.Delete("key"); err != nil {
+		t.Error(err)
+	}
+
+	handshake := func(config *tls.Config) (*tls.Conn, error) {
+		conn, err := tls.Dial("tcp", "localhost:11200", config)
+		if err != nil {
+			return nil, err
+		}
+		// the server only rejects a client certificate once the client
+		// reads, after the handshake completes on its side
+		conn.Write([]byte("version\r\n"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	// clients without a certificate signed by the CA are rejected
+	if conn, err := handshake(&tls.Config{RootCAs: roots, ServerName: "localhost"}); err == nil {
+		conn.Close()
+		t.Errorf("expected a client without a certificate to be rejected")
+	}
+	stranger := newTestCert(t, 4, nil, false)
+	if conn, err := handshake(&tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: []tls.Certificate{stranger.tlsCertificate()}}); err == nil {
+		conn.Close()
+		t.Errorf("expected a client with a certificate from an unknown CA to be rejected")
+	}
+
+	// versions below the minimum are rejected
+	old := config.Clone()
+	old.MaxVersion = tls.VersionTLS11
+	if conn, err := handshake(old); err == nil {
+		conn.Close()
+		t.Errorf("expected a client limited to TLS 1.1 to be rejected")
+	}
+
+	// reloading picks up a new certificate for new connections only
+	established, err := handshake(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer established.Close()
+	newTestCert(t, 5, ca, false).write(t, certFile, keyFile)
+	if err := server.ReloadTLS(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := handshake(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 5 {
+		t.Errorf("expected the reloaded certificate with serial 5, received %d", serial)
+	}
+	if _, err := established.Write([]byte("version\r\n")); err != nil {
+		t.Errorf("expected the established connection to stay open, received %v", err)
+	}
+
+	// a failed reload keeps the current certificate
+	ioutil.WriteFile(certFile, []byte("garbage"), 0600)
+	if err := server.ReloadTLS(); err == nil {
+		t.Errorf("expected reloading a malformed certificate to fail")
+	}
+	if conn, err := handshake(config); err != nil {
+		t.Errorf("expected the server to keep serving after a failed reload, received %v", err)
+	} else {
+		conn.Close()
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/golang/glog"
+	"github.com/tshprecher/mcache/protocol"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// udpHeaderLength is the length of the frame header starting every
+	// datagram: the request id, sequence number, total number of datagrams
+	// and two reserved bytes.
+	udpHeaderLength = 8
+	// udpMaxDatagram is the largest datagram sent, as in memcached.
+	udpMaxDatagram = 1400
+	// udpMaxRequest is the largest datagram read.
+	udpMaxRequest = 64 * 1024
+	// udpMaxInFlight is the most datagrams served at once. Beyond it, reading
+	// stops and the kernel drops datagrams once the socket buffer fills.
+	udpMaxInFlight = 64
+)
+
+var udpMultiPacketRequest = protocol.NewServerErrorResponse("multi-packet request not supported")
+
+// serveUDP reads requests from the packet connection until it is closed,
+// serving each one in its own goroutine once it takes a slot of workers.
+func (s *Server) serveUDP(pc net.PacketConn, workers chan struct{}) {
+	buf := make([]byte, udpMaxRequest)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			glog.Warning(err.Error())
+			return
+		}
+		if n < udpHeaderLength {
+			glog.Warningf("dropping datagram without a frame header: addr=%v", addr)
+			continue
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		workers <- struct{}{}
+		go func() {
+			defer func() { <-workers }()
+			s.handleDatagram(pc, addr, datagram)
+		}()
+	}
+}
+
+// handleDatagram serves the commands in a single datagram with a
+// TextSession, and sends the responses back split across datagrams.
+func (s *Server) handleDatagram(pc net.PacketConn, addr net.Addr, datagram []byte) {
+	id := binary.BigEndian.Uint16(datagram[0:2])
+	seq := binary.BigEndian.Uint16(datagram[2:4])
+	total := binary.BigEndian.Uint16(datagram[4:6])
+	req := &udpRequest{in: bytes.NewReader(datagram[udpHeaderLength:]), local: pc.LocalAddr(), remote: addr}
+	if seq != 0 || total != 1 {
+		req.out.Write(udpMultiPacketRequest.Bytes())
+	} else {
+		session := protocol.NewTextSession(req, s.se, s, s.maxValSize, 0, 0)
+		s.enableAuth(session)
+		for session.Alive() {
+			if err := session.Serve(); err != nil {
+				if err != io.EOF {
+					glog.Errorf("error serving datagram: %v", err)
+				}
+				break
+			}
+		}
+	}
+	datagrams, ok := udpDatagrams(id, req.out.Bytes())
+	if !ok {
+		glog.Errorf("dropping response too large for udp: addr=%v bytes=%d", addr, req.out.Len())
+		return
+	}
+	for _, d := range datagrams {
+		if _, err := pc.WriteTo(d, addr); err != nil {
+			glog.Errorf("error writing datagram: %v", err)
+			return
+		}
+	}
+}
+
+// udpDatagrams splits a response into datagrams, each with a frame header
+// holding the request id, its sequence number and the number of datagrams.
+// It returns false if the response needs more datagrams than the header
+// can count.
+func udpDatagrams(id uint16, resp []byte) ([][]byte, bool) {
+	const payload = udpMaxDatagram - udpHeaderLength
+	total := (len(resp) + payload - 1) / payload
+	if total > 0xffff {
+		return nil, false
+	}
+	datagrams := make([][]byte, 0, total)
+	for seq := 0; seq < total; seq++ {
+		chunk := resp[seq*payload:]
+		if len(chunk) > payload {
+			chunk = chunk[:payload]
+		}
+		d := make([]byte, udpHeaderLength, udpHeaderLength+len(chunk))
+		binary.BigEndian.PutUint16(d[0:2], id)
+		binary.BigEndian.PutUint16(d[2:4], uint16(seq))
+		binary.BigEndian.PutUint16(d[4:6], uint16(total))
+		datagrams = append(datagrams, append(d, chunk...))
+	}
+	return datagrams, true
+}
+
+// udpRequest is the net.Conn a TextSession serves a datagram over: it reads
+// the commands of the datagram and collects the responses.
+type udpRequest struct {
+	in            *bytes.Reader
+	out           bytes.Buffer
+	local, remote net.Addr
+}
+
+func (r *udpRequest) Read(p []byte) (int, error)         { return r.in.Read(p) }
+func (r *udpRequest) Write(p []byte) (int, error)        { return r.out.Write(p) }
+func (r *udpRequest) Close() error                       { return nil }
+func (r *udpRequest) LocalAddr() net.Addr                { return r.local }
+func (r *udpRequest) RemoteAddr() net.Addr               { return r.remote }
+func (r *udpRequest) SetDeadline(t time.Time) error      { return nil }
+func (r *udpRequest) SetReadDeadline(t time.Time) error  { return nil }
+func (r *udpRequest) SetWriteDeadline(t time.Time) error { return nil }